@@ -0,0 +1,468 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// AdminLinkFilter narrows an admin link search
+type AdminLinkFilter struct {
+	Query  string
+	Owner  string
+	Limit  int
+	Offset int
+}
+
+// SetRoleRequest represents the request body for changing a user's role
+type SetRoleRequest struct {
+	Role string `json:"role"`
+}
+
+// SetPlanRequest represents the request body for moving a user or workspace to another plan
+type SetPlanRequest struct {
+	Plan string `json:"plan"`
+}
+
+// parsePage reads the limit and offset query parameters, defaulting limit to 100
+func parsePage(r *http.Request) (limit, offset int, err error) {
+	q := r.URL.Query()
+	limit = 100
+	if v := q.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > 500 {
+			return 0, 0, fmt.Errorf("limit must be between 1 and 500")
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("offset must be a non-negative integer")
+		}
+	}
+	return limit, offset, nil
+}
+
+// adminLink looks up the link in the {code} route variable regardless of owner
+func (h *Handlers) adminLink(w http.ResponseWriter, r *http.Request) (*ShortURL, bool) {
+	shortURL, err := h.db.GetByShortCodePrimary(r.Context(), mux.Vars(r)["code"])
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, ProblemNotFound, "Link not found")
+		return nil, false
+	}
+	if err != nil {
+		fmt.Println("Database error looking up link:", err)
+		writeServerError(w, r, err, "Database error")
+		return nil, false
+	}
+	return shortURL, true
+}
+
+// adminTargetUser looks up the user in the {userID} route variable. Admins
+// can't act on their own account so they can't lock themselves out.
+func (h *Handlers) adminTargetUser(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	target, err := h.db.GetUserByUserID(r.Context(), mux.Vars(r)["userID"])
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, ProblemNotFound, "User not found")
+		return nil, false
+	}
+	if err != nil {
+		fmt.Println("Database error looking up user:", err)
+		writeServerError(w, r, err, "Database error")
+		return nil, false
+	}
+	if target.ID == currentUser(r).ID {
+		writeError(w, r, http.StatusConflict, ProblemConflict, "Admins can't change their own account")
+		return nil, false
+	}
+	return target, true
+}
+
+// AdminListLinks handles GET /api/admin/links
+func (h *Handlers) AdminListLinks(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("AdminListLinks called")
+	limit, offset, err := parsePage(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ProblemInvalidRequest, err.Error())
+		return
+	}
+	filter := &AdminLinkFilter{
+		Query:  r.URL.Query().Get("q"),
+		Owner:  r.URL.Query().Get("owner"),
+		Limit:  limit,
+		Offset: offset,
+	}
+
+	links, err := h.db.SearchLinks(r.Context(), filter)
+	if err != nil {
+		fmt.Println("Database error searching links:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	writeJSON(w, http.StatusOK, links)
+}
+
+// AdminDisableLink handles POST /api/admin/links/{code}/disable
+func (h *Handlers) AdminDisableLink(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("AdminDisableLink called")
+	h.setLinkDisabled(w, r, true)
+}
+
+// AdminEnableLink handles POST /api/admin/links/{code}/enable
+func (h *Handlers) AdminEnableLink(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("AdminEnableLink called")
+	h.setLinkDisabled(w, r, false)
+}
+
+func (h *Handlers) setLinkDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	shortURL, ok := h.adminLink(w, r)
+	if !ok {
+		return
+	}
+	if (shortURL.DisabledAt != nil) == disabled {
+		writeJSON(w, http.StatusOK, shortURL)
+		return
+	}
+
+	updated, err := h.db.SetLinkDisabled(r.Context(), shortURL.ID, disabled)
+	if err != nil {
+		fmt.Println("Database error updating link:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	action := AuditAdminLinkEnable
+	if disabled {
+		action = AuditAdminLinkDisable
+	}
+	h.audit(r, currentUser(r), action, "link", updated.ShortCode, shortURL, updated)
+	writeJSON(w, http.StatusOK, updated)
+}
+
+// AdminDeleteLink handles DELETE /api/admin/links/{code} by moving any user's link to the trash
+func (h *Handlers) AdminDeleteLink(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("AdminDeleteLink called")
+	shortURL, ok := h.adminLink(w, r)
+	if !ok {
+		return
+	}
+	if shortURL.DeletedAt != nil {
+		writeError(w, r, http.StatusConflict, ProblemConflict, "Link is already in the trash")
+		return
+	}
+
+	deleted, err := h.db.SoftDelete(r.Context(), shortURL.ID)
+	if err != nil {
+		fmt.Println("Database error deleting link:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	h.audit(r, currentUser(r), AuditAdminLinkDelete, "link", deleted.ShortCode, shortURL, deleted)
+	writeJSON(w, http.StatusOK, deleted)
+}
+
+// AdminListUsers handles GET /api/admin/users
+func (h *Handlers) AdminListUsers(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("AdminListUsers called")
+	limit, offset, err := parsePage(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ProblemInvalidRequest, err.Error())
+		return
+	}
+
+	users, err := h.db.SearchUsers(r.Context(), r.URL.Query().Get("q"), limit, offset)
+	if err != nil {
+		fmt.Println("Database error searching users:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	writeJSON(w, http.StatusOK, users)
+}
+
+// AdminSetUserRole handles PUT /api/admin/users/{userID}/role
+func (h *Handlers) AdminSetUserRole(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("AdminSetUserRole called")
+	var req SetRoleRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if err := ValidateRole(req.Role); err != nil {
+		writeError(w, r, http.StatusBadRequest, ProblemInvalidRequest, err.Error())
+		return
+	}
+	target, ok := h.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	updated, err := h.db.SetUserRole(r.Context(), target.ID, req.Role)
+	if err != nil {
+		fmt.Println("Database error updating role:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	h.audit(r, currentUser(r), AuditAdminUserRole, "user", updated.UserID, target, updated)
+	writeJSON(w, http.StatusOK, updated)
+}
+
+// AdminSetUserPlan handles PUT /api/admin/users/{userID}/plan
+func (h *Handlers) AdminSetUserPlan(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("AdminSetUserPlan called")
+	var req SetPlanRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if err := h.ValidatePlan(req.Plan); err != nil {
+		writeError(w, r, http.StatusBadRequest, ProblemInvalidRequest, err.Error())
+		return
+	}
+	target, ok := h.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	updated, err := h.db.SetUserPlan(r.Context(), target.ID, req.Plan)
+	if err != nil {
+		fmt.Println("Database error updating plan:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	h.audit(r, currentUser(r), AuditAdminUserPlan, "user", updated.UserID, target, updated)
+	writeJSON(w, http.StatusOK, updated)
+}
+
+// AdminSetWorkspacePlan handles PUT /api/admin/workspaces/{workspaceID}/plan
+func (h *Handlers) AdminSetWorkspacePlan(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("AdminSetWorkspacePlan called")
+	var req SetPlanRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if err := h.ValidatePlan(req.Plan); err != nil {
+		writeError(w, r, http.StatusBadRequest, ProblemInvalidRequest, err.Error())
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["workspaceID"])
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, ProblemNotFound, "Workspace not found")
+		return
+	}
+
+	previous, err := h.db.GetWorkspacePlan(r.Context(), id)
+	var updated *Workspace
+	if err == nil {
+		updated, err = h.db.SetWorkspacePlan(r.Context(), id, req.Plan)
+	}
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, ProblemNotFound, "Workspace not found")
+		return
+	}
+	if err != nil {
+		fmt.Println("Database error updating plan:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	h.audit(r, currentUser(r), AuditAdminWorkspacePlan, "workspace", strconv.Itoa(id), map[string]any{"plan": previous}, map[string]any{"plan": updated.Plan})
+	writeJSON(w, http.StatusOK, updated)
+}
+
+// AdminDisableUser handles POST /api/admin/users/{userID}/disable
+func (h *Handlers) AdminDisableUser(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("AdminDisableUser called")
+	h.setUserDisabled(w, r, true)
+}
+
+// AdminEnableUser handles POST /api/admin/users/{userID}/enable
+func (h *Handlers) AdminEnableUser(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("AdminEnableUser called")
+	h.setUserDisabled(w, r, false)
+}
+
+func (h *Handlers) setUserDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	target, ok := h.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+	if (target.DisabledAt != nil) == disabled {
+		writeJSON(w, http.StatusOK, target)
+		return
+	}
+
+	updated, err := h.db.SetUserDisabled(r.Context(), target.ID, disabled)
+	if err != nil {
+		fmt.Println("Database error updating user:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	action := AuditAdminUserEnable
+	if disabled {
+		action = AuditAdminUserDisable
+	}
+	h.audit(r, currentUser(r), action, "user", updated.UserID, target, updated)
+	writeJSON(w, http.StatusOK, updated)
+}
+
+// AdminDeleteUser handles DELETE /api/admin/users/{userID}. The user's links
+// are kept but no longer have an owner. Deleting the last owner of a
+// workspace is refused.
+func (h *Handlers) AdminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("AdminDeleteUser called")
+	target, ok := h.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := h.db.DeleteUser(r.Context(), target.ID)
+	if err == ErrLastOwner {
+		writeError(w, r, http.StatusConflict, ProblemLastOwner, "The user is the last owner of a workspace; make someone else an owner first")
+		return
+	}
+	if err != nil {
+		fmt.Println("Database error deleting user:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	h.audit(r, currentUser(r), AuditAdminUserDelete, "user", target.UserID, target, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SearchLinks returns links of any owner, including deleted and disabled ones,
+// newest first. Query matches the short code or destination.
+func (db *Database) SearchLinks(ctx context.Context, filter *AdminLinkFilter) ([]*ShortURL, error) {
+	var conditions []string
+	var args []any
+	if filter.Query != "" {
+		args = append(args, "%"+escapeLike(filter.Query)+"%")
+		conditions = append(conditions, fmt.Sprintf("(short_code ILIKE $%d OR original_url ILIKE $%d)", len(args), len(args)))
+	}
+	if filter.Owner != "" {
+		args = append(args, filter.Owner)
+		conditions = append(conditions, fmt.Sprintf("owner_id = (SELECT id FROM users WHERE user_id = $%d)", len(args)))
+	}
+
+	query := `SELECT ` + shortURLColumns + ` FROM short_urls`
+	if len(conditions) > 0 {
+		query += ` WHERE ` + strings.Join(conditions, " AND ")
+	}
+	args = append(args, filter.Limit, filter.Offset)
+	query += fmt.Sprintf(` ORDER BY id DESC LIMIT $%d OFFSET $%d`, len(args)-1, len(args))
+	return db.queryShortURLs(ctx, query, args...)
+}
+
+// SetLinkDisabled disables or re-enables a link. Disabling releases its dedup
+// key so the destination isn't handed back to new shortens.
+func (db *Database) SetLinkDisabled(ctx context.Context, id int, disabled bool) (*ShortURL, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	query := `
+		UPDATE short_urls
+		SET disabled_at = CASE WHEN $2 THEN NOW() END,
+			dedup_key = CASE WHEN $2 THEN NULL ELSE dedup_key END
+		WHERE id = $1
+		RETURNING ` + shortURLColumns
+	return scanShortURL(db.conn.QueryRowContext(ctx, query, id, disabled))
+}
+
+// SearchUsers returns users whose user ID contains q, oldest first
+func (db *Database) SearchUsers(ctx context.Context, q string, limit, offset int) ([]*User, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	query := `SELECT ` + userColumns + ` FROM users WHERE user_id ILIKE $1 ORDER BY id LIMIT $2 OFFSET $3`
+	rows, err := db.conn.QueryContext(ctx, query, "%"+escapeLike(q)+"%", limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// SetUserRole changes a user's role
+func (db *Database) SetUserRole(ctx context.Context, id int, role string) (*User, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	query := `UPDATE users SET role = $2, updated_at = NOW() WHERE id = $1 RETURNING ` + userColumns
+	return scanUser(db.conn.QueryRowContext(ctx, query, id, role))
+}
+
+// SetUserDisabled disables or re-enables a user's account
+func (db *Database) SetUserDisabled(ctx context.Context, id int, disabled bool) (*User, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	query := `UPDATE users SET disabled_at = CASE WHEN $2 THEN NOW() END, updated_at = NOW() WHERE id = $1 RETURNING ` + userColumns
+	return scanUser(db.conn.QueryRowContext(ctx, query, id, disabled))
+}
+
+// DeleteUser removes a user, detaching their links in the same transaction. It
+// returns ErrLastOwner if that would leave one of their workspaces without an owner.
+func (db *Database) DeleteUser(ctx context.Context, id int) error {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var workspaceIDs []int
+	rows, err := tx.QueryContext(ctx, `SELECT workspace_id FROM workspace_members WHERE user_id = $1 AND role = $2`, id, WorkspaceOwner)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var workspaceID int
+		if err := rows.Scan(&workspaceID); err != nil {
+			rows.Close()
+			return err
+		}
+		workspaceIDs = append(workspaceIDs, workspaceID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, workspaceID := range workspaceIDs {
+		if err := checkOtherOwners(ctx, tx, workspaceID, id); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE short_urls SET owner_id = NULL WHERE owner_id = $1`, id); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// PromoteUser makes a user an admin and re-enables their account
+func (db *Database) PromoteUser(ctx context.Context, id int) (*User, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	query := `UPDATE users SET role = $2, disabled_at = NULL, updated_at = NOW() WHERE id = $1 RETURNING ` + userColumns
+	return scanUser(db.conn.QueryRowContext(ctx, query, id, RoleAdmin))
+}
+
+// escapeLike escapes the LIKE wildcards in s
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
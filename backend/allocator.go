@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrCodeAllocationFailed is returned when no free short code was found within the attempt budget
+var ErrCodeAllocationFailed = errors.New("could not allocate a unique short code")
+
+// AllocatorConfig configures short code allocation
+type AllocatorConfig struct {
+	// MaxAttempts bounds how many codes are tried per insert
+	MaxAttempts int
+	// GrowThreshold is the collision rate above which the code length grows by one
+	GrowThreshold float64
+	// GrowWindow is how many attempts are sampled before the collision rate is evaluated
+	GrowWindow int
+}
+
+// CodeAllocator inserts short URLs under freshly generated codes, relying on
+// the short_code unique constraint rather than a check-then-insert.
+type CodeAllocator struct {
+	db     *Database
+	cfg    AllocatorConfig
+	genCfg CodeGeneratorConfig
+
+	mu         sync.Mutex
+	gen        CodeGenerator
+	attempts   int
+	collisions int
+
+	totalAllocations uint64
+	totalCollisions  uint64
+	totalFailures    uint64
+}
+
+// NewCodeAllocator creates an allocator for the given generator configuration
+func NewCodeAllocator(db *Database, genCfg CodeGeneratorConfig, cfg AllocatorConfig) (*CodeAllocator, error) {
+	if cfg.MaxAttempts <= 0 {
+		return nil, fmt.Errorf("max attempts must be positive, got %d", cfg.MaxAttempts)
+	}
+	gen, err := NewCodeGenerator(genCfg)
+	if err != nil {
+		return nil, err
+	}
+	return &CodeAllocator{db: db, cfg: cfg, genCfg: genCfg, gen: gen}, nil
+}
+
+// Allocate assigns a unique short code to shortURL and inserts it, setting its ID.
+// If shortURL has a dedup key that is already taken, nothing is inserted and the
+// link holding the key is returned instead.
+func (a *CodeAllocator) Allocate(ctx context.Context, shortURL *ShortURL) (*ShortURL, error) {
+	for attempt := 0; attempt < a.cfg.MaxAttempts; attempt++ {
+		gen := a.generator()
+
+		var seq int64
+		if gen.UsesSequence() {
+			var err error
+			seq, err = a.db.NextSequence(ctx)
+			if err != nil {
+				return nil, err
+			}
+		}
+		code, err := gen.Generate(seq)
+		if err != nil {
+			return nil, err
+		}
+
+		shortURL.ShortCode = code
+		id, err := a.db.Create(ctx, shortURL)
+		if err == ErrInsertConflict {
+			if shortURL.DedupKey != nil {
+				existing, err := a.db.GetByDedupKey(ctx, *shortURL.DedupKey)
+				if err == nil && existing.isLive(time.Now()) {
+					return existing, nil
+				}
+				if err == nil {
+					// A link that stopped redirecting before the janitor got to it gives up its key
+					if err := a.db.ReleaseDedupKey(ctx, existing.ID, *shortURL.DedupKey); err != nil {
+						return nil, err
+					}
+					continue
+				}
+				if err != sql.ErrNoRows {
+					return nil, err
+				}
+			}
+			fmt.Println("Short code collision:", code)
+			a.record(true)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		a.record(false)
+		shortURL.ID = int(id)
+		return nil, nil
+	}
+
+	a.mu.Lock()
+	a.totalFailures++
+	a.mu.Unlock()
+	return nil, ErrCodeAllocationFailed
+}
+
+// generator returns the current generator
+func (a *CodeAllocator) generator() CodeGenerator {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.gen
+}
+
+// record tracks an insert attempt and grows the code length when collisions get too frequent
+func (a *CodeAllocator) record(collision bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.attempts++
+	if collision {
+		a.collisions++
+		a.totalCollisions++
+	} else {
+		a.totalAllocations++
+	}
+
+	if a.attempts < a.cfg.GrowWindow {
+		return
+	}
+	rate := float64(a.collisions) / float64(a.attempts)
+	a.attempts, a.collisions = 0, 0
+	if a.cfg.GrowThreshold <= 0 || rate < a.cfg.GrowThreshold || a.genCfg.Length >= maxCodeLength {
+		return
+	}
+
+	next := a.genCfg
+	next.Length++
+	gen, err := NewCodeGenerator(next)
+	if err != nil {
+		fmt.Println("Error growing short code length:", err)
+		return
+	}
+	fmt.Printf("Collision rate %.2f exceeded %.2f, growing short code length to %d\n", rate, a.cfg.GrowThreshold, next.Length)
+	a.genCfg, a.gen = next, gen
+}
+
+// AllocatorStats is a snapshot of allocation counters
+type AllocatorStats struct {
+	CodeLength          int
+	KeyspaceSize        float64
+	KeyspaceUsed        int64
+	KeyspaceUtilization float64
+	Allocations         uint64
+	Collisions          uint64
+	Failures            uint64
+}
+
+// Stats returns allocation counters and the utilization of the current keyspace
+func (a *CodeAllocator) Stats(ctx context.Context) (*AllocatorStats, error) {
+	a.mu.Lock()
+	stats := &AllocatorStats{
+		CodeLength:   a.genCfg.Length,
+		KeyspaceSize: a.gen.KeyspaceSize(),
+		Allocations:  a.totalAllocations,
+		Collisions:   a.totalCollisions,
+		Failures:     a.totalFailures,
+	}
+	a.mu.Unlock()
+
+	used, err := a.db.CountCodesOfLength(ctx, stats.CodeLength)
+	if err != nil {
+		return nil, err
+	}
+	stats.KeyspaceUsed = used
+	if stats.KeyspaceSize > 0 {
+		stats.KeyspaceUtilization = float64(used) / stats.KeyspaceSize
+	}
+	return stats, nil
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Audited actions
+const (
+	AuditSignup      = "user.signup"
+	AuditLogin       = "user.login"
+	AuditLoginFailed = "user.login_failed"
+	AuditLogout      = "user.logout"
+	AuditLogoutAll   = "user.logout_all"
+
+	AuditSessionRevoke = "session.revoke"
+
+	AuditPasswordChange       = "user.password_change"
+	AuditPasswordResetRequest = "user.password_reset_request"
+	AuditPasswordReset        = "user.password_reset"
+
+	AuditMFAEnable        = "user.mfa_enable"
+	AuditMFADisable       = "user.mfa_disable"
+	AuditMFARecoveryCodes = "user.mfa_recovery_codes"
+
+	AuditSSOProvision = "user.sso_provision"
+	AuditSSOLink      = "user.sso_link"
+	AuditSSOUnlink    = "user.sso_unlink"
+
+	AuditLinkCreate   = "link.create"
+	AuditLinkUpdate   = "link.update"
+	AuditLinkRollback = "link.rollback"
+	AuditLinkDelete   = "link.delete"
+	AuditLinkRestore  = "link.restore"
+
+	AuditAdminLinkDisable   = "admin.link_disable"
+	AuditAdminLinkEnable    = "admin.link_enable"
+	AuditAdminLinkDelete    = "admin.link_delete"
+	AuditAdminUserRole      = "admin.user_role"
+	AuditAdminUserPlan      = "admin.user_plan"
+	AuditAdminUserDisable   = "admin.user_disable"
+	AuditAdminUserEnable    = "admin.user_enable"
+	AuditAdminUserDelete    = "admin.user_delete"
+	AuditAdminCreate        = "admin.create_admin"
+	AuditAdminWorkspacePlan = "admin.workspace_plan"
+
+	AuditWorkspaceCreate       = "workspace.create"
+	AuditWorkspaceInvite       = "workspace.invite"
+	AuditWorkspaceInviteRevoke = "workspace.invite_revoke"
+	AuditWorkspaceJoin         = "workspace.join"
+	AuditWorkspaceMemberRole   = "workspace.member_role"
+	AuditWorkspaceMemberRemove = "workspace.member_remove"
+)
+
+// AuditEvent is an entry in the append-only audit log
+type AuditEvent struct {
+	ID         int64                  `json:"id"`
+	OccurredAt time.Time              `json:"occurred_at"`
+	ActorID    *int                   `json:"actor_id"`
+	Actor      string                 `json:"actor"`
+	Action     string                 `json:"action"`
+	IP         string                 `json:"ip"`
+	UserAgent  string                 `json:"user_agent"`
+	TargetType string                 `json:"target_type"`
+	TargetID   string                 `json:"target_id"`
+	Before     json.RawMessage        `json:"before,omitempty"`
+	After      json.RawMessage        `json:"after,omitempty"`
+	Diff       map[string]FieldChange `json:"diff,omitempty"`
+}
+
+// AuditFilter narrows an audit log query
+type AuditFilter struct {
+	Actor    string
+	Action   string
+	Since    *time.Time
+	Until    *time.Time
+	BeforeID int64
+	Limit    int
+}
+
+// audit records a security-relevant action. before and after are encoded as
+// JSON snapshots of the target; either may be nil. Failures are logged but
+// never fail the request that triggered them.
+func (h *Handlers) audit(r *http.Request, actor *User, action, targetType, targetID string, before, after any) {
+	event := &AuditEvent{
+		Action:     action,
+		IP:         clientIP(r),
+		UserAgent:  r.UserAgent(),
+		TargetType: targetType,
+		TargetID:   targetID,
+	}
+	if actor != nil {
+		event.ActorID = &actor.ID
+		event.Actor = actor.UserID
+	}
+	if !isNil(before) {
+		event.Before, _ = json.Marshal(before)
+	}
+	if !isNil(after) {
+		event.After, _ = json.Marshal(after)
+	}
+	if event.Before != nil && event.After != nil {
+		event.Diff = diffJSON(before, after)
+	}
+
+	// The change already happened, so record it even if the client has gone
+	if err := h.db.InsertAuditEvent(context.WithoutCancel(r.Context()), event); err != nil {
+		fmt.Println("Error writing audit event:", action, err)
+	}
+}
+
+// diffJSON returns the top-level JSON fields that differ between two values
+func diffJSON(before, after any) map[string]FieldChange {
+	b, _ := jsonValue(before).(map[string]any)
+	a, _ := jsonValue(after).(map[string]any)
+
+	changes := make(map[string]FieldChange)
+	for key := range a {
+		if !reflect.DeepEqual(b[key], a[key]) {
+			changes[key] = FieldChange{From: b[key], To: a[key]}
+		}
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			changes[key] = FieldChange{From: b[key], To: nil}
+		}
+	}
+	return changes
+}
+
+// isNil reports whether v is nil or a nil pointer, map or slice
+func isNil(v any) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Pointer, reflect.Map, reflect.Slice, reflect.Interface:
+		return rv.IsNil()
+	}
+	return false
+}
+
+// parseAuditFilter reads the actor, action, since, until, before_id and limit query parameters
+func parseAuditFilter(r *http.Request) (*AuditFilter, error) {
+	q := r.URL.Query()
+	filter := &AuditFilter{Actor: q.Get("actor"), Action: q.Get("action")}
+	for _, param := range []struct {
+		name   string
+		target **time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		if v := q.Get(param.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be an RFC 3339 time", param.name)
+			}
+			*param.target = &t
+		}
+	}
+	if v := q.Get("before_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("before_id must be an integer")
+		}
+		filter.BeforeID = id
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return nil, fmt.Errorf("limit must be a positive integer")
+		}
+		filter.Limit = limit
+	}
+	return filter, nil
+}
+
+// ListAuditEvents handles GET /api/admin/audit
+func (h *Handlers) ListAuditEvents(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("ListAuditEvents called")
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ProblemInvalidRequest, err.Error())
+		return
+	}
+	if filter.Limit == 0 || filter.Limit > 500 {
+		filter.Limit = 100
+	}
+
+	events, err := h.db.ListAuditEvents(r.Context(), filter, nil)
+	if err != nil {
+		fmt.Println("Database error listing audit events:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	writeJSON(w, http.StatusOK, events)
+}
+
+// ExportAuditEvents handles GET /api/admin/audit/export, streaming every
+// matching event as JSON Lines
+func (h *Handlers) ExportAuditEvents(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("ExportAuditEvents called")
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ProblemInvalidRequest, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+	encoder := json.NewEncoder(w)
+	if _, err := h.db.ListAuditEvents(r.Context(), filter, func(event *AuditEvent) error {
+		return encoder.Encode(event)
+	}); err != nil {
+		// Headers are already sent, so the best we can do is stop the stream
+		fmt.Println("Error exporting audit events:", err)
+	}
+}
+
+// CreateAuditTable creates the append-only audit_events table if it doesn't exist
+func (db *Database) CreateAuditTable(ctx context.Context) error {
+	fmt.Println("CreateAuditTable called")
+	query := `
+		CREATE TABLE IF NOT EXISTS audit_events (
+			id BIGSERIAL PRIMARY KEY,
+			occurred_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			actor_id INTEGER,
+			actor VARCHAR(50) NOT NULL DEFAULT '',
+			action VARCHAR(50) NOT NULL,
+			ip VARCHAR(45) NOT NULL DEFAULT '',
+			user_agent TEXT NOT NULL DEFAULT '',
+			target_type VARCHAR(30) NOT NULL DEFAULT '',
+			target_id VARCHAR(100) NOT NULL DEFAULT '',
+			before JSONB,
+			after JSONB,
+			diff JSONB
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_audit_occurred_at ON audit_events(occurred_at);
+		CREATE INDEX IF NOT EXISTS idx_audit_actor ON audit_events(actor);
+		CREATE INDEX IF NOT EXISTS idx_audit_action ON audit_events(action);
+
+		CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION 'audit_events is append-only';
+		END;
+		$$ LANGUAGE plpgsql;
+
+		DO $$
+		BEGIN
+			IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'audit_events_append_only') THEN
+				CREATE TRIGGER audit_events_append_only
+					BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_events
+					FOR EACH STATEMENT EXECUTE FUNCTION audit_events_append_only();
+			END IF;
+		END;
+		$$;
+	`
+
+	_, err := db.conn.ExecContext(ctx, query)
+	return err
+}
+
+// InsertAuditEvent appends an event to the audit log
+func (db *Database) InsertAuditEvent(ctx context.Context, event *AuditEvent) error {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	var diff []byte
+	if len(event.Diff) > 0 {
+		var err error
+		if diff, err = json.Marshal(event.Diff); err != nil {
+			return err
+		}
+	}
+	query := `
+		INSERT INTO audit_events (actor_id, actor, action, ip, user_agent, target_type, target_id, before, after, diff)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING id, occurred_at`
+	return db.conn.QueryRowContext(ctx, query, event.ActorID, event.Actor, event.Action, event.IP, event.UserAgent,
+		event.TargetType, event.TargetID, nullJSON(event.Before), nullJSON(event.After), nullJSON(diff),
+	).Scan(&event.ID, &event.OccurredAt)
+}
+
+// ListAuditEvents returns events matching filter, newest first. If each is
+// non-nil, rows are streamed to it instead of being collected.
+func (db *Database) ListAuditEvents(ctx context.Context, filter *AuditFilter, each func(*AuditEvent) error) ([]*AuditEvent, error) {
+	var conditions []string
+	var args []any
+	add := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if filter.Actor != "" {
+		add("actor = $%d", filter.Actor)
+	}
+	if filter.Action != "" {
+		add("action = $%d", filter.Action)
+	}
+	if filter.Since != nil {
+		add("occurred_at >= $%d", *filter.Since)
+	}
+	if filter.Until != nil {
+		add("occurred_at < $%d", *filter.Until)
+	}
+	if filter.BeforeID > 0 {
+		add("id < $%d", filter.BeforeID)
+	}
+
+	query := `SELECT id, occurred_at, actor_id, actor, action, ip, user_agent, target_type, target_id, before, after, diff FROM audit_events`
+	if len(conditions) > 0 {
+		query += ` WHERE ` + strings.Join(conditions, " AND ")
+	}
+	query += ` ORDER BY id DESC`
+	if filter.Limit > 0 {
+		query += ` LIMIT ` + strconv.Itoa(filter.Limit)
+	}
+
+	// Streamed exports can run for longer than one query is normally allowed,
+	// bounded only by ctx
+	if each == nil {
+		var cancel context.CancelFunc
+		ctx, cancel = db.queryContext(ctx)
+		defer cancel()
+	}
+	rows, err := db.conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*AuditEvent{}
+	for rows.Next() {
+		event := &AuditEvent{}
+		var before, after, diff []byte
+		if err := rows.Scan(&event.ID, &event.OccurredAt, &event.ActorID, &event.Actor, &event.Action, &event.IP,
+			&event.UserAgent, &event.TargetType, &event.TargetID, &before, &after, &diff); err != nil {
+			return nil, err
+		}
+		event.Before, event.After = before, after
+		if diff != nil {
+			if err := json.Unmarshal(diff, &event.Diff); err != nil {
+				return nil, err
+			}
+		}
+		if each != nil {
+			if err := each(event); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// nullJSON maps empty JSON to a SQL NULL
+func nullJSON(data []byte) any {
+	if len(data) == 0 {
+		return nil
+	}
+	return string(data)
+}
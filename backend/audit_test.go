@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiffJSON(t *testing.T) {
+	type target struct {
+		Role     string  `json:"role"`
+		Disabled bool    `json:"disabled"`
+		Email    *string `json:"email,omitempty"`
+	}
+	tests := []struct {
+		name   string
+		before any
+		after  any
+		want   map[string]FieldChange
+	}{
+		{"unchanged", target{Role: RoleUser}, target{Role: RoleUser}, map[string]FieldChange{}},
+		{
+			"one field",
+			target{Role: RoleUser},
+			target{Role: RoleAdmin},
+			map[string]FieldChange{"role": {From: RoleUser, To: RoleAdmin}},
+		},
+		{
+			"several fields",
+			target{Role: RoleUser},
+			target{Role: RoleModerator, Disabled: true},
+			map[string]FieldChange{"role": {From: RoleUser, To: RoleModerator}, "disabled": {From: false, To: true}},
+		},
+		{
+			"field added",
+			target{},
+			target{Email: stringPtr("a@example.com")},
+			map[string]FieldChange{"email": {From: nil, To: "a@example.com"}},
+		},
+		{
+			"field removed",
+			target{Email: stringPtr("a@example.com")},
+			target{},
+			map[string]FieldChange{"email": {From: "a@example.com", To: nil}},
+		},
+		{
+			"pointers",
+			&target{Role: RoleUser},
+			&target{Role: RoleAdmin},
+			map[string]FieldChange{"role": {From: RoleUser, To: RoleAdmin}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := diffJSON(tt.before, tt.after); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffJSON = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsNil(t *testing.T) {
+	var user *User
+	var links []*ShortURL
+	var fields map[string]any
+	tests := []struct {
+		name string
+		v    any
+		want bool
+	}{
+		{"nil", nil, true},
+		{"nil pointer", user, true},
+		{"nil slice", links, true},
+		{"nil map", fields, true},
+		{"pointer", &User{}, false},
+		{"empty slice", []*ShortURL{}, false},
+		{"struct", User{}, false},
+		{"string", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isNil(tt.v); got != tt.want {
+				t.Errorf("isNil = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAuditFilter(t *testing.T) {
+	since := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	until := time.Date(2024, 3, 2, 12, 0, 0, 0, time.FixedZone("", 2*60*60))
+	tests := []struct {
+		name    string
+		query   string
+		want    *AuditFilter
+		wantErr string
+	}{
+		{"empty", "", &AuditFilter{}, ""},
+		{"actor and action", "actor=alice&action=user.login", &AuditFilter{Actor: "alice", Action: "user.login"}, ""},
+		{"time range", "since=2024-03-01T00:00:00Z&until=2024-03-02T12:00:00%2B02:00", &AuditFilter{Since: &since, Until: &until}, ""},
+		{"paging", "before_id=120&limit=50", &AuditFilter{BeforeID: 120, Limit: 50}, ""},
+		{"bad since", "since=yesterday", nil, "since must be an RFC 3339 time"},
+		{"date only until", "until=2024-03-02", nil, "until must be an RFC 3339 time"},
+		{"bad before_id", "before_id=abc", nil, "before_id must be an integer"},
+		{"zero limit", "limit=0", nil, "limit must be a positive integer"},
+		{"negative limit", "limit=-5", nil, "limit must be a positive integer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseAuditFilter(httptest.NewRequest(http.MethodGet, "/api/admin/audit?"+tt.query, nil))
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("parseAuditFilter error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseAuditFilter: %v", err)
+			}
+			if got.Actor != tt.want.Actor || got.Action != tt.want.Action || got.BeforeID != tt.want.BeforeID || got.Limit != tt.want.Limit {
+				t.Errorf("parseAuditFilter = %+v, want %+v", got, tt.want)
+			}
+			for _, times := range [][2]*time.Time{{got.Since, tt.want.Since}, {got.Until, tt.want.Until}} {
+				if (times[0] == nil) != (times[1] == nil) || (times[0] != nil && !times[0].Equal(*times[1])) {
+					t.Errorf("parseAuditFilter times = %v, %v, want %v, %v", got.Since, got.Until, tt.want.Since, tt.want.Until)
+				}
+			}
+		})
+	}
+}
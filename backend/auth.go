@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidToken is returned when an auth token is unknown, revoked or expired
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// TokenSigner signs values such as unlock cookies and login challenges with the server's HMAC secret
+type TokenSigner struct {
+	secret []byte
+}
+
+// NewTokenSigner creates a token signer. If secret is empty a random one is
+// generated, which invalidates all signed values whenever the server restarts.
+func NewTokenSigner(secret string) *TokenSigner {
+	key := []byte(secret)
+	if len(key) == 0 {
+		log.Println("AUTH_SECRET not set, generating a random secret. Signed cookies will not survive restarts.")
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			log.Fatal("Failed to generate auth secret:", err)
+		}
+	}
+	return &TokenSigner{secret: key}
+}
+
+// Issue returns a token of the form purpose.base64(subject).expires_unix.signature
+// that Verify accepts for the same purpose until ttl has passed
+func (s *TokenSigner) Issue(purpose, subject string, ttl time.Duration) string {
+	payload := purpose + "." + base64.RawURLEncoding.EncodeToString([]byte(subject)) + "." +
+		strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	return payload + "." + s.sign(payload)
+}
+
+// Verify checks a token's purpose, signature and expiry and returns its subject
+func (s *TokenSigner) Verify(purpose, token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 || parts[0] != purpose {
+		return "", ErrInvalidToken
+	}
+	payload := strings.Join(parts[:3], ".")
+	if !hmac.Equal([]byte(parts[3]), []byte(s.sign(payload))) {
+		return "", ErrInvalidToken
+	}
+	expires, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", ErrInvalidToken
+	}
+	subject, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	return string(subject), nil
+}
+
+func (s *TokenSigner) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer <token>" header
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+// authenticatedUser returns the user making the request, or nil for anonymous
+// requests. A token that is present but invalid is an error.
+func (h *Handlers) authenticatedUser(r *http.Request) (*User, error) {
+	user, _, err := h.authenticate(r)
+	return user, err
+}
+
+// authenticate returns the user and session for the request's bearer token,
+// or nils for anonymous requests. Users whose role requires two-factor
+// authentication are refused until they have enabled it.
+func (h *Handlers) authenticate(r *http.Request) (*User, *Session, error) {
+	user, session, err := h.authenticateSession(r)
+	if err != nil || user == nil {
+		return user, session, err
+	}
+	required, err := h.mfaRequired(r.Context(), user)
+	if err != nil {
+		return nil, nil, err
+	}
+	if required {
+		return nil, nil, ErrMFAEnrollmentRequired
+	}
+	return user, session, nil
+}
+
+// authenticateSession is authenticate without the two-factor enrollment check
+func (h *Handlers) authenticateSession(r *http.Request) (*User, *Session, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return nil, nil, nil
+	}
+	session, err := h.db.GetSession(r.Context(), hashSessionToken(token))
+	if err == sql.ErrNoRows {
+		return nil, nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err := h.db.GetUserByID(r.Context(), session.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if user.DisabledAt != nil {
+		return nil, nil, ErrAccountDisabled
+	}
+	return user, session, nil
+}
+
+// writeAuthError writes the response for an error from authenticatedUser
+func writeAuthError(w http.ResponseWriter, r *http.Request, err error) {
+	fmt.Println("Error authenticating request:", err)
+	switch {
+	case errors.Is(err, ErrInvalidToken):
+		writeError(w, r, http.StatusUnauthorized, ProblemInvalidToken, "Invalid or expired token")
+	case errors.Is(err, ErrAccountDisabled):
+		writeError(w, r, http.StatusForbidden, ProblemAccountDisabled, "Account disabled")
+	case errors.Is(err, ErrMFAEnrollmentRequired):
+		writeError(w, r, http.StatusForbidden, ProblemMFAEnrollmentRequired, "Two-factor authentication must be enabled for your account")
+	default:
+		writeServerError(w, r, err, "Database error")
+	}
+}
+
+// requireSession returns the authenticated user and their session, writing a
+// 401 if there is none
+func (h *Handlers) requireSession(w http.ResponseWriter, r *http.Request) (*User, *Session, bool) {
+	user, session, err := h.authenticate(r)
+	if err != nil {
+		writeAuthError(w, r, err)
+		return nil, nil, false
+	}
+	if session == nil {
+		writeError(w, r, http.StatusUnauthorized, ProblemAuthRequired, "Authentication required")
+		return nil, nil, false
+	}
+	return user, session, true
+}
+
+// requireUser returns the authenticated user, writing a 401 if there is none
+func (h *Handlers) requireUser(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	user, err := h.authenticatedUser(r)
+	if err != nil {
+		writeAuthError(w, r, err)
+		return nil, false
+	}
+	if user == nil {
+		writeError(w, r, http.StatusUnauthorized, ProblemAuthRequired, "Authentication required")
+		return nil, false
+	}
+	return user, true
+}
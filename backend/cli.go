@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// runCommand runs the CLI subcommand named in args, if any. It reports
+// whether a subcommand was run so main knows not to start the server.
+func runCommand(db *Database, config *Config, args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+	switch args[0] {
+	case "create-admin":
+		return true, createAdmin(db, config, args[1:])
+	default:
+		return true, fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// createAdmin handles `create-admin -user <id>`. An existing user is promoted
+// to admin and re-enabled; otherwise a new admin is created. The password is
+// read from ADMIN_PASSWORD or the first line of stdin and is only used when
+// creating a user.
+func createAdmin(db *Database, config *Config, args []string) error {
+	fs := flag.NewFlagSet("create-admin", flag.ContinueOnError)
+	userID := fs.String("user", "", "user ID of the admin")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *userID == "" {
+		return errors.New("-user is required")
+	}
+	*userID = NormalizeUserID(*userID)
+	ctx := context.Background()
+
+	existing, err := db.GetUserByUserID(ctx, *userID)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	var user *User
+	if existing != nil {
+		if user, err = db.PromoteUser(ctx, existing.ID); err != nil {
+			return err
+		}
+		fmt.Printf("Promoted %s to admin\n", user.UserID)
+	} else {
+		if fieldErrors := config.UserIDPolicy.Check(*userID); len(fieldErrors) > 0 {
+			return errors.New(fieldErrors[0].Message)
+		}
+		password, err := readAdminPassword()
+		if err != nil {
+			return err
+		}
+		if fieldErrors := config.PasswordPolicy.Check("password", password, *userID); len(fieldErrors) > 0 {
+			return errors.New(fieldErrors[0].Message)
+		}
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		if user, err = db.CreateUser(ctx, *userID, string(hashedPassword)); err != nil {
+			return err
+		}
+		if user, err = db.PromoteUser(ctx, user.ID); err != nil {
+			return err
+		}
+		fmt.Printf("Created admin %s\n", user.UserID)
+	}
+
+	event := &AuditEvent{Actor: "cli", Action: AuditAdminCreate, TargetType: "user", TargetID: user.UserID}
+	if err := db.InsertAuditEvent(ctx, event); err != nil {
+		fmt.Println("Error writing audit event:", AuditAdminCreate, err)
+	}
+	return nil
+}
+
+// readAdminPassword returns ADMIN_PASSWORD, falling back to a line from stdin
+func readAdminPassword() (string, error) {
+	if password := os.Getenv("ADMIN_PASSWORD"); password != "" {
+		return password, nil
+	}
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("reading password: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxAnalyticsRange is the longest period one analytics request can cover
+const maxAnalyticsRange = 366 * 24 * time.Hour
+
+// defaultAnalyticsRange is the period reported when since isn't given
+const defaultAnalyticsRange = 30 * 24 * time.Hour
+
+//go:embed bot_user_agents.txt
+var builtinBotUserAgents string
+
+// BotDetector tells clicks by crawlers, link unfurlers, health checkers and
+// scripts apart from clicks by people
+type BotDetector struct {
+	patterns []string
+}
+
+// NewBotDetector builds a detector from the built-in User-Agent list plus the
+// patterns in extraFile, if set
+func NewBotDetector(extraFile string) (*BotDetector, error) {
+	patterns := parsePatternList(builtinBotUserAgents)
+	if extraFile != "" {
+		extra, err := os.ReadFile(extraFile)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, parsePatternList(string(extra))...)
+	}
+	return &BotDetector{patterns: patterns}, nil
+}
+
+// parsePatternList reads one lowercase pattern per line, skipping blanks and # comments
+func parsePatternList(text string) []string {
+	var patterns []string
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			patterns = append(patterns, strings.ToLower(line))
+		}
+	}
+	return patterns
+}
+
+// IsBot reports whether r comes from a bot: a HEAD request, which browsers
+// don't send when following a link, a missing User-Agent, or one on the list
+func (d *BotDetector) IsBot(r *http.Request) bool {
+	if r.Method == http.MethodHead {
+		return true
+	}
+	userAgent := strings.ToLower(strings.TrimSpace(r.UserAgent()))
+	if userAgent == "" {
+		return true
+	}
+	for _, pattern := range d.patterns {
+		if strings.Contains(userAgent, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// VisitorHasher identifies visitors for unique counts without storing who they
+// are: a visitor is a hash of their IP and User-Agent with a random salt that
+// changes every UTC day. Old salts are deleted, so hashes can't be traced back
+// or linked across days.
+type VisitorHasher struct {
+	db *Database
+
+	mu   sync.Mutex
+	day  time.Time
+	salt []byte
+}
+
+// NewVisitorHasher creates a hasher keeping its daily salts in db
+func NewVisitorHasher(db *Database) *VisitorHasher {
+	return &VisitorHasher{db: db}
+}
+
+// Hash returns the visitor ID for ip and userAgent at now
+func (v *VisitorHasher) Hash(ctx context.Context, ip, userAgent string, now time.Time) (string, error) {
+	salt, err := v.saltFor(ctx, utcDay(now))
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(string(salt) + "\x00" + ip + "\x00" + userAgent))
+	return hex.EncodeToString(sum[:16]), nil
+}
+
+// saltFor returns the salt for day, shared by every instance through the database
+func (v *VisitorHasher) saltFor(ctx context.Context, day time.Time) ([]byte, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.salt != nil && v.day.Equal(day) {
+		return v.salt, nil
+	}
+
+	candidate := make([]byte, 32)
+	if _, err := rand.Read(candidate); err != nil {
+		return nil, err
+	}
+	salt, err := v.db.VisitorSalt(ctx, day, candidate)
+	if err != nil {
+		return nil, err
+	}
+	v.day, v.salt = day, salt
+	return salt, nil
+}
+
+// utcDay returns the start of t's UTC day
+func utcDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// recordClick stores a click on shortURL for analytics. Failures are logged
+// rather than stopping the visitor.
+func (h *Handlers) recordClick(r *http.Request, shortURL *ShortURL, isBot bool) {
+	ua := ParseUserAgent(r.UserAgent())
+	if isBot {
+		ua.DeviceType = DeviceBot
+	}
+	click := &Click{LinkID: shortURL.ID, ClickedAt: time.Now(), IsBot: isBot, UserAgent: ua}
+	if !isBot {
+		visitor, err := h.visitors.Hash(r.Context(), clientIP(r), r.UserAgent(), click.ClickedAt)
+		if err != nil {
+			fmt.Println("Error hashing visitor:", err)
+		} else {
+			click.VisitorHash = &visitor
+		}
+	}
+	if err := h.db.InsertClick(r.Context(), click); err != nil {
+		fmt.Println("Error recording click:", err)
+	}
+}
+
+// Click is one visit to a link's destination
+type Click struct {
+	LinkID      int
+	ClickedAt   time.Time
+	IsBot       bool
+	VisitorHash *string
+	UserAgent
+}
+
+// ClickCounts summarizes clicks over a period. Unique visitors are counted per
+// UTC day, so over several days a returning visitor is counted once a day.
+type ClickCounts struct {
+	Total          int64 `json:"total"`
+	Human          int64 `json:"human"`
+	Bot            int64 `json:"bot"`
+	UniqueVisitors int64 `json:"unique_visitors"`
+}
+
+// DailyClicks is the clicks on one UTC day
+type DailyClicks struct {
+	Date string `json:"date"`
+	ClickCounts
+}
+
+// LinkAnalytics is the response for GET /api/links/{code}/analytics
+type LinkAnalytics struct {
+	ShortCode string    `json:"short_code"`
+	Since     time.Time `json:"since"`
+	Until     time.Time `json:"until"`
+	ClickCounts
+	Daily  []DailyClicks `json:"daily"`
+	Groups []ClickGroup  `json:"groups,omitempty"`
+}
+
+// ClickGroup is the clicks whose group_by dimension has one value
+type ClickGroup struct {
+	Value string `json:"value"`
+	ClickCounts
+}
+
+// clickDimensions maps the group_by values LinkAnalytics accepts to the SQL
+// expressions they group by. Clicks recorded before user agents were parsed
+// have no dimensions and are grouped as "unknown".
+var clickDimensions = map[string]string{
+	"device_type":     "device_type",
+	"browser":         "browser",
+	"browser_version": "COALESCE(browser || ' ' || NULLIF(browser_version, ''), browser)",
+	"os":              "os",
+	"os_version":      "COALESCE(os || ' ' || NULLIF(os_version, ''), os)",
+}
+
+// LinkAnalytics handles GET /api/links/{code}/analytics?since=&until=&group_by=,
+// with RFC 3339 times defaulting to the last 30 days. group_by breaks the
+// counts down by device_type, browser, browser_version, os or os_version.
+func (h *Handlers) LinkAnalytics(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("LinkAnalytics called")
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+	shortURL, ok := h.accessibleLink(w, r, user, WorkspaceViewer)
+	if !ok {
+		return
+	}
+
+	until := time.Now().UTC()
+	if value := r.URL.Query().Get("until"); value != "" {
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, ProblemInvalidRequest, "until must be an RFC 3339 time")
+			return
+		}
+		until = t
+	}
+	since := until.Add(-defaultAnalyticsRange)
+	if value := r.URL.Query().Get("since"); value != "" {
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, ProblemInvalidRequest, "since must be an RFC 3339 time")
+			return
+		}
+		since = t
+	}
+	if !since.Before(until) {
+		writeError(w, r, http.StatusBadRequest, ProblemInvalidRequest, "since must be before until")
+		return
+	}
+	if until.Sub(since) > maxAnalyticsRange {
+		writeError(w, r, http.StatusBadRequest, ProblemInvalidRequest, "The period can be at most 366 days")
+		return
+	}
+	groupBy := r.URL.Query().Get("group_by")
+	if _, ok := clickDimensions[groupBy]; groupBy != "" && !ok {
+		writeError(w, r, http.StatusBadRequest, ProblemInvalidRequest, "group_by must be one of device_type, browser, browser_version, os or os_version")
+		return
+	}
+
+	daily, err := h.db.DailyClicks(r.Context(), shortURL.ID, since, until)
+	if err != nil {
+		fmt.Println("Database error reading analytics:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	analytics := &LinkAnalytics{ShortCode: shortURL.ShortCode, Since: since, Until: until, Daily: daily}
+	for _, day := range daily {
+		analytics.Total += day.Total
+		analytics.Human += day.Human
+		analytics.Bot += day.Bot
+		analytics.UniqueVisitors += day.UniqueVisitors
+	}
+	if groupBy != "" {
+		analytics.Groups, err = h.db.ClickGroups(r.Context(), shortURL.ID, since, until, groupBy)
+		if err != nil {
+			fmt.Println("Database error grouping analytics:", err)
+			writeServerError(w, r, err, "Database error")
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, analytics)
+}
+
+// CreateClickTables creates the link_clicks and visitor_salts tables if they
+// don't exist, and adds the user agent dimensions to older link_clicks tables
+func (db *Database) CreateClickTables(ctx context.Context) error {
+	query := `
+		CREATE TABLE IF NOT EXISTS link_clicks (
+			id BIGSERIAL PRIMARY KEY,
+			link_id INTEGER NOT NULL REFERENCES short_urls(id) ON DELETE CASCADE,
+			clicked_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			is_bot BOOLEAN NOT NULL,
+			visitor_hash TEXT
+		);
+		CREATE INDEX IF NOT EXISTS idx_link_clicks_link_time ON link_clicks(link_id, clicked_at);
+		ALTER TABLE link_clicks ADD COLUMN IF NOT EXISTS browser TEXT;
+		ALTER TABLE link_clicks ADD COLUMN IF NOT EXISTS browser_version TEXT;
+		ALTER TABLE link_clicks ADD COLUMN IF NOT EXISTS os TEXT;
+		ALTER TABLE link_clicks ADD COLUMN IF NOT EXISTS os_version TEXT;
+		ALTER TABLE link_clicks ADD COLUMN IF NOT EXISTS device_type TEXT;
+
+		CREATE TABLE IF NOT EXISTS visitor_salts (
+			day DATE PRIMARY KEY,
+			salt BYTEA NOT NULL
+		);`
+	_, err := db.conn.ExecContext(ctx, query)
+	return err
+}
+
+// InsertClick stores a click
+func (db *Database) InsertClick(ctx context.Context, click *Click) error {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	query := `
+		INSERT INTO link_clicks (link_id, clicked_at, is_bot, visitor_hash, browser, browser_version, os, os_version, device_type)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+	_, err := db.conn.ExecContext(ctx, query, click.LinkID, click.ClickedAt, click.IsBot, click.VisitorHash,
+		click.Browser, click.BrowserVersion, click.OS, click.OSVersion, click.DeviceType)
+	return err
+}
+
+// VisitorSalt returns the visitor salt for day, storing candidate if the day
+// has none yet, and deletes the salts of earlier days
+func (db *Database) VisitorSalt(ctx context.Context, day time.Time, candidate []byte) ([]byte, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	query := `
+		WITH inserted AS (
+			INSERT INTO visitor_salts (day, salt) VALUES ($1, $2)
+			ON CONFLICT (day) DO NOTHING
+			RETURNING salt
+		)
+		SELECT salt FROM inserted
+		UNION ALL
+		SELECT salt FROM visitor_salts WHERE day = $1
+		LIMIT 1`
+	var salt []byte
+	if err := db.conn.QueryRowContext(ctx, query, day, candidate).Scan(&salt); err != nil {
+		return nil, err
+	}
+	if _, err := db.conn.ExecContext(ctx, `DELETE FROM visitor_salts WHERE day < $1`, day); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// DailyClicks counts a link's clicks in [since, until) per UTC day, reading
+// from a replica if there is a healthy one
+func (db *Database) DailyClicks(ctx context.Context, linkID int, since, until time.Time) ([]DailyClicks, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	query := `
+		SELECT (clicked_at AT TIME ZONE 'UTC')::date AS day,
+			COUNT(*),
+			COUNT(*) FILTER (WHERE NOT is_bot),
+			COUNT(*) FILTER (WHERE is_bot),
+			COUNT(DISTINCT visitor_hash)
+		FROM link_clicks
+		WHERE link_id = $1 AND clicked_at >= $2 AND clicked_at < $3
+		GROUP BY day
+		ORDER BY day`
+	var daily []DailyClicks
+	err := db.readReplica(ctx, func(conn *sql.DB) error {
+		rows, err := conn.QueryContext(ctx, query, linkID, since, until)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		daily = []DailyClicks{}
+		for rows.Next() {
+			var day time.Time
+			var counts ClickCounts
+			if err := rows.Scan(&day, &counts.Total, &counts.Human, &counts.Bot, &counts.UniqueVisitors); err != nil {
+				return err
+			}
+			daily = append(daily, DailyClicks{Date: day.Format("2006-01-02"), ClickCounts: counts})
+		}
+		return rows.Err()
+	})
+	return daily, err
+}
+
+// ClickGroups counts a link's clicks in [since, until) per value of dimension,
+// one of the clickDimensions, most clicked first. Unique visitors are counted
+// per UTC day and summed, like the daily counts. Reads from a replica if there
+// is a healthy one.
+func (db *Database) ClickGroups(ctx context.Context, linkID int, since, until time.Time, dimension string) ([]ClickGroup, error) {
+	expr, ok := clickDimensions[dimension]
+	if !ok {
+		return nil, fmt.Errorf("unknown click dimension %q", dimension)
+	}
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	query := `
+		SELECT value, SUM(total), SUM(human), SUM(bot), SUM(unique_visitors)
+		FROM (
+			SELECT (clicked_at AT TIME ZONE 'UTC')::date AS day,
+				COALESCE(` + expr + `, 'unknown') AS value,
+				COUNT(*) AS total,
+				COUNT(*) FILTER (WHERE NOT is_bot) AS human,
+				COUNT(*) FILTER (WHERE is_bot) AS bot,
+				COUNT(DISTINCT visitor_hash) AS unique_visitors
+			FROM link_clicks
+			WHERE link_id = $1 AND clicked_at >= $2 AND clicked_at < $3
+			GROUP BY day, value
+		) daily
+		GROUP BY value
+		ORDER BY SUM(total) DESC, value`
+	var groups []ClickGroup
+	err := db.readReplica(ctx, func(conn *sql.DB) error {
+		rows, err := conn.QueryContext(ctx, query, linkID, since, until)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		groups = []ClickGroup{}
+		for rows.Next() {
+			var group ClickGroup
+			if err := rows.Scan(&group.Value, &group.Total, &group.Human, &group.Bot, &group.UniqueVisitors); err != nil {
+				return err
+			}
+			groups = append(groups, group)
+		}
+		return rows.Err()
+	})
+	return groups, err
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBotDetectorIsBot(t *testing.T) {
+	extra := filepath.Join(t.TempDir(), "bots.txt")
+	if err := os.WriteFile(extra, []byte("# in-house monitoring\nAcmeProbe\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	detector, err := NewBotDetector(extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		method    string
+		userAgent string
+		want      bool
+	}{
+		{"browser", http.MethodGet, "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36", false},
+		{"mobile browser", http.MethodGet, "Mozilla/5.0 (iPhone; CPU iPhone OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Mobile/15E148 Safari/604.1", false},
+		{"HEAD request", http.MethodHead, "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36", true},
+		{"no User-Agent", http.MethodGet, "", true},
+		{"blank User-Agent", http.MethodGet, "   ", true},
+		{"search crawler", http.MethodGet, "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", true},
+		{"link unfurler", http.MethodGet, "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)", true},
+		{"mixed case", http.MethodGet, "Mozilla/5.0 (compatible; BINGBOT/2.0)", true},
+		{"extra pattern", http.MethodGet, "acmeprobe/3.1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/abc123", nil)
+			r.Header.Set("User-Agent", tt.userAgent)
+			if got := detector.IsBot(r); got != tt.want {
+				t.Errorf("IsBot = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewBotDetectorMissingFile(t *testing.T) {
+	if _, err := NewBotDetector(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("NewBotDetector succeeded with a missing file, want error")
+	}
+}
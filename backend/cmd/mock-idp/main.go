@@ -0,0 +1,33 @@
+// Command mock-idp is a minimal OpenID Connect provider for trying out and
+// testing single sign-on locally. It accepts any user without a password:
+//
+//	go run ./cmd/mock-idp -addr :9000
+//
+// then start the backend with OIDC_ISSUER=http://localhost:9000 and
+// OIDC_CLIENT_ID=shorturl. Adding login_hint=<name> to the authorization URL
+// skips the form, which makes the flow scriptable with curl.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"shorturl-backend/internal/mockidp"
+)
+
+func main() {
+	addr := flag.String("addr", ":9000", "listen address")
+	issuer := flag.String("issuer", "http://localhost:9000", "issuer URL, as reached by the backend and the browser")
+	clientID := flag.String("client-id", "shorturl", "accepted client ID")
+	clientSecret := flag.String("client-secret", "", "required client secret, if any")
+	flag.Parse()
+
+	p, err := mockidp.New(*issuer, *clientID, *clientSecret)
+	if err != nil {
+		log.Fatal("Failed to generate signing key:", err)
+	}
+
+	log.Printf("Mock IdP %s listening on %s", p.Issuer(), *addr)
+	log.Fatal(http.ListenAndServe(*addr, p.Handler()))
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+)
+
+const (
+	// ambiguousChars are characters that are easily confused when read aloud or printed
+	ambiguousChars = "0O1lI"
+
+	// Code generation strategies
+	StrategyRandom        = "random"
+	StrategySequence      = "sequence"
+	StrategyHashID        = "hashid"
+	StrategyPronounceable = "pronounceable"
+
+	// maxCodeLength is the widest short code the short_urls table can store
+	maxCodeLength = 32
+)
+
+// CodeGenerator produces short codes. seq is a unique, monotonically
+// increasing number from the database; strategies that don't need it ignore it.
+type CodeGenerator interface {
+	Generate(seq int64) (string, error)
+	// UsesSequence reports whether Generate needs a fresh seq value
+	UsesSequence() bool
+	// KeyspaceSize returns how many distinct codes the generator can produce at its length
+	KeyspaceSize() float64
+}
+
+// CodeGeneratorConfig configures how short codes are generated
+type CodeGeneratorConfig struct {
+	Strategy         string
+	Length           int
+	Alphabet         string
+	ExcludeAmbiguous bool
+	Salt             string
+}
+
+// NewCodeGenerator creates a code generator for the configured strategy
+func NewCodeGenerator(cfg CodeGeneratorConfig) (CodeGenerator, error) {
+	if cfg.Length <= 0 || cfg.Length > maxCodeLength {
+		return nil, fmt.Errorf("code length must be between 1 and %d, got %d", maxCodeLength, cfg.Length)
+	}
+
+	alphabet := cfg.Alphabet
+	if alphabet == "" {
+		alphabet = base62Chars
+	}
+	if cfg.ExcludeAmbiguous {
+		alphabet = removeChars(alphabet, ambiguousChars)
+	}
+	if err := validateAlphabet(alphabet); err != nil {
+		return nil, err
+	}
+
+	switch cfg.Strategy {
+	case "", StrategyRandom:
+		return &RandomCodeGenerator{alphabet: alphabet, length: cfg.Length}, nil
+	case StrategySequence:
+		return &SequenceCodeGenerator{alphabet: alphabet, minLength: cfg.Length}, nil
+	case StrategyHashID:
+		return &HashIDCodeGenerator{alphabet: shuffleAlphabet(alphabet, cfg.Salt), minLength: cfg.Length}, nil
+	case StrategyPronounceable:
+		return newPronounceableCodeGenerator(cfg.Length, cfg.ExcludeAmbiguous), nil
+	default:
+		return nil, fmt.Errorf("unknown code strategy %q", cfg.Strategy)
+	}
+}
+
+// RandomCodeGenerator generates codes from crypto/rand
+type RandomCodeGenerator struct {
+	alphabet string
+	length   int
+}
+
+// Generate returns a random code of the configured length
+func (g *RandomCodeGenerator) Generate(_ int64) (string, error) {
+	return randomString(g.alphabet, g.length)
+}
+
+// UsesSequence reports whether Generate needs a sequence value
+func (g *RandomCodeGenerator) UsesSequence() bool { return false }
+
+// KeyspaceSize returns the number of possible codes
+func (g *RandomCodeGenerator) KeyspaceSize() float64 {
+	return math.Pow(float64(len(g.alphabet)), float64(g.length))
+}
+
+// SequenceCodeGenerator encodes the database sequence in base62 (or the configured alphabet)
+type SequenceCodeGenerator struct {
+	alphabet  string
+	minLength int
+}
+
+// Generate returns seq encoded in the alphabet, left-padded to the minimum length
+func (g *SequenceCodeGenerator) Generate(seq int64) (string, error) {
+	if seq < 0 {
+		return "", fmt.Errorf("sequence must not be negative, got %d", seq)
+	}
+	code := encodeBase(uint64(seq), g.alphabet)
+	if len(code) < g.minLength {
+		code = strings.Repeat(g.alphabet[:1], g.minLength-len(code)) + code
+	}
+	return code, nil
+}
+
+// UsesSequence reports whether Generate needs a sequence value
+func (g *SequenceCodeGenerator) UsesSequence() bool { return true }
+
+// KeyspaceSize returns the number of codes that fit in the minimum length
+func (g *SequenceCodeGenerator) KeyspaceSize() float64 {
+	return math.Pow(float64(len(g.alphabet)), float64(g.minLength))
+}
+
+// HashIDCodeGenerator encodes the database sequence with a salted, shuffled
+// alphabet so consecutive links don't get guessable consecutive codes.
+// It follows the same idea as hashids/sqids: the first character selects a
+// rotation of the alphabet, and padding is drawn from that rotation.
+type HashIDCodeGenerator struct {
+	alphabet  string
+	minLength int
+}
+
+// Generate returns the obfuscated encoding of seq
+func (g *HashIDCodeGenerator) Generate(seq int64) (string, error) {
+	if seq < 0 {
+		return "", fmt.Errorf("sequence must not be negative, got %d", seq)
+	}
+	n := uint64(seq)
+	size := uint64(len(g.alphabet))
+
+	// Pick a rotation from the number itself so neighbouring values diverge immediately
+	offset := (n*2654435761 + uint64(g.alphabet[n%size])) % size
+	rotated := g.alphabet[offset:] + g.alphabet[:offset]
+	prefix := rotated[0]
+	body := reverseString(rotated[1:])
+
+	code := string(prefix) + encodeBase(n, body[1:])
+	// body[0] acts as a separator so padding can never be mistaken for digits
+	for i := 0; len(code) < g.minLength; i++ {
+		if i == 0 {
+			code += string(body[0])
+			continue
+		}
+		body = shuffleAlphabet(body, code)
+		code += string(body[0])
+	}
+	return code, nil
+}
+
+// UsesSequence reports whether Generate needs a sequence value
+func (g *HashIDCodeGenerator) UsesSequence() bool { return true }
+
+// KeyspaceSize returns the number of codes that fit in the minimum length
+func (g *HashIDCodeGenerator) KeyspaceSize() float64 {
+	// One character is spent on the prefix and one digit is excluded as the separator
+	return float64(len(g.alphabet)) * math.Pow(float64(len(g.alphabet)-2), float64(g.minLength-1))
+}
+
+// PronounceableCodeGenerator builds codes from alternating consonants and vowels
+type PronounceableCodeGenerator struct {
+	consonants string
+	vowels     string
+	length     int
+}
+
+func newPronounceableCodeGenerator(length int, excludeAmbiguous bool) *PronounceableCodeGenerator {
+	consonants := "bcdfghjklmnprstvwz"
+	vowels := "aeiou"
+	if excludeAmbiguous {
+		consonants = removeChars(consonants, ambiguousChars)
+		vowels = removeChars(vowels, ambiguousChars)
+	}
+	return &PronounceableCodeGenerator{consonants: consonants, vowels: vowels, length: length}
+}
+
+// Generate returns a random code such as "tobaki"
+func (g *PronounceableCodeGenerator) Generate(_ int64) (string, error) {
+	b := make([]byte, g.length)
+	for i := range b {
+		set := g.consonants
+		if i%2 == 1 {
+			set = g.vowels
+		}
+		c, err := randomString(set, 1)
+		if err != nil {
+			return "", err
+		}
+		b[i] = c[0]
+	}
+	return string(b), nil
+}
+
+// UsesSequence reports whether Generate needs a sequence value
+func (g *PronounceableCodeGenerator) UsesSequence() bool { return false }
+
+// KeyspaceSize returns the number of possible codes
+func (g *PronounceableCodeGenerator) KeyspaceSize() float64 {
+	consonants := (g.length + 1) / 2
+	vowels := g.length / 2
+	return math.Pow(float64(len(g.consonants)), float64(consonants)) * math.Pow(float64(len(g.vowels)), float64(vowels))
+}
+
+// randomString returns n characters drawn uniformly from alphabet using crypto/rand
+func randomString(alphabet string, n int) (string, error) {
+	max := big.NewInt(int64(len(alphabet)))
+	b := make([]byte, n)
+	for i := range b {
+		idx, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = alphabet[idx.Int64()]
+	}
+	return string(b), nil
+}
+
+// encodeBase encodes n using the characters of alphabet as digits
+func encodeBase(n uint64, alphabet string) string {
+	base := uint64(len(alphabet))
+	if n == 0 {
+		return alphabet[:1]
+	}
+	var b []byte
+	for n > 0 {
+		b = append(b, alphabet[n%base])
+		n /= base
+	}
+	return reverseString(string(b))
+}
+
+// shuffleAlphabet deterministically permutes alphabet using salt
+func shuffleAlphabet(alphabet, salt string) string {
+	if salt == "" {
+		return alphabet
+	}
+	b := []byte(alphabet)
+	sum := sha256.Sum256([]byte(salt))
+	for i := len(b) - 1; i > 0; i-- {
+		sum = sha256.Sum256(sum[:])
+		j := int(binary.BigEndian.Uint64(sum[:8]) % uint64(i+1))
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
+
+// validateAlphabet checks an alphabet is usable for code generation
+func validateAlphabet(alphabet string) error {
+	if len(alphabet) < 4 {
+		return fmt.Errorf("code alphabet must have at least 4 characters, got %q", alphabet)
+	}
+	seen := make(map[rune]bool)
+	for _, c := range alphabet {
+		if c > 127 {
+			return fmt.Errorf("code alphabet must be ASCII, got %q", c)
+		}
+		if c == '/' || c == '?' || c == '#' || c == '+' || c == '%' {
+			return fmt.Errorf("code alphabet must not contain URL-reserved character %q", c)
+		}
+		if seen[c] {
+			return fmt.Errorf("code alphabet contains duplicate character %q", c)
+		}
+		seen[c] = true
+	}
+	return nil
+}
+
+// removeChars returns s without any of the characters in remove
+func removeChars(s, remove string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(remove, r) {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+func reverseString(s string) string {
+	b := []byte(s)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
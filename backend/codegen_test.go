@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewCodeGeneratorRejectsBadConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  CodeGeneratorConfig
+	}{
+		{"zero length", CodeGeneratorConfig{Length: 0}},
+		{"too long", CodeGeneratorConfig{Length: maxCodeLength + 1}},
+		{"short alphabet", CodeGeneratorConfig{Length: 6, Alphabet: "abc"}},
+		{"reserved character", CodeGeneratorConfig{Length: 6, Alphabet: "abcd/"}},
+		{"duplicate character", CodeGeneratorConfig{Length: 6, Alphabet: "abcda"}},
+		{"non-ASCII", CodeGeneratorConfig{Length: 6, Alphabet: "abcdé"}},
+		{"unknown strategy", CodeGeneratorConfig{Length: 6, Strategy: "nope"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewCodeGenerator(tt.cfg); err == nil {
+				t.Errorf("NewCodeGenerator(%+v) succeeded, want error", tt.cfg)
+			}
+		})
+	}
+}
+
+func TestSequenceCodeGenerator(t *testing.T) {
+	gen, err := NewCodeGenerator(CodeGeneratorConfig{Strategy: StrategySequence, Length: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		seq  int64
+		want string
+	}{
+		{0, "aaa"},
+		{1, "aab"},
+		{61, "aa9"},
+		{62, "aba"},
+		{62 * 62 * 62, "baaa"},
+	}
+	for _, tt := range tests {
+		got, err := gen.Generate(tt.seq)
+		if err != nil || got != tt.want {
+			t.Errorf("Generate(%d) = %q, %v, want %q", tt.seq, got, err, tt.want)
+		}
+	}
+	if _, err := gen.Generate(-1); err == nil {
+		t.Error("Generate(-1) succeeded, want error")
+	}
+}
+
+func TestCodeGenerators(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      CodeGeneratorConfig
+		alphabet string
+		// exactLength is false for strategies whose length is only a minimum
+		exactLength bool
+	}{
+		{"random", CodeGeneratorConfig{Strategy: StrategyRandom, Length: 8}, base62Chars, true},
+		{"random without ambiguous", CodeGeneratorConfig{Strategy: StrategyRandom, Length: 8, ExcludeAmbiguous: true}, removeChars(base62Chars, ambiguousChars), true},
+		{"random custom alphabet", CodeGeneratorConfig{Strategy: StrategyRandom, Length: 5, Alphabet: "wxyz"}, "wxyz", true},
+		{"sequence", CodeGeneratorConfig{Strategy: StrategySequence, Length: 4}, base62Chars, false},
+		{"hashid", CodeGeneratorConfig{Strategy: StrategyHashID, Length: 6, Salt: "pepper"}, base62Chars, false},
+		{"pronounceable", CodeGeneratorConfig{Strategy: StrategyPronounceable, Length: 7}, "bcdfghjklmnprstvwzaeiou", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gen, err := NewCodeGenerator(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gen.KeyspaceSize() <= 1 {
+				t.Errorf("KeyspaceSize() = %v, want more than 1", gen.KeyspaceSize())
+			}
+			seen := make(map[string]bool)
+			for seq := int64(0); seq < 500; seq++ {
+				code, err := gen.Generate(seq)
+				if err != nil {
+					t.Fatalf("Generate(%d): %v", seq, err)
+				}
+				if tt.exactLength && len(code) != tt.cfg.Length || len(code) < tt.cfg.Length {
+					t.Errorf("Generate(%d) = %q, want length %d", seq, code, tt.cfg.Length)
+				}
+				for _, c := range code {
+					if !strings.ContainsRune(tt.alphabet, c) {
+						t.Fatalf("Generate(%d) = %q, which has %q outside the alphabet", seq, code, c)
+					}
+				}
+				if gen.UsesSequence() && seen[code] {
+					t.Fatalf("Generate(%d) = %q, already generated for another sequence value", seq, code)
+				}
+				seen[code] = true
+			}
+		})
+	}
+}
+
+func TestHashIDCodeGeneratorIsSalted(t *testing.T) {
+	first, _ := NewCodeGenerator(CodeGeneratorConfig{Strategy: StrategyHashID, Length: 6, Salt: "one"})
+	second, _ := NewCodeGenerator(CodeGeneratorConfig{Strategy: StrategyHashID, Length: 6, Salt: "two"})
+	a, _ := first.Generate(42)
+	again, _ := first.Generate(42)
+	b, _ := second.Generate(42)
+	if a != again {
+		t.Errorf("Generate(42) = %q then %q, want the same code", a, again)
+	}
+	if a == b {
+		t.Errorf("Generate(42) = %q for both salts, want different codes", a)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds settings read from the environment
+type Config struct {
+	CodeGenerator CodeGeneratorConfig
+	Allocator     AllocatorConfig
+	DedupMode     string
+	AuthSecret    string
+	TokenTTL      time.Duration
+
+	// Password-protected links
+	LinkUnlockTTL         time.Duration
+	LinkUnlockMaxAttempts int
+	LinkUnlockWindow      time.Duration
+
+	Janitor JanitorConfig
+
+	// Password resets
+	PasswordResetTTL         time.Duration
+	PasswordResetURL         string
+	PasswordResetMaxRequests int
+	PasswordResetWindow      time.Duration
+	Notifier                 string
+	NotifierFile             string
+
+	// Signup and password rules
+	UserIDPolicy   UserIDPolicy
+	PasswordPolicy PasswordPolicy
+
+	// Two-factor authentication
+	MFAIssuer        string
+	MFARequiredRoles map[string]bool
+	MFAMaxAttempts   int
+	MFAWindow        time.Duration
+
+	// Single sign-on
+	OIDC OIDCConfig
+
+	// Quota limits for users and workspaces on each plan
+	QuotaPlans map[string]QuotaPlan
+	// AnonymousMaxLinks limits links created without signing in per IP and
+	// AnonymousLinkWindow; zero turns anonymous creation off
+	AnonymousMaxLinks   int
+	AnonymousLinkWindow time.Duration
+
+	// Database connections
+	Pool     PoolConfig
+	Replicas ReplicaConfig
+
+	// Click analytics
+	BotUserAgentsFile string
+
+	// Request limits
+	QueryTimeout    time.Duration
+	RequestTimeout  time.Duration
+	RedirectTimeout time.Duration
+	ExportTimeout   time.Duration
+	MaxBodyBytes    int64
+}
+
+// LoadConfig reads the application configuration from environment variables
+func LoadConfig() *Config {
+	return &Config{
+		CodeGenerator: CodeGeneratorConfig{
+			Strategy:         getEnv("SHORT_CODE_STRATEGY", StrategyRandom),
+			Length:           getEnvInt("SHORT_CODE_LENGTH", 6),
+			Alphabet:         getEnv("SHORT_CODE_ALPHABET", base62Chars),
+			ExcludeAmbiguous: getEnvBool("SHORT_CODE_EXCLUDE_AMBIGUOUS", false),
+			Salt:             getEnv("SHORT_CODE_SALT", ""),
+		},
+		Allocator: AllocatorConfig{
+			MaxAttempts:   getEnvInt("SHORT_CODE_MAX_ATTEMPTS", 5),
+			GrowThreshold: getEnvFloat("SHORT_CODE_GROW_THRESHOLD", 0.1),
+			GrowWindow:    getEnvInt("SHORT_CODE_GROW_WINDOW", 100),
+		},
+		DedupMode:  getEnv("DEDUP_MODE", DedupOwner),
+		AuthSecret: os.Getenv("AUTH_SECRET"),
+		TokenTTL:   getEnvDuration("TOKEN_TTL", 24*time.Hour),
+
+		LinkUnlockTTL:         getEnvDuration("LINK_UNLOCK_TTL", time.Hour),
+		LinkUnlockMaxAttempts: getEnvInt("LINK_UNLOCK_MAX_ATTEMPTS", 5),
+		LinkUnlockWindow:      getEnvDuration("LINK_UNLOCK_WINDOW", 15*time.Minute),
+
+		Janitor: JanitorConfig{
+			Interval:    getEnvDuration("JANITOR_INTERVAL", time.Hour),
+			GracePeriod: getEnvDuration("JANITOR_GRACE_PERIOD", 30*24*time.Hour),
+			PurgePolicy: getEnv("JANITOR_PURGE_POLICY", PurgeArchive),
+			CodePolicy:  getEnv("JANITOR_CODE_POLICY", CodeReserve),
+			BatchSize:   getEnvInt("JANITOR_BATCH_SIZE", 500),
+
+			TrashRetention: getEnvDuration("TRASH_RETENTION", 30*24*time.Hour),
+		},
+
+		PasswordResetTTL:         getEnvDuration("PASSWORD_RESET_TTL", time.Hour),
+		PasswordResetURL:         getEnv("PASSWORD_RESET_URL", "http://localhost:3000/reset-password"),
+		PasswordResetMaxRequests: getEnvInt("PASSWORD_RESET_MAX_REQUESTS", 5),
+		PasswordResetWindow:      getEnvDuration("PASSWORD_RESET_WINDOW", time.Hour),
+		Notifier:                 getEnv("NOTIFIER", NotifierLog),
+		NotifierFile:             getEnv("NOTIFIER_FILE", "notifications.jsonl"),
+
+		UserIDPolicy: UserIDPolicy{
+			MinLength: getEnvInt("USER_ID_MIN_LENGTH", 3),
+			MaxLength: getEnvInt("USER_ID_MAX_LENGTH", maxUserIDLength),
+			Charset:   getEnv("USER_ID_CHARSET", CharsetUsername),
+		},
+		PasswordPolicy: PasswordPolicy{
+			MinLength:   getEnvInt("PASSWORD_MIN_LENGTH", 8),
+			CheckCommon: getEnvBool("PASSWORD_CHECK_COMMON", true),
+		},
+
+		MFAIssuer:        getEnv("MFA_ISSUER", "ShortURL"),
+		MFARequiredRoles: getEnvSet("MFA_REQUIRED_ROLES", RoleAdmin+","+RoleWorkspaceOwner),
+		MFAMaxAttempts:   getEnvInt("MFA_MAX_ATTEMPTS", 5),
+		MFAWindow:        getEnvDuration("MFA_WINDOW", 15*time.Minute),
+
+		OIDC: OIDCConfig{
+			Issuer:        getEnv("OIDC_ISSUER", ""),
+			ClientID:      getEnv("OIDC_CLIENT_ID", ""),
+			ClientSecret:  getEnv("OIDC_CLIENT_SECRET", ""),
+			RedirectURL:   getEnv("OIDC_REDIRECT_URL", "http://localhost:8080/api/oidc/callback"),
+			Scopes:        strings.Fields(getEnv("OIDC_SCOPES", "openid profile email")),
+			UserIDClaim:   getEnv("OIDC_USER_ID_CLAIM", "preferred_username"),
+			RoleClaim:     getEnv("OIDC_ROLE_CLAIM", ""),
+			RoleMap:       getEnvMap("OIDC_ROLE_MAP"),
+			RoleDowngrade: getEnvBool("OIDC_ROLE_DOWNGRADE", false),
+			AutoProvision: getEnvBool("OIDC_AUTO_PROVISION", true),
+			LinkByUserID:  getEnvBool("OIDC_LINK_BY_USER_ID", false),
+			FrontendURL:   getEnv("OIDC_FRONTEND_URL", "http://localhost:3000/"),
+		},
+
+		QuotaPlans:          loadQuotaPlans(),
+		AnonymousMaxLinks:   getEnvInt("ANONYMOUS_MAX_LINKS", 10),
+		AnonymousLinkWindow: getEnvDuration("ANONYMOUS_LINK_WINDOW", time.Hour),
+
+		Pool: PoolConfig{
+			MaxOpenConns:    getEnvInt("DB_MAX_OPEN_CONNS", 25),
+			MaxIdleConns:    getEnvInt("DB_MAX_IDLE_CONNS", 10),
+			ConnMaxLifetime: getEnvDuration("DB_CONN_MAX_LIFETIME", 30*time.Minute),
+			ConnMaxIdleTime: getEnvDuration("DB_CONN_MAX_IDLE_TIME", 5*time.Minute),
+		},
+		Replicas: ReplicaConfig{
+			URLs:          getEnvList("DATABASE_REPLICA_URLS"),
+			MaxLag:        getEnvDuration("DB_REPLICA_MAX_LAG", 5*time.Second),
+			CheckInterval: getEnvDuration("DB_REPLICA_CHECK_INTERVAL", 5*time.Second),
+		},
+
+		BotUserAgentsFile: getEnv("BOT_USER_AGENTS_FILE", ""),
+
+		QueryTimeout:    getEnvDuration("DB_QUERY_TIMEOUT", 5*time.Second),
+		RequestTimeout:  getEnvDuration("REQUEST_TIMEOUT", 10*time.Second),
+		RedirectTimeout: getEnvDuration("REDIRECT_TIMEOUT", 3*time.Second),
+		ExportTimeout:   getEnvDuration("EXPORT_TIMEOUT", 5*time.Minute),
+		MaxBodyBytes:    int64(getEnvInt("MAX_BODY_BYTES", 1<<20)),
+	}
+}
+
+// loadQuotaPlans reads the free plan's limits from USER_MAX_* and WORKSPACE_MAX_*,
+// and those of each plan listed in QUOTA_PLANS from the same variables
+// prefixed with the plan's upper-cased name, e.g. PRO_USER_MAX_ACTIVE_LINKS
+func loadQuotaPlans() map[string]QuotaPlan {
+	plans := map[string]QuotaPlan{PlanFree: loadQuotaPlan("")}
+	for _, name := range getEnvList("QUOTA_PLANS") {
+		if !validPlanName.MatchString(name) {
+			log.Printf("Ignoring QUOTA_PLANS entry %q: plan names are lower-case letters, digits and underscores", name)
+			continue
+		}
+		if name != PlanFree {
+			plans[name] = loadQuotaPlan(strings.ToUpper(name) + "_")
+		}
+	}
+	return plans
+}
+
+// loadQuotaPlan reads the limits of one plan from variables starting with prefix
+func loadQuotaPlan(prefix string) QuotaPlan {
+	return QuotaPlan{
+		User: QuotaConfig{
+			LinksPerDay:   getEnvInt(prefix+"USER_MAX_LINKS_PER_DAY", 0),
+			LinksPerMonth: getEnvInt(prefix+"USER_MAX_LINKS_PER_MONTH", 0),
+			ActiveLinks:   getEnvInt(prefix+"USER_MAX_ACTIVE_LINKS", 0),
+		},
+		Workspace: QuotaConfig{
+			LinksPerDay:   getEnvInt(prefix+"WORKSPACE_MAX_LINKS_PER_DAY", 0),
+			LinksPerMonth: getEnvInt(prefix+"WORKSPACE_MAX_LINKS_PER_MONTH", 0),
+			ActiveLinks:   getEnvInt(prefix+"WORKSPACE_MAX_ACTIVE_LINKS", 0),
+		},
+	}
+}
+
+// getEnv returns the environment variable or a fallback if it is unset
+func getEnv(key, fallback string) string {
+	if value := strings.TrimSpace(os.Getenv(key)); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// getEnvSet returns the comma-separated values of the environment variable as a
+// set, or those of fallback if it is unset. The value "none" is the empty set.
+func getEnvSet(key, fallback string) map[string]bool {
+	set := make(map[string]bool)
+	for _, value := range strings.Split(getEnv(key, fallback), ",") {
+		if value = strings.TrimSpace(value); value != "" && value != "none" {
+			set[value] = true
+		}
+	}
+	return set
+}
+
+// getEnvList returns the comma-separated values of the environment variable in order
+func getEnvList(key string) []string {
+	var list []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			list = append(list, value)
+		}
+	}
+	return list
+}
+
+// getEnvMap returns comma-separated key=value pairs of the environment variable as a map
+func getEnvMap(key string) map[string]string {
+	m := make(map[string]string)
+	for _, pair := range strings.Split(os.Getenv(key), ",") {
+		k, v, ok := strings.Cut(pair, "=")
+		if k, v = strings.TrimSpace(k), strings.TrimSpace(v); ok && k != "" {
+			m[k] = v
+		} else if strings.TrimSpace(pair) != "" {
+			log.Printf("Ignoring %s entry without '=': %q", key, pair)
+		}
+	}
+	return m
+}
+
+// getEnvInt returns the environment variable parsed as an int or a fallback
+func getEnvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		log.Printf("Invalid integer for %s: %q, using %d", key, value, fallback)
+		return fallback
+	}
+	return n
+}
+
+// getEnvFloat returns the environment variable parsed as a float64 or a fallback
+func getEnvFloat(key string, fallback float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		log.Printf("Invalid number for %s: %q, using %g", key, value, fallback)
+		return fallback
+	}
+	return f
+}
+
+// getEnvDuration returns the environment variable parsed as a time.Duration or a fallback
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(value))
+	if err != nil {
+		log.Printf("Invalid duration for %s: %q, using %s", key, value, fallback)
+		return fallback
+	}
+	return d
+}
+
+// getEnvBool returns the environment variable parsed as a bool or a fallback
+func getEnvBool(key string, fallback bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		log.Printf("Invalid boolean for %s: %q, using %t", key, value, fallback)
+		return fallback
+	}
+	return b
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Deduplication modes for shortening a URL that has been shortened before
+const (
+	// DedupNone always creates a new short URL
+	DedupNone = "none"
+	// DedupOwner returns the caller's or workspace's existing short URL for the same destination
+	DedupOwner = "owner"
+	// DedupGlobal also returns a short URL created anonymously for the same
+	// destination, which nobody can edit, to signed-in callers
+	DedupGlobal = "global"
+)
+
+// ValidateDedupMode checks that mode is a known deduplication mode
+func ValidateDedupMode(mode string) error {
+	switch mode {
+	case DedupNone, DedupOwner, DedupGlobal:
+		return nil
+	}
+	return fmt.Errorf("unknown dedup mode %q", mode)
+}
+
+// dedupKey returns the value stored in short_urls.dedup_key for a new link.
+// The unique index on that column makes deduplication atomic; nil opts out.
+// Keys are scoped to whoever can edit the link, its workspace or owner, so a
+// caller is never handed a link whose destination someone else can change.
+// Anonymous links, which nobody can edit, share a single scope.
+func dedupKey(mode string, shortURL *ShortURL) *string {
+	if mode == DedupNone || !shortURL.isPlain() {
+		return nil
+	}
+	scope := "anonymous"
+	switch {
+	case shortURL.WorkspaceID != nil:
+		scope = "workspace:" + strconv.Itoa(*shortURL.WorkspaceID)
+	case shortURL.OwnerID != nil:
+		scope = "owner:" + strconv.Itoa(*shortURL.OwnerID)
+	}
+	key := scopedDedupKey(scope, shortURL)
+	return &key
+}
+
+// sharedDedupKey returns the dedup key of an anonymous link that redirects
+// like shortURL, which DedupGlobal hands out to signed-in callers too
+func sharedDedupKey(shortURL *ShortURL) string {
+	return scopedDedupKey("anonymous", shortURL)
+}
+
+// scopedDedupKey hashes what a visitor of the link gets: its destination and
+// the redirect status they get there with
+func scopedDedupKey(scope string, shortURL *ShortURL) string {
+	sum := sha256.Sum256([]byte(dedupVariant(shortURL)))
+	return scope + ":" + hex.EncodeToString(sum[:])
+}
+
+// dedupVariant is what two links must share to be interchangeable
+func dedupVariant(shortURL *ShortURL) string {
+	variant := shortURL.OriginalURL
+	if shortURL.RedirectType != nil {
+		variant += "\x00" + strconv.Itoa(*shortURL.RedirectType)
+	}
+	return variant
+}
+
+// liveDedupedLink returns the link holding key if it still redirects, or nil
+func (h *Handlers) liveDedupedLink(ctx context.Context, key string) (*ShortURL, error) {
+	existing, err := h.db.GetByDedupKey(ctx, key)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !existing.isLive(time.Now()) {
+		return nil, nil
+	}
+	return existing, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func intPtr(n int) *int { return &n }
+
+func stringPtr(s string) *string { return &s }
+
+func TestIsPlain(t *testing.T) {
+	later := time.Now().Add(time.Hour)
+	tests := []struct {
+		name string
+		link ShortURL
+		want bool
+	}{
+		{"plain", ShortURL{OriginalURL: "https://example.com"}, true},
+		{"redirect type", ShortURL{RedirectType: intPtr(http.StatusMovedPermanently)}, true},
+		{"interstitial", ShortURL{Interstitial: true}, false},
+		{"password", ShortURL{PasswordHash: stringPtr("hash")}, false},
+		{"max clicks", ShortURL{MaxClicks: intPtr(5)}, false},
+		{"scheduled", ShortURL{ActivatesAt: &later}, false},
+		{"prelaunch URL", ShortURL{PrelaunchURL: stringPtr("https://example.com/soon")}, false},
+		{"expired URL", ShortURL{ExpiredURL: stringPtr("https://example.com/gone")}, false},
+		{"expires", ShortURL{ExpiresAt: &later}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.link.isPlain(); got != tt.want {
+				t.Errorf("isPlain() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDedupKey(t *testing.T) {
+	plain := func(modify func(*ShortURL)) *ShortURL {
+		link := &ShortURL{OriginalURL: "https://example.com"}
+		if modify != nil {
+			modify(link)
+		}
+		return link
+	}
+	anonymous := dedupKey(DedupOwner, plain(nil))
+	owned := dedupKey(DedupOwner, plain(func(s *ShortURL) { s.OwnerID = intPtr(1) }))
+
+	tests := []struct {
+		name string
+		mode string
+		link *ShortURL
+		// same is the key the result must equal, or nil if it must differ from every other key
+		same   *string
+		nilKey bool
+	}{
+		{"none mode", DedupNone, plain(nil), nil, true},
+		{"not plain", DedupOwner, plain(func(s *ShortURL) { s.Interstitial = true }), nil, true},
+		{"expiring", DedupGlobal, plain(func(s *ShortURL) { s.ExpiresAt = &time.Time{} }), nil, true},
+		{"anonymous", DedupGlobal, plain(nil), anonymous, false},
+		{"same owner", DedupOwner, plain(func(s *ShortURL) { s.OwnerID = intPtr(1) }), owned, false},
+		{"other owner", DedupOwner, plain(func(s *ShortURL) { s.OwnerID = intPtr(2) }), nil, false},
+		{"workspace", DedupOwner, plain(func(s *ShortURL) { s.OwnerID = intPtr(1); s.WorkspaceID = intPtr(1) }), nil, false},
+		{"other destination", DedupOwner, plain(func(s *ShortURL) { s.OriginalURL = "https://example.org" }), nil, false},
+		{"redirect type", DedupOwner, plain(func(s *ShortURL) { s.RedirectType = intPtr(http.StatusMovedPermanently) }), nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := dedupKey(tt.mode, tt.link)
+			switch {
+			case tt.nilKey:
+				if got != nil {
+					t.Errorf("dedupKey = %q, want nil", *got)
+				}
+			case got == nil:
+				t.Error("dedupKey = nil, want a key")
+			case tt.same != nil && *got != *tt.same:
+				t.Errorf("dedupKey = %q, want %q", *got, *tt.same)
+			case tt.same == nil && (*got == *anonymous || *got == *owned):
+				t.Errorf("dedupKey = %q, which another scope or variant shares", *got)
+			}
+		})
+	}
+
+	if shared := sharedDedupKey(plain(func(s *ShortURL) { s.OwnerID = intPtr(1) })); shared != *anonymous {
+		t.Errorf("sharedDedupKey = %q, want the anonymous key %q", shared, *anonymous)
+	}
+}
@@ -10,6 +10,7 @@ require (
 	github.com/joho/godotenv v1.4.0
 	github.com/lib/pq v1.10.9
 	golang.org/x/crypto v0.41.0
+	golang.org/x/text v0.28.0
 )
 
 require github.com/felixge/httpsnoop v1.0.1 // indirect
@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
@@ -12,12 +14,70 @@ import (
 
 // Handlers contains the HTTP handlers
 type Handlers struct {
-	db *Database
+	db            *Database
+	codes         *CodeAllocator
+	janitor       *Janitor
+	tokens        *TokenSigner
+	sessionTTL    time.Duration
+	dedupMode     string
+	unlockTTL     time.Duration
+	unlockLimiter *RateLimiter
+
+	quotaPlans       map[string]QuotaPlan
+	anonymousLinks   bool
+	anonymousLimiter *RateLimiter
+
+	notifier     Notifier
+	resetTTL     time.Duration
+	resetURL     string
+	resetLimiter *RateLimiter
+
+	mfaIssuer  string
+	mfaRoles   map[string]bool
+	mfaLimiter *RateLimiter
+
+	oidc *OIDCProvider
+
+	userIDPolicy   UserIDPolicy
+	passwordPolicy PasswordPolicy
+
+	bots     *BotDetector
+	visitors *VisitorHasher
 }
 
 // NewHandlers creates a new handlers instance
-func NewHandlers(db *Database) *Handlers {
-	return &Handlers{db: db}
+func NewHandlers(db *Database, codes *CodeAllocator, janitor *Janitor, tokens *TokenSigner, notifier Notifier, bots *BotDetector, config *Config) *Handlers {
+	return &Handlers{
+		db:            db,
+		codes:         codes,
+		janitor:       janitor,
+		tokens:        tokens,
+		sessionTTL:    config.TokenTTL,
+		dedupMode:     config.DedupMode,
+		unlockTTL:     config.LinkUnlockTTL,
+		unlockLimiter: NewRateLimiter(config.LinkUnlockMaxAttempts, config.LinkUnlockWindow),
+
+		quotaPlans:       config.QuotaPlans,
+		anonymousLinks:   config.AnonymousMaxLinks > 0,
+		anonymousLimiter: NewRateLimiter(config.AnonymousMaxLinks, config.AnonymousLinkWindow),
+
+		notifier:     notifier,
+		resetTTL:     config.PasswordResetTTL,
+		resetURL:     config.PasswordResetURL,
+		resetLimiter: NewRateLimiter(config.PasswordResetMaxRequests, config.PasswordResetWindow),
+
+		mfaIssuer:  config.MFAIssuer,
+		mfaRoles:   config.MFARequiredRoles,
+		mfaLimiter: NewRateLimiter(config.MFAMaxAttempts, config.MFAWindow),
+
+		oidc: NewOIDCProvider(config.OIDC),
+
+		userIDPolicy:   config.UserIDPolicy,
+		passwordPolicy: config.PasswordPolicy,
+
+		bots:     bots,
+		visitors: NewVisitorHasher(db),
+	}
 }
 
 // ShortenURL handles POST /api/shorten
@@ -26,91 +86,214 @@ func (h *Handlers) ShortenURL(w http.ResponseWriter, r *http.Request) {
 	var req ShortenRequest
 
 	// Parse JSON request
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		fmt.Println("Error decoding JSON:", err)
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
 	// Validate URL
 	if req.URL == "" {
 		fmt.Println("URL is required")
-		http.Error(w, "URL is required", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, ProblemInvalidRequest, "URL is required")
+		return
+	}
+
+	// Identify the owner, if any
+	owner, err := h.authenticatedUser(r)
+	if err != nil {
+		writeAuthError(w, r, err)
 		return
 	}
 
 	// Normalize URL
 	normalizedURL := NormalizeURL(req.URL)
 
-	// Check if URL already exists
-	existing, err := h.db.GetByOriginalURL(normalizedURL)
-	if err != nil && err != sql.ErrNoRows {
-		fmt.Println("Database error checking existing URL:", err)
-		http.Error(w, "Database error", http.StatusInternalServerError)
-		return
+	shortURL := &ShortURL{
+		OriginalURL:  normalizedURL,
+		CreatedAt:    time.Now(),
+		ClickCount:   0,
+		Interstitial: req.Interstitial,
+		Active:       true,
 	}
+	if owner != nil {
+		shortURL.OwnerID = &owner.ID
 
-	if existing != nil {
-		// Return existing short URL
-		fmt.Println("Found existing URL:", existing.ShortCode)
-		response := ShortenResponse{
-			ShortURL:    fmt.Sprintf("http://%s/%s", r.Host, existing.ShortCode),
-			OriginalURL: existing.OriginalURL,
-			CreatedAt:   existing.CreatedAt,
-			ExpiresAt:   existing.ExpiresAt,
+		// Links created while working in a workspace belong to it
+		workspace, ok := h.currentWorkspace(w, r, owner, WorkspaceEditor)
+		if !ok {
+			return
+		}
+		if workspace != nil {
+			shortURL.WorkspaceID = &workspace.ID
 		}
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
-		fmt.Println("Returned existing short URL")
-		return
 	}
 
-	// Generate short code before inserting
-	var shortCode string
-	for {
-		shortCode = GenerateRandomCode(6)
-		// Check for collision
-		exists, err := h.db.GetByShortCode(shortCode)
-		if err != nil && err != sql.ErrNoRows {
-			fmt.Println("Database error checking short code:", err)
-			http.Error(w, "Database error", http.StatusInternalServerError)
+	// Hash the link passphrase the same way user passwords are hashed
+	if req.Password != "" {
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			fmt.Println("Error hashing link password:", err)
+			if err == bcrypt.ErrPasswordTooLong {
+				writeError(w, r, http.StatusBadRequest, ProblemInvalidRequest, "Password must be at most 72 bytes")
+			} else {
+				writeError(w, r, http.StatusInternalServerError, ProblemInternal, "Failed to create short URL")
+			}
 			return
 		}
-		if exists == nil {
-			break // unique code
+		hash := string(hashedPassword)
+		shortURL.PasswordHash = &hash
+	}
+
+	if req.RedirectType != nil {
+		if !validRedirectType(*req.RedirectType) {
+			writeError(w, r, http.StatusBadRequest, ProblemInvalidRequest, "redirect_type must be 301, 302, 307 or 308")
+			return
 		}
+		shortURL.RedirectType = req.RedirectType
 	}
 
-	shortURL := &ShortURL{
-		OriginalURL: normalizedURL,
-		ShortCode:   shortCode,
-		CreatedAt:   time.Now(),
-		ClickCount:  0,
+	if req.MaxClicks != nil {
+		if *req.MaxClicks < 1 {
+			writeError(w, r, http.StatusBadRequest, ProblemInvalidRequest, "max_clicks must be at least 1")
+			return
+		}
+		shortURL.MaxClicks = req.MaxClicks
 	}
 
+	// Set the activation window
+	if req.ExpiresInDays != nil && req.ExpiresAt != nil {
+		writeError(w, r, http.StatusBadRequest, ProblemInvalidRequest, "Use either expires_in_days or expires_at, not both")
+		return
+	}
 	if req.ExpiresInDays != nil {
 		expiresAt := time.Now().Add(time.Duration(*req.ExpiresInDays) * 24 * time.Hour)
 		shortURL.ExpiresAt = &expiresAt
 	}
+	if req.ExpiresAt != nil {
+		expiresAt := req.ExpiresAt.UTC()
+		shortURL.ExpiresAt = &expiresAt
+	}
+	if req.ActivatesAt != nil {
+		activatesAt := req.ActivatesAt.UTC()
+		shortURL.ActivatesAt = &activatesAt
+	}
+	if shortURL.ActivatesAt != nil && shortURL.ExpiresAt != nil && !shortURL.ExpiresAt.After(*shortURL.ActivatesAt) {
+		writeError(w, r, http.StatusBadRequest, ProblemInvalidRequest, "expires_at must be after activates_at")
+		return
+	}
 
-	// Insert into database
-	fmt.Println("Creating new short URL for:", normalizedURL)
-	id, err := h.db.Create(shortURL)
-	if err != nil {
-		fmt.Println("Error creating short URL:", err)
-		http.Error(w, "Failed to create short URL", http.StatusInternalServerError)
+	// Fallback destinations for before activation and after expiry
+	for _, fallback := range []struct {
+		name   string
+		value  string
+		target **string
+	}{
+		{"prelaunch_url", req.PrelaunchURL, &shortURL.PrelaunchURL},
+		{"expired_url", req.ExpiredURL, &shortURL.ExpiredURL},
+	} {
+		if fallback.value == "" {
+			continue
+		}
+		normalized := NormalizeURL(fallback.value)
+		if !ValidateURL(normalized) {
+			writeError(w, r, http.StatusBadRequest, ProblemInvalidRequest, "Invalid "+fallback.name)
+			return
+		}
+		*fallback.target = &normalized
+	}
+
+	// Only plain links are deduplicated so a protected or expiring link is
+	// never handed out in place of a permanent one, or the other way around
+	shortURL.DedupKey = dedupKey(h.dedupMode, shortURL)
+
+	// In global mode signed-in callers can also get an anonymous link
+	var existing *ShortURL
+	if h.dedupMode == DedupGlobal && shortURL.DedupKey != nil && (shortURL.OwnerID != nil || shortURL.WorkspaceID != nil) {
+		existing, err = h.liveDedupedLink(r.Context(), sharedDedupKey(shortURL))
+		if err != nil {
+			fmt.Println("Database error checking existing URL:", err)
+			writeServerError(w, r, err, "Database error")
+			return
+		}
+	}
+
+	// Anonymous callers are limited per IP, unless deduplication hands back an existing link anyway
+	if existing == nil && owner == nil {
+		if !h.anonymousLinks {
+			writeError(w, r, http.StatusUnauthorized, ProblemAuthRequired, "Sign in to create links")
+			return
+		}
+		if !h.anonymousLimiter.Allow(clientIP(r)) {
+			if shortURL.DedupKey != nil {
+				existing, _ = h.liveDedupedLink(r.Context(), *shortURL.DedupKey)
+			}
+			if existing == nil {
+				writeError(w, r, http.StatusTooManyRequests, ProblemRateLimited, "Too many links created from this address, sign in or try again later")
+				return
+			}
+		}
+	}
+
+	// Refuse links over quota, unless deduplication hands back an existing one anyway
+	if existing == nil && owner != nil {
+		quotaErr, err := h.exceededQuota(r.Context(), owner, shortURL.WorkspaceID, creationQuotas...)
+		if err != nil {
+			fmt.Println("Database error checking quotas:", err)
+			writeServerError(w, r, err, "Database error")
+			return
+		}
+		if quotaErr != nil {
+			if shortURL.DedupKey != nil {
+				existing, _ = h.liveDedupedLink(r.Context(), *shortURL.DedupKey)
+			}
+			if existing == nil {
+				writeQuotaError(w, r, quotaErr)
+				return
+			}
+		}
+	}
+
+	// Insert into database under a freshly allocated short code
+	if existing == nil {
+		fmt.Println("Creating new short URL for:", normalizedURL)
+		existing, err = h.codes.Allocate(r.Context(), shortURL)
+		if err != nil {
+			fmt.Println("Error creating short URL:", err)
+			if err == ErrCodeAllocationFailed {
+				writeError(w, r, http.StatusServiceUnavailable, ProblemUnavailable, "Could not allocate a short code, please retry")
+				return
+			}
+			writeServerError(w, r, err, "Failed to create short URL")
+			return
+		}
+	}
+
+	if existing != nil {
+		// Return existing short URL
+		fmt.Println("Found existing URL:", existing.ShortCode)
+		response := ShortenResponse{
+			ShortURL:    fmt.Sprintf("http://%s/%s", r.Host, existing.ShortCode),
+			OriginalURL: existing.OriginalURL,
+			CreatedAt:   existing.CreatedAt,
+			ExpiresAt:   existing.ExpiresAt,
+			ActivatesAt: existing.ActivatesAt,
+			Existing:    true,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		fmt.Println("Returned existing short URL")
 		return
 	}
-	fmt.Println("Created short URL with ID:", id)
-	shortURL.ID = int(id)
+	fmt.Println("Created short URL with ID:", shortURL.ID)
+	h.audit(r, owner, AuditLinkCreate, "link", shortURL.ShortCode, nil, shortURL)
 
 	// Return response
 	response := ShortenResponse{
-		ShortURL:    fmt.Sprintf("http://%s/%s", r.Host, shortCode),
+		ShortURL:    fmt.Sprintf("http://%s/%s", r.Host, shortURL.ShortCode),
 		OriginalURL: shortURL.OriginalURL,
 		CreatedAt:   shortURL.CreatedAt,
 		ExpiresAt:   shortURL.ExpiresAt,
+		ActivatesAt: shortURL.ActivatesAt,
 	}
 
 	fmt.Println("ShortURL created:", response)
@@ -119,11 +302,67 @@ func (h *Handlers) ShortenURL(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-// RedirectURL handles GET /{shortCode}
+// Metrics handles GET /api/metrics in the Prometheus text format
+func (h *Handlers) Metrics(w http.ResponseWriter, r *http.Request) {
+	stats, err := h.codes.Stats(r.Context())
+	if err != nil {
+		fmt.Println("Database error collecting metrics:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP shorturl_code_length Current short code length.\n# TYPE shorturl_code_length gauge\nshorturl_code_length %d\n", stats.CodeLength)
+	fmt.Fprintf(w, "# HELP shorturl_keyspace_size Number of codes available at the current length.\n# TYPE shorturl_keyspace_size gauge\nshorturl_keyspace_size %g\n", stats.KeyspaceSize)
+	fmt.Fprintf(w, "# HELP shorturl_keyspace_used Number of codes in use at the current length.\n# TYPE shorturl_keyspace_used gauge\nshorturl_keyspace_used %d\n", stats.KeyspaceUsed)
+	fmt.Fprintf(w, "# HELP shorturl_keyspace_utilization Fraction of the current keyspace in use.\n# TYPE shorturl_keyspace_utilization gauge\nshorturl_keyspace_utilization %g\n", stats.KeyspaceUtilization)
+	fmt.Fprintf(w, "# HELP shorturl_code_allocations_total Short codes allocated.\n# TYPE shorturl_code_allocations_total counter\nshorturl_code_allocations_total %d\n", stats.Allocations)
+	fmt.Fprintf(w, "# HELP shorturl_code_collisions_total Short code insert attempts that hit an existing code.\n# TYPE shorturl_code_collisions_total counter\nshorturl_code_collisions_total %d\n", stats.Collisions)
+	fmt.Fprintf(w, "# HELP shorturl_code_allocation_failures_total Inserts that ran out of attempts.\n# TYPE shorturl_code_allocation_failures_total counter\nshorturl_code_allocation_failures_total %d\n", stats.Failures)
+
+	janitor := h.janitor.Stats()
+	fmt.Fprintf(w, "# HELP shorturl_janitor_runs_total Janitor runs, including ones skipped for lack of the leader lock.\n# TYPE shorturl_janitor_runs_total counter\nshorturl_janitor_runs_total %d\n", janitor.Runs)
+	fmt.Fprintf(w, "# HELP shorturl_janitor_deactivated_total Expired links marked inactive.\n# TYPE shorturl_janitor_deactivated_total counter\nshorturl_janitor_deactivated_total %d\n", janitor.Deactivated)
+	fmt.Fprintf(w, "# HELP shorturl_janitor_archived_total Inactive links moved to the archive.\n# TYPE shorturl_janitor_archived_total counter\nshorturl_janitor_archived_total %d\n", janitor.Archived)
+	fmt.Fprintf(w, "# HELP shorturl_janitor_deleted_total Inactive links deleted.\n# TYPE shorturl_janitor_deleted_total counter\nshorturl_janitor_deleted_total %d\n", janitor.Deleted)
+	fmt.Fprintf(w, "# HELP shorturl_janitor_trash_purged_total Deleted links removed after the trash retention period.\n# TYPE shorturl_janitor_trash_purged_total counter\nshorturl_janitor_trash_purged_total %d\n", janitor.TrashPurged)
+	if janitor.Last != nil && !janitor.Last.Skipped {
+		fmt.Fprintf(w, "# HELP shorturl_janitor_last_run_timestamp_seconds When this instance last ran the janitor.\n# TYPE shorturl_janitor_last_run_timestamp_seconds gauge\nshorturl_janitor_last_run_timestamp_seconds %d\n", janitor.Last.StartedAt.Unix())
+	}
+
+	pool := h.db.PoolStats()
+	fmt.Fprintf(w, "# HELP shorturl_db_open_connections Open connections to the primary database.\n# TYPE shorturl_db_open_connections gauge\nshorturl_db_open_connections %d\n", pool.OpenConnections)
+	fmt.Fprintf(w, "# HELP shorturl_db_in_use_connections Connections to the primary database in use.\n# TYPE shorturl_db_in_use_connections gauge\nshorturl_db_in_use_connections %d\n", pool.InUse)
+	fmt.Fprintf(w, "# HELP shorturl_db_wait_count_total Times a query waited for a free connection.\n# TYPE shorturl_db_wait_count_total counter\nshorturl_db_wait_count_total %d\n", pool.WaitCount)
+	fmt.Fprintf(w, "# HELP shorturl_db_wait_duration_seconds_total Time spent waiting for a free connection.\n# TYPE shorturl_db_wait_duration_seconds_total counter\nshorturl_db_wait_duration_seconds_total %g\n", pool.WaitDuration.Seconds())
+	if replicas := h.db.ReplicaStatuses(); len(replicas) > 0 {
+		fmt.Fprint(w, "# HELP shorturl_db_replica_healthy Whether a read replica is serving reads.\n# TYPE shorturl_db_replica_healthy gauge\n")
+		for _, replica := range replicas {
+			healthy := 0
+			if replica.Healthy {
+				healthy = 1
+			}
+			fmt.Fprintf(w, "shorturl_db_replica_healthy{replica=%q} %d\n", replica.Name, healthy)
+		}
+		fmt.Fprint(w, "# HELP shorturl_db_replica_lag_seconds How far a read replica was behind the primary at its last check.\n# TYPE shorturl_db_replica_lag_seconds gauge\n")
+		for _, replica := range replicas {
+			fmt.Fprintf(w, "shorturl_db_replica_lag_seconds{replica=%q} %g\n", replica.Name, replica.Lag.Seconds())
+		}
+	}
+}
+
+// RedirectURL handles GET /{shortCode}. GET /{shortCode}+ or ?preview=1 shows
+// a preview page instead of redirecting.
 func (h *Handlers) RedirectURL(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("RedirectURL called")
 	shortCode := r.URL.Path[1:] // Remove leading slash
 
+	preview := r.URL.Query().Get("preview") == "1"
+	if strings.HasSuffix(shortCode, "+") {
+		shortCode = strings.TrimSuffix(shortCode, "+")
+		preview = true
+	}
+
 	if shortCode == "" {
 		fmt.Println("Error: Short code is required")
 		http.Error(w, "Short code is required", http.StatusBadRequest)
@@ -132,37 +371,165 @@ func (h *Handlers) RedirectURL(w http.ResponseWriter, r *http.Request) {
 
 	// Get URL from database by short code
 	fmt.Println("Looking up URL for short code:", shortCode)
-	shortURL, err := h.db.GetByShortCode(shortCode)
+	shortURL, err := h.db.GetByShortCode(r.Context(), shortCode)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			fmt.Println("URL not found for short code:", shortCode)
 			h.renderErrorPage(w, "URL not found", http.StatusNotFound)
 		} else {
 			fmt.Println("Database error looking up URL:", err)
-			h.renderErrorPage(w, "Database error", http.StatusInternalServerError)
+			status, _, _ := serverFailure(r, err, "")
+			h.renderErrorPage(w, "Database error", status)
 		}
 		return
 	}
 	fmt.Println("Found URL:", shortURL.OriginalURL)
 
+	// Deleted links stay reserved but no longer redirect
+	if shortURL.DeletedAt != nil {
+		fmt.Println("URL has been deleted:", shortCode)
+		h.renderErrorPage(w, "This link has been deleted", http.StatusGone)
+		return
+	}
+
+	// Links disabled by a moderator stop redirecting until re-enabled
+	if shortURL.DisabledAt != nil {
+		fmt.Println("URL has been disabled:", shortCode)
+		h.renderErrorPage(w, "This link has been disabled", http.StatusGone)
+		return
+	}
+
+	// Check if URL is live yet
+	if shortURL.ActivatesAt != nil && time.Now().Before(*shortURL.ActivatesAt) {
+		fmt.Println("URL is not active until:", shortURL.ActivatesAt)
+		if shortURL.PrelaunchURL != nil {
+			http.Redirect(w, r, *shortURL.PrelaunchURL, http.StatusFound)
+			return
+		}
+		h.renderNotYetActivePage(w, *shortURL.ActivatesAt)
+		return
+	}
+
 	// Check if URL has expired
-	if shortURL.ExpiresAt != nil && shortURL.ExpiresAt.Before(time.Now()) {
+	if !shortURL.Active || (shortURL.ExpiresAt != nil && shortURL.ExpiresAt.Before(time.Now())) {
 		fmt.Println("URL has expired:", shortURL.ExpiresAt)
+		if shortURL.ExpiredURL != nil {
+			http.Redirect(w, r, *shortURL.ExpiredURL, http.StatusFound)
+			return
+		}
 		h.renderErrorPage(w, "URL has expired", http.StatusNotFound)
 		return
 	}
 
+	// Check if the link has used up its clicks
+	if shortURL.MaxClicks != nil && shortURL.ClickCount >= *shortURL.MaxClicks {
+		fmt.Println("URL has used up its clicks:", shortURL.ShortCode)
+		h.renderUsedUpPage(w)
+		return
+	}
+
+	// Ask for the passphrase before revealing anything about a protected link
+	if shortURL.PasswordHash != nil && !h.unlockLink(w, r, shortURL) {
+		return
+	}
+
+	// Show the preview or interstitial page unless the visitor already confirmed
+	if preview || (shortURL.Interstitial && r.URL.Query().Get("confirm") != "1") {
+		page := newPreviewPage(shortURL, preview)
+		if shortURL.OwnerID != nil {
+			creator, err := h.db.GetUserByID(r.Context(), *shortURL.OwnerID)
+			if err != nil {
+				fmt.Println("Error looking up link creator:", err)
+			} else {
+				page.Creator = creator.UserID
+			}
+		}
+		h.renderPreviewPage(w, page)
+		return
+	}
+
+	// Bots such as link unfurlers and health checks don't use up clicks. So
+	// that pretending to be one can't get around a click limit, they aren't
+	// told where limited links go.
+	if h.bots.IsBot(r) {
+		fmt.Println("Bot click on:", shortURL.ShortCode)
+		h.recordClick(r, shortURL, true)
+		if shortURL.MaxClicks != nil {
+			h.renderBotPage(w)
+			return
+		}
+		http.Redirect(w, r, shortURL.OriginalURL, redirectStatus(shortURL))
+		return
+	}
+
 	// Increment click count
-	if err := h.db.IncrementClickCount(shortURL.ID); err != nil {
+	if err := h.db.IncrementClickCount(r.Context(), shortURL.ID); err != nil {
+		if err == ErrClickLimitReached {
+			// Another visitor took the last click
+			fmt.Println("URL has used up its clicks:", shortURL.ShortCode)
+			h.renderUsedUpPage(w)
+			return
+		}
+		if shortURL.MaxClicks != nil {
+			// A limited link can't be followed without counting the click
+			fmt.Printf("Failed to increment click count: %v\n", err)
+			status, _, _ := serverFailure(r, err, "")
+			h.renderErrorPage(w, "Database error", status)
+			return
+		}
 		// Log error but don't fail the redirect
 		fmt.Printf("Failed to increment click count: %v\n", err)
 	} else {
 		fmt.Println("Successfully incremented click count")
 	}
+	h.recordClick(r, shortURL, false)
 
 	// Redirect to original URL
 	fmt.Println("Redirecting to:", shortURL.OriginalURL)
-	http.Redirect(w, r, shortURL.OriginalURL, http.StatusMovedPermanently)
+	http.Redirect(w, r, shortURL.OriginalURL, redirectStatus(shortURL))
+}
+
+// newPreviewPage builds the preview, or the interstitial page unless preview
+// was asked for. Like bots, previews aren't told where links with a click
+// limit go, since viewing them doesn't use up a click; the destination is only
+// revealed by the counted redirect behind ContinueURL.
+func newPreviewPage(shortURL *ShortURL, preview bool) *PreviewPage {
+	return &PreviewPage{
+		ShortURL:        shortURL,
+		ContinueURL:     "/" + url.PathEscape(shortURL.ShortCode) + "?confirm=1",
+		Interstitial:    shortURL.Interstitial && !preview,
+		HideDestination: shortURL.MaxClicks != nil,
+	}
+}
+
+// validRedirectType reports whether status can be used as a link's redirect type
+func validRedirectType(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// redirectStatus returns the status code to redirect a visitor with. Browsers
+// cache permanent redirects indefinitely, past any later edit, deletion or
+// takedown and without counting clicks, so links only redirect permanently
+// when asked to.
+func redirectStatus(shortURL *ShortURL) int {
+	status := http.StatusFound
+	if shortURL.RedirectType != nil {
+		status = *shortURL.RedirectType
+	}
+	if !shortURL.isPlain() {
+		// A cached permanent redirect would outlive the link's access rules
+		switch status {
+		case http.StatusMovedPermanently:
+			status = http.StatusFound
+		case http.StatusPermanentRedirect:
+			status = http.StatusTemporaryRedirect
+		}
+	}
+	return status
 }
 
 // renderErrorPage renders a simple HTML error page
@@ -231,47 +598,30 @@ func (h *Handlers) Login(w http.ResponseWriter, r *http.Request) {
 	var req LoginRequest
 
 	// Parse JSON request
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	if !decodeJSON(w, r, &req) {
 		return
 	}
+	req.UserID = NormalizeUserID(req.UserID)
 	fmt.Println("Parsed login request for user:", req.UserID)
 
 	// Validate input
 	if req.UserID == "" || req.Password == "" {
-		response := AuthResponse{
-			Success: false,
-			Message: "User ID and password are required",
-		}
 		fmt.Println("Validation failed: missing user ID or password")
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+		writeError(w, r, http.StatusBadRequest, ProblemValidation, "User ID and password are required")
 		return
 	}
 	fmt.Println("User Id and Password is fine:")
 
 	// Get user from database
-	user, err := h.db.GetUserByUserID(req.UserID)
+	user, err := h.db.GetUserByUserID(r.Context(), req.UserID)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			response := AuthResponse{
-				Success: false,
-				Message: "Invalid user ID or password",
-			}
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusUnauthorized)
-			json.NewEncoder(w).Encode(response)
+			h.audit(r, nil, AuditLoginFailed, "user", req.UserID, nil, nil)
+			writeError(w, r, http.StatusUnauthorized, ProblemInvalidCredentials, "Invalid user ID or password")
 			return
 		}
 		fmt.Println("Database error during login:", err)
-		response := AuthResponse{
-			Success: false,
-			Message: "Internal server error",
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		writeServerError(w, r, err, "Internal server error")
 		return
 	}
 	fmt.Println("User found with ID:", user.UserID)
@@ -279,28 +629,45 @@ func (h *Handlers) Login(w http.ResponseWriter, r *http.Request) {
 	// Verify password
 	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password))
 	if err != nil {
-		response := AuthResponse{
-			Success: false,
-			Message: "Invalid user ID or password",
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(response)
+		h.audit(r, user, AuditLoginFailed, "user", user.UserID, nil, nil)
+		writeError(w, r, http.StatusUnauthorized, ProblemInvalidCredentials, "Invalid user ID or password")
 		return
 	}
 	fmt.Println("Password verified for user:", req.UserID)
 
-	// Generate simple token (in production, use JWT or similar)
-	token := fmt.Sprintf("token-%s-%d", req.UserID, time.Now().Unix())
+	if user.DisabledAt != nil {
+		h.audit(r, user, AuditLoginFailed, "user", user.UserID, nil, nil)
+		writeError(w, r, http.StatusForbidden, ProblemAccountDisabled, "Account disabled")
+		return
+	}
+
+	// Users with two-factor authentication finish logging in at /api/login/mfa
+	if user.TOTPEnabledAt != nil {
+		writeProblem(w, http.StatusUnauthorized, &MFAChallenge{
+			ErrorResponse:  *newProblem(r, http.StatusUnauthorized, ProblemMFARequired, "Two-factor authentication code required"),
+			UserID:         user.UserID,
+			ChallengeToken: h.tokens.Issue(mfaChallengePurpose, user.UserID, mfaChallengeTTL),
+		})
+		return
+	}
+
+	// Start a session on this device
+	token, err := h.startSession(r, user)
+	if err != nil {
+		fmt.Println("Error starting session:", err)
+		writeServerError(w, r, err, "Internal server error")
+		return
+	}
 
 	response := AuthResponse{
 		Success: true,
 		Message: "Login successful",
 		Token:   token,
-		UserID:  req.UserID,
+		UserID:  user.UserID,
 	}
 
 	fmt.Println("Login successful for user:", req.UserID)
+	h.audit(r, user, AuditLogin, "user", user.UserID, nil, nil)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
@@ -311,74 +678,32 @@ func (h *Handlers) Signup(w http.ResponseWriter, r *http.Request) {
 	var req SignupRequest
 
 	// Parse JSON request
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	if !decodeJSON(w, r, &req) {
 		return
 	}
+	req.UserID = NormalizeUserID(req.UserID)
 	fmt.Println("Parsed signup request for user:", req.UserID)
 
-	// Validate input
-	if req.UserID == "" || req.Password == "" {
-		response := AuthResponse{
-			Success: false,
-			Message: "User ID and password are required",
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+	// Validate input, reporting every rejected field
+	fieldErrors := append(h.userIDPolicy.Check(req.UserID), h.passwordPolicy.Check("password", req.Password, req.UserID)...)
+	if len(fieldErrors) > 0 {
+		fmt.Println("Signup validation failed for user:", req.UserID)
+		writeFieldErrors(w, r, http.StatusBadRequest, ProblemValidation, fieldErrors)
 		return
 	}
-	fmt.Println("User Id and Password is fine:")
 
-	// Basic validation for user ID (alphanumeric, minimum length)
-	if len(req.UserID) < 3 {
-		response := AuthResponse{
-			Success: false,
-			Message: "User ID must be at least 3 characters long",
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
-		return
-	}
-	fmt.Println("validated user ID:", req.UserID)
-
-	// Basic validation for password (minimum length)
-	if len(req.Password) < 6 {
-		response := AuthResponse{
-			Success: false,
-			Message: "Password must be at least 6 characters long",
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
-		return
-	}
-	fmt.Println("validated password length for user:", req.UserID)
-
-	// Check if user already exists
-	exists, err := h.db.UserExists(req.UserID)
+	// Check if user already exists, ignoring case
+	exists, err := h.db.UserExists(r.Context(), req.UserID)
 	if err != nil {
 		fmt.Println("Database error checking user existence:", err)
-		response := AuthResponse{
-			Success: false,
-			Message: "Internal server error",
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		writeServerError(w, r, err, "Internal server error")
 		return
 	}
 	fmt.Println("User existence check for", req.UserID, ":", exists)
 
 	if exists {
-		response := AuthResponse{
-			Success: false,
-			Message: "User ID already exists",
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusConflict)
-		json.NewEncoder(w).Encode(response)
+		taken := FieldError{Field: "user_id", Code: ValidationTaken, Message: "User ID already exists"}
+		writeFieldErrors(w, r, http.StatusConflict, ProblemAlreadyExists, []FieldError{taken})
 		return
 	}
 	fmt.Println("User ID is available:", req.UserID)
@@ -387,34 +712,27 @@ func (h *Handlers) Signup(w http.ResponseWriter, r *http.Request) {
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 	if err != nil {
 		fmt.Println("Error hashing password:", err)
-		response := AuthResponse{
-			Success: false,
-			Message: "Internal server error",
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		writeError(w, r, http.StatusInternalServerError, ProblemInternal, "Internal server error")
 		return
 	}
 	fmt.Println("Password hashed successfully for user:", req.UserID)
 
 	// Create user in database
-	user, err := h.db.CreateUser(req.UserID, string(hashedPassword))
+	user, err := h.db.CreateUser(r.Context(), req.UserID, string(hashedPassword))
 	if err != nil {
 		fmt.Println("Error creating user:", err)
-		response := AuthResponse{
-			Success: false,
-			Message: "Failed to create user",
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		writeServerError(w, r, err, "Failed to create user")
 		return
 	}
 	fmt.Println("User created with ID:", user.ID)
 
-	// Generate simple token (in production, use JWT or similar)
-	token := fmt.Sprintf("token-%s-%d", req.UserID, time.Now().Unix())
+	// Start a session on this device
+	token, err := h.startSession(r, user)
+	if err != nil {
+		fmt.Println("Error starting session:", err)
+		writeServerError(w, r, err, "Internal server error")
+		return
+	}
 
 	response := AuthResponse{
 		Success: true,
@@ -424,6 +742,7 @@ func (h *Handlers) Signup(w http.ResponseWriter, r *http.Request) {
 	}
 
 	fmt.Println("Signup successful for user:", req.UserID)
+	h.audit(r, user, AuditSignup, "user", user.UserID, nil, user)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(response)
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedirectStatus(t *testing.T) {
+	later := time.Now().Add(time.Hour)
+	tests := []struct {
+		name string
+		link ShortURL
+		want int
+	}{
+		{"default", ShortURL{}, http.StatusFound},
+		{"301", ShortURL{RedirectType: intPtr(http.StatusMovedPermanently)}, http.StatusMovedPermanently},
+		{"302", ShortURL{RedirectType: intPtr(http.StatusFound)}, http.StatusFound},
+		{"307", ShortURL{RedirectType: intPtr(http.StatusTemporaryRedirect)}, http.StatusTemporaryRedirect},
+		{"308", ShortURL{RedirectType: intPtr(http.StatusPermanentRedirect)}, http.StatusPermanentRedirect},
+		{"301 with expiry", ShortURL{RedirectType: intPtr(http.StatusMovedPermanently), ExpiresAt: &later}, http.StatusFound},
+		{"308 with max clicks", ShortURL{RedirectType: intPtr(http.StatusPermanentRedirect), MaxClicks: intPtr(3)}, http.StatusTemporaryRedirect},
+		{"307 with password", ShortURL{RedirectType: intPtr(http.StatusTemporaryRedirect), PasswordHash: stringPtr("hash")}, http.StatusTemporaryRedirect},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redirectStatus(&tt.link); got != tt.want {
+				t.Errorf("redirectStatus = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPreviewPageHidesLimitedDestinations(t *testing.T) {
+	const destination = "https://example.com/secret-invite"
+	tests := []struct {
+		name     string
+		link     ShortURL
+		preview  bool
+		wantShow bool
+	}{
+		{"preview", ShortURL{ShortCode: "abc123", OriginalURL: destination}, true, true},
+		{"interstitial", ShortURL{ShortCode: "abc123", OriginalURL: destination, Interstitial: true}, false, true},
+		{"single-use preview", ShortURL{ShortCode: "abc123", OriginalURL: destination, MaxClicks: intPtr(1)}, true, false},
+		{"limited interstitial", ShortURL{ShortCode: "abc123", OriginalURL: destination, MaxClicks: intPtr(5), Interstitial: true}, false, false},
+	}
+	h := &Handlers{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.renderPreviewPage(rec, newPreviewPage(&tt.link, tt.preview))
+			body := rec.Body.String()
+			if shown := strings.Contains(body, destination); shown != tt.wantShow {
+				t.Errorf("destination shown = %v, want %v", shown, tt.wantShow)
+			}
+			if !strings.Contains(body, "/abc123?confirm=1") {
+				t.Error("page has no link to the counted redirect")
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Purge policies for links that stayed expired past the grace period
+const (
+	// PurgeNone leaves expired links in place once they are deactivated
+	PurgeNone = "none"
+	// PurgeArchive moves expired links to short_urls_archive
+	PurgeArchive = "archive"
+	// PurgeDelete removes expired links permanently
+	PurgeDelete = "delete"
+)
+
+// Code policies for purged links
+const (
+	// CodeReserve keeps a purged link's short code from ever being reused
+	CodeReserve = "reserve"
+	// CodeFree lets a purged link's short code be allocated again
+	CodeFree = "free"
+)
+
+// janitorLockKey is the Postgres advisory lock held by the instance running the janitor
+const janitorLockKey int64 = 0x73686f727475726c // "shorturl"
+
+// JanitorConfig configures the background cleanup of expired links
+type JanitorConfig struct {
+	// Interval between runs; zero disables the janitor
+	Interval    time.Duration
+	GracePeriod time.Duration
+	PurgePolicy string
+	CodePolicy  string
+	BatchSize   int
+	// TrashRetention is how long deleted links stay restorable; zero keeps them forever
+	TrashRetention time.Duration
+}
+
+// Validate checks the janitor policies are known
+func (c JanitorConfig) Validate() error {
+	switch c.PurgePolicy {
+	case PurgeNone, PurgeArchive, PurgeDelete:
+	default:
+		return fmt.Errorf("unknown purge policy %q", c.PurgePolicy)
+	}
+	switch c.CodePolicy {
+	case CodeReserve, CodeFree:
+	default:
+		return fmt.Errorf("unknown code policy %q", c.CodePolicy)
+	}
+	if c.BatchSize <= 0 {
+		return fmt.Errorf("batch size must be positive, got %d", c.BatchSize)
+	}
+	return nil
+}
+
+// JanitorReport describes what a janitor run did
+type JanitorReport struct {
+	StartedAt   time.Time     `json:"started_at"`
+	Duration    time.Duration `json:"duration"`
+	Skipped     bool          `json:"skipped"` // another instance holds the leader lock
+	Deactivated int64         `json:"deactivated"`
+	Archived    int64         `json:"archived"`
+	Deleted     int64         `json:"deleted"`
+	// TrashPurged counts deleted links removed after the trash retention period
+	TrashPurged int64 `json:"trash_purged"`
+	// SessionsPurged counts expired login sessions removed
+	SessionsPurged int64 `json:"sessions_purged"`
+}
+
+// Janitor periodically deactivates expired links and purges them after a grace period
+type Janitor struct {
+	db  *Database
+	cfg JanitorConfig
+
+	mu          sync.Mutex
+	last        *JanitorReport
+	runs        uint64
+	deactivated int64
+	archived    int64
+	deleted     int64
+	trashPurged int64
+}
+
+// NewJanitor creates a janitor
+func NewJanitor(db *Database, cfg JanitorConfig) *Janitor {
+	return &Janitor{db: db, cfg: cfg}
+}
+
+// Start runs the janitor every interval until ctx is cancelled
+func (j *Janitor) Start(ctx context.Context) {
+	if j.cfg.Interval <= 0 {
+		log.Println("Janitor disabled")
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(j.cfg.Interval)
+		defer ticker.Stop()
+		for {
+			if _, err := j.RunOnce(ctx); err != nil {
+				log.Println("Janitor run failed:", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// RunOnce performs a single cleanup pass if this instance can take the leader lock
+func (j *Janitor) RunOnce(ctx context.Context) (*JanitorReport, error) {
+	report := &JanitorReport{StartedAt: time.Now()}
+
+	unlock, acquired, err := j.db.TryAdvisoryLock(ctx, janitorLockKey)
+	if err != nil {
+		return nil, err
+	}
+	if !acquired {
+		report.Skipped = true
+		j.record(report)
+		return report, nil
+	}
+	defer unlock()
+
+	report.Deactivated, err = j.db.DeactivateExpired(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if j.cfg.PurgePolicy != PurgeNone {
+		cutoff := time.Now().Add(-j.cfg.GracePeriod)
+		archive := j.cfg.PurgePolicy == PurgeArchive
+		reserve := j.cfg.CodePolicy == CodeReserve
+		for {
+			n, err := j.db.PurgeInactive(ctx, cutoff, j.cfg.BatchSize, archive, reserve)
+			if err != nil {
+				return nil, err
+			}
+			if archive {
+				report.Archived += n
+			} else {
+				report.Deleted += n
+			}
+			if n < int64(j.cfg.BatchSize) || ctx.Err() != nil {
+				break
+			}
+		}
+	}
+
+	// Deleted links always keep their codes reserved so printed links never change destination
+	if j.cfg.TrashRetention > 0 {
+		cutoff := time.Now().Add(-j.cfg.TrashRetention)
+		archive := j.cfg.PurgePolicy == PurgeArchive
+		for {
+			n, err := j.db.PurgeDeleted(ctx, cutoff, j.cfg.BatchSize, archive)
+			if err != nil {
+				return nil, err
+			}
+			report.TrashPurged += n
+			if n < int64(j.cfg.BatchSize) || ctx.Err() != nil {
+				break
+			}
+		}
+	}
+
+	report.SessionsPurged, err = j.db.PurgeExpiredSessions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report.Duration = time.Since(report.StartedAt)
+	j.record(report)
+	log.Printf("Janitor run: deactivated %d, archived %d, deleted %d expired links, purged %d from the trash and %d expired sessions in %s",
+		report.Deactivated, report.Archived, report.Deleted, report.TrashPurged, report.SessionsPurged, report.Duration)
+	return report, nil
+}
+
+// record keeps the report and running totals for the metrics endpoint
+func (j *Janitor) record(report *JanitorReport) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.last = report
+	j.runs++
+	j.deactivated += report.Deactivated
+	j.archived += report.Archived
+	j.deleted += report.Deleted
+	j.trashPurged += report.TrashPurged
+}
+
+// JanitorStats is a snapshot of janitor totals
+type JanitorStats struct {
+	Runs        uint64
+	Deactivated int64
+	Archived    int64
+	Deleted     int64
+	TrashPurged int64
+	Last        *JanitorReport
+}
+
+// Stats returns the janitor's running totals and its last report
+func (j *Janitor) Stats() JanitorStats {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return JanitorStats{Runs: j.runs, Deactivated: j.deactivated, Archived: j.archived, Deleted: j.deleted, TrashPurged: j.trashPurged, Last: j.last}
+}
+
+// CreateArchiveTables creates the tables used by the janitor if they don't exist
+func (db *Database) CreateArchiveTables(ctx context.Context) error {
+	fmt.Println("CreateArchiveTables called")
+	query := `
+		CREATE TABLE IF NOT EXISTS short_urls_archive (
+			id INTEGER PRIMARY KEY,
+			short_code VARCHAR(32) NOT NULL,
+			original_url TEXT NOT NULL,
+			data JSONB NOT NULL,
+			archived_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_archive_short_code ON short_urls_archive(short_code);
+
+		CREATE TABLE IF NOT EXISTS reserved_codes (
+			short_code VARCHAR(32) PRIMARY KEY,
+			reserved_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+	`
+
+	_, err := db.conn.ExecContext(ctx, query)
+	return err
+}
+
+// TryAdvisoryLock takes a session-level Postgres advisory lock without waiting.
+// If acquired, the returned function releases it.
+func (db *Database) TryAdvisoryLock(ctx context.Context, key int64) (func(), bool, error) {
+	conn, err := db.conn.Conn(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var acquired bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, key).Scan(&acquired); err != nil {
+		conn.Close()
+		return nil, false, err
+	}
+	if !acquired {
+		conn.Close()
+		return nil, false, nil
+	}
+
+	unlock := func() {
+		if _, err := conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, key); err != nil {
+			log.Println("Failed to release advisory lock:", err)
+		}
+		conn.Close()
+	}
+	return unlock, true, nil
+}
+
+// DeactivateExpired marks expired links inactive and releases their dedup keys
+func (db *Database) DeactivateExpired(ctx context.Context) (int64, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	query := `
+		UPDATE short_urls
+		SET active = FALSE, deactivated_at = NOW(), dedup_key = NULL
+		WHERE active AND expires_at < NOW()`
+	result, err := db.conn.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// PurgeInactive removes up to limit links deactivated before cutoff, optionally
+// copying them to short_urls_archive and reserving their short codes
+func (db *Database) PurgeInactive(ctx context.Context, cutoff time.Time, limit int, archive, reserve bool) (int64, error) {
+	return db.purge(ctx, `NOT active AND deactivated_at < $1`, cutoff, limit, archive, reserve)
+}
+
+// PurgeDeleted removes up to limit links deleted before cutoff, optionally
+// copying them to short_urls_archive. Their short codes are always reserved.
+func (db *Database) PurgeDeleted(ctx context.Context, cutoff time.Time, limit int, archive bool) (int64, error) {
+	return db.purge(ctx, `deleted_at < $1`, cutoff, limit, archive, true)
+}
+
+// purge removes up to limit links matching condition, which compares against
+// cutoff as $1. Everything happens in one statement so a purge is never half-applied.
+func (db *Database) purge(ctx context.Context, condition string, cutoff time.Time, limit int, archive, reserve bool) (int64, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	query := `
+		WITH purged AS (
+			DELETE FROM short_urls
+			WHERE id IN (
+				SELECT id FROM short_urls
+				WHERE ` + condition + `
+				ORDER BY id
+				LIMIT $2
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING *
+		), archived AS (
+			INSERT INTO short_urls_archive (id, short_code, original_url, data)
+			SELECT id, short_code, original_url, to_jsonb(purged) FROM purged WHERE $3
+			ON CONFLICT (id) DO NOTHING
+		), reserved AS (
+			INSERT INTO reserved_codes (short_code)
+			SELECT short_code FROM purged WHERE $4
+			ON CONFLICT (short_code) DO NOTHING
+		)
+		SELECT COUNT(*) FROM purged`
+
+	var count int64
+	err := db.conn.QueryRowContext(ctx, query, cutoff, limit, archive, reserve).Scan(&count)
+	return count, err
+}
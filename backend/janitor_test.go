@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJanitorConfigValidate(t *testing.T) {
+	valid := JanitorConfig{
+		Interval:    time.Hour,
+		GracePeriod: 30 * 24 * time.Hour,
+		PurgePolicy: PurgeArchive,
+		CodePolicy:  CodeReserve,
+		BatchSize:   500,
+	}
+	with := func(change func(*JanitorConfig)) JanitorConfig {
+		c := valid
+		change(&c)
+		return c
+	}
+	tests := []struct {
+		name    string
+		cfg     JanitorConfig
+		wantErr bool
+	}{
+		{"defaults", valid, false},
+		{"purge none", with(func(c *JanitorConfig) { c.PurgePolicy = PurgeNone }), false},
+		{"purge delete, free codes", with(func(c *JanitorConfig) { c.PurgePolicy = PurgeDelete; c.CodePolicy = CodeFree }), false},
+		{"disabled", with(func(c *JanitorConfig) { c.Interval = 0 }), false},
+		{"unknown purge policy", with(func(c *JanitorConfig) { c.PurgePolicy = "shred" }), true},
+		{"empty purge policy", with(func(c *JanitorConfig) { c.PurgePolicy = "" }), true},
+		{"unknown code policy", with(func(c *JanitorConfig) { c.CodePolicy = "recycle" }), true},
+		{"zero batch size", with(func(c *JanitorConfig) { c.BatchSize = 0 }), true},
+		{"negative batch size", with(func(c *JanitorConfig) { c.BatchSize = -1 }), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
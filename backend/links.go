@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// accessibleLink looks up the link in the {code} route variable and checks user
+// may act on it. Personal links are only visible to their owner; workspace links
+// need a membership of at least need. It writes a 404 for links the user can't
+// see and a 403 for links they can see but not change.
+func (h *Handlers) accessibleLink(w http.ResponseWriter, r *http.Request, user *User, need string) (*ShortURL, bool) {
+	shortURL, err := h.db.GetByShortCodePrimary(r.Context(), mux.Vars(r)["code"])
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, ProblemNotFound, "Link not found")
+		return nil, false
+	}
+	if err != nil {
+		fmt.Println("Database error looking up link:", err)
+		writeServerError(w, r, err, "Database error")
+		return nil, false
+	}
+
+	if shortURL.WorkspaceID == nil {
+		if shortURL.OwnerID == nil || *shortURL.OwnerID != user.ID {
+			writeError(w, r, http.StatusNotFound, ProblemNotFound, "Link not found")
+			return nil, false
+		}
+		return shortURL, true
+	}
+
+	workspace, err := h.db.GetMembership(r.Context(), *shortURL.WorkspaceID, user.ID)
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, ProblemNotFound, "Link not found")
+		return nil, false
+	}
+	if err != nil {
+		fmt.Println("Database error looking up membership:", err)
+		writeServerError(w, r, err, "Database error")
+		return nil, false
+	}
+	if !hasWorkspaceRole(workspace.Role, need) {
+		writeError(w, r, http.StatusForbidden, ProblemForbidden, "Insufficient workspace permissions")
+		return nil, false
+	}
+	return shortURL, true
+}
+
+// ListLinks handles GET /api/links, listing the links in the current workspace
+// or the user's personal links
+func (h *Handlers) ListLinks(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("ListLinks called")
+	h.listLinks(w, r, false)
+}
+
+// GetLink handles GET /api/links/{code}
+func (h *Handlers) GetLink(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("GetLink called")
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+	shortURL, ok := h.accessibleLink(w, r, user, WorkspaceViewer)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, shortURL)
+}
+
+// DeleteLink handles DELETE /api/links/{code} by moving the link to the trash
+func (h *Handlers) DeleteLink(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("DeleteLink called")
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+	shortURL, ok := h.accessibleLink(w, r, user, WorkspaceEditor)
+	if !ok {
+		return
+	}
+	if shortURL.DeletedAt != nil {
+		writeError(w, r, http.StatusConflict, ProblemConflict, "Link is already in the trash")
+		return
+	}
+
+	deleted, err := h.db.SoftDelete(r.Context(), shortURL.ID)
+	if err != nil {
+		fmt.Println("Database error deleting link:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	fmt.Println("Moved link to trash:", deleted.ShortCode)
+	h.audit(r, user, AuditLinkDelete, "link", deleted.ShortCode, shortURL, deleted)
+	writeJSON(w, http.StatusOK, deleted)
+}
+
+// ListTrash handles GET /api/links/trash
+func (h *Handlers) ListTrash(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("ListTrash called")
+	h.listLinks(w, r, true)
+}
+
+// listLinks writes the links in the user's current scope that are, or are not, in the trash
+func (h *Handlers) listLinks(w http.ResponseWriter, r *http.Request, deleted bool) {
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+	workspace, ok := h.currentWorkspace(w, r, user, WorkspaceViewer)
+	if !ok {
+		return
+	}
+
+	var links []*ShortURL
+	var err error
+	if workspace != nil {
+		links, err = h.db.ListWorkspaceLinks(r.Context(), workspace.ID, deleted)
+	} else {
+		links, err = h.db.ListPersonalLinks(r.Context(), user.ID, deleted)
+	}
+	if err != nil {
+		fmt.Println("Database error listing links:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	writeJSON(w, http.StatusOK, links)
+}
+
+// RestoreLink handles POST /api/links/{code}/restore
+func (h *Handlers) RestoreLink(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("RestoreLink called")
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+	shortURL, ok := h.accessibleLink(w, r, user, WorkspaceEditor)
+	if !ok {
+		return
+	}
+	if shortURL.DeletedAt == nil {
+		writeError(w, r, http.StatusConflict, ProblemConflict, "Link is not in the trash")
+		return
+	}
+	if shortURL.Active && !h.enforceQuotas(w, r, user, shortURL.WorkspaceID, QuotaActiveLinks) {
+		return
+	}
+
+	// Links the janitor deactivated or a moderator disabled stay without a dedup key
+	var key *string
+	if shortURL.Active && shortURL.DisabledAt == nil {
+		key = dedupKey(h.dedupMode, shortURL)
+	}
+	restored, err := h.db.Restore(r.Context(), shortURL.ID, key)
+	if err != nil {
+		fmt.Println("Database error restoring link:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	fmt.Println("Restored link from trash:", restored.ShortCode)
+	h.audit(r, user, AuditLinkRestore, "link", restored.ShortCode, shortURL, restored)
+	writeJSON(w, http.StatusOK, restored)
+}
+
+// SoftDelete moves a link to the trash. Its dedup key is released so the
+// destination can be shortened again, but the short code stays taken.
+// Restore takes the key back if it is still free.
+func (db *Database) SoftDelete(ctx context.Context, id int) (*ShortURL, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	query := `UPDATE short_urls SET deleted_at = NOW(), dedup_key = NULL WHERE id = $1 RETURNING ` + shortURLColumns
+	return scanShortURL(db.conn.QueryRowContext(ctx, query, id))
+}
+
+// Restore takes a link out of the trash and gives it dedupKey, which SoftDelete
+// released. If another link has taken the key since, the restored link is
+// left without one.
+func (db *Database) Restore(ctx context.Context, id int, dedupKey *string) (*ShortURL, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	query := `
+		UPDATE short_urls SET deleted_at = NULL,
+			dedup_key = CASE WHEN NOT EXISTS (SELECT 1 FROM short_urls WHERE dedup_key = $2) THEN $2 END
+		WHERE id = $1
+		RETURNING ` + shortURLColumns
+	restored, err := scanShortURL(db.conn.QueryRowContext(ctx, query, id, dedupKey))
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		// A link created concurrently took the key
+		return scanShortURL(db.conn.QueryRowContext(ctx, query, id, nil))
+	}
+	return restored, err
+}
+
+// ListPersonalLinks returns a user's links outside any workspace, either
+// live ones newest first or the trash most recently deleted first
+func (db *Database) ListPersonalLinks(ctx context.Context, ownerID int, deleted bool) ([]*ShortURL, error) {
+	query := `SELECT ` + shortURLColumns + ` FROM short_urls WHERE owner_id = $1 AND workspace_id IS NULL AND ` + trashCondition(deleted)
+	return db.queryShortURLs(ctx, query, ownerID)
+}
+
+// ListWorkspaceLinks returns a workspace's links, either live ones newest
+// first or the trash most recently deleted first
+func (db *Database) ListWorkspaceLinks(ctx context.Context, workspaceID int, deleted bool) ([]*ShortURL, error) {
+	query := `SELECT ` + shortURLColumns + ` FROM short_urls WHERE workspace_id = $1 AND ` + trashCondition(deleted)
+	return db.queryShortURLs(ctx, query, workspaceID)
+}
+
+// trashCondition selects and orders links in or out of the trash
+func trashCondition(deleted bool) string {
+	if deleted {
+		return `deleted_at IS NOT NULL ORDER BY deleted_at DESC`
+	}
+	return `deleted_at IS NULL ORDER BY id DESC`
+}
+
+// queryShortURLs runs a query selecting shortURLColumns and scans every row
+func (db *Database) queryShortURLs(ctx context.Context, query string, args ...any) ([]*ShortURL, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	rows, err := db.conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []*ShortURL{}
+	for rows.Next() {
+		shortURL, err := scanShortURL(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, shortURL)
+	}
+	return links, rows.Err()
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
@@ -19,6 +21,21 @@ func main() {
 		log.Println("No .env file found, using system environment variables")
 	}
 
+	// Load configuration
+	config := LoadConfig()
+	if err := config.UserIDPolicy.Validate(); err != nil {
+		log.Fatal("Invalid user ID policy:", err)
+	}
+	if err := config.PasswordPolicy.Validate(); err != nil {
+		log.Fatal("Invalid password policy:", err)
+	}
+	if err := config.Pool.Validate(); err != nil {
+		log.Fatal("Invalid connection pool configuration:", err)
+	}
+	if err := config.Replicas.Validate(); err != nil {
+		log.Fatal("Invalid read replica configuration:", err)
+	}
+
 	// Get database URL from environment or use default
 	dbURL := os.Getenv("DATABASE_URL")
 	if dbURL == "" {
@@ -33,22 +50,109 @@ func main() {
 	}
 	defer db.Close()
 
+	config.Pool.Apply(db)
+
 	// Test database connection
 	if err := db.Ping(); err != nil {
 		log.Fatal("Failed to ping database:", err)
 	}
 
 	// Create database instance and tables
-	database := NewDatabase(db)
-	if err := database.CreateTable(); err != nil {
+	database := NewDatabase(db, config.QueryTimeout)
+	ctx := context.Background()
+	if err := database.CreateTable(ctx); err != nil {
 		log.Fatal("Failed to create short_urls table:", err)
 	}
-	if err := database.CreateUserTable(); err != nil {
+	if err := database.CreateUserTable(ctx); err != nil {
 		log.Fatal("Failed to create users table:", err)
 	}
+	if err := database.CreateArchiveTables(ctx); err != nil {
+		log.Fatal("Failed to create archive tables:", err)
+	}
+	if err := database.CreateRevisionTable(ctx); err != nil {
+		log.Fatal("Failed to create link_revisions table:", err)
+	}
+	if err := database.CreateAuditTable(ctx); err != nil {
+		log.Fatal("Failed to create audit_events table:", err)
+	}
+	if err := database.CreateWorkspaceTables(ctx); err != nil {
+		log.Fatal("Failed to create workspace tables:", err)
+	}
+	if err := database.CreatePasswordResetTable(ctx); err != nil {
+		log.Fatal("Failed to create password_resets table:", err)
+	}
+	if err := database.CreateSessionTable(ctx); err != nil {
+		log.Fatal("Failed to create sessions table:", err)
+	}
+	if err := database.CreateRecoveryCodeTable(ctx); err != nil {
+		log.Fatal("Failed to create mfa_recovery_codes table:", err)
+	}
+	if err := database.CreateIdentityTable(ctx); err != nil {
+		log.Fatal("Failed to create user_identities table:", err)
+	}
+	if err := database.CreateClickTables(ctx); err != nil {
+		log.Fatal("Failed to create click tables:", err)
+	}
+
+	// Run a CLI subcommand such as create-admin instead of the server
+	if ran, err := runCommand(database, config, os.Args[1:]); ran {
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Connect to read replicas; ones that are down or behind are skipped until they recover
+	var replicas []*sql.DB
+	for _, dsn := range config.Replicas.URLs {
+		replica, err := sql.Open("postgres", dsn)
+		if err != nil {
+			log.Fatal("Invalid read replica URL:", err)
+		}
+		defer replica.Close()
+		config.Pool.Apply(replica)
+		replicas = append(replicas, replica)
+	}
+	database.SetReplicas(config.Replicas.URLs, replicas, config.Replicas.MaxLag)
+	database.MonitorReplicas(ctx, config.Replicas.CheckInterval)
+
+	// Create short code allocator
+	codes, err := NewCodeAllocator(database, config.CodeGenerator, config.Allocator)
+	if err != nil {
+		log.Fatal("Invalid short code configuration:", err)
+	}
+
+	if err := ValidateDedupMode(config.DedupMode); err != nil {
+		log.Fatal("Invalid DEDUP_MODE:", err)
+	}
+	if err := ValidateMFARoles(config.MFARequiredRoles); err != nil {
+		log.Fatal("Invalid MFA_REQUIRED_ROLES:", err)
+	}
+	if err := config.OIDC.Validate(); err != nil {
+		log.Fatal("Invalid OIDC configuration:", err)
+	}
+	if config.MaxBodyBytes <= 0 {
+		log.Fatal("Invalid MAX_BODY_BYTES: must be positive")
+	}
+
+	// Start the background janitor for expired links
+	if err := config.Janitor.Validate(); err != nil {
+		log.Fatal("Invalid janitor configuration:", err)
+	}
+	janitor := NewJanitor(database, config.Janitor)
+	janitor.Start(context.Background())
 
 	// Create handlers
-	appHandlers := NewHandlers(database)
+	tokens := NewTokenSigner(config.AuthSecret)
+	notifier, err := NewNotifier(config.Notifier, config.NotifierFile)
+	if err != nil {
+		log.Fatal("Invalid notifier configuration:", err)
+	}
+	bots, err := NewBotDetector(config.BotUserAgentsFile)
+	if err != nil {
+		log.Fatal("Failed to read BOT_USER_AGENTS_FILE:", err)
+	}
+	appHandlers := NewHandlers(database, codes, janitor, tokens, notifier, bots, config)
 
 	// Create router
 	r := mux.NewRouter()
@@ -56,16 +160,78 @@ func main() {
 	// Add CORS middleware
 	corsHandler := handlers.CORS(
 		handlers.AllowedOrigins([]string{"http://localhost:3000"}),
-		handlers.AllowedMethods([]string{"GET", "POST"}),
-		handlers.AllowedHeaders([]string{"Content-Type", "Authorization"}),
+		handlers.AllowedMethods([]string{"GET", "POST", "PUT", "PATCH", "DELETE"}),
+		handlers.AllowedHeaders([]string{"Content-Type", "Authorization", requestIDHeader}),
+		handlers.ExposedHeaders([]string{requestIDHeader, "Retry-After"}),
 		handlers.AllowCredentials(),
-	)(r)
+	)(withRequestID(recoverPanics(limitBody(config.MaxBodyBytes, r))))
+
+	// Deadlines for database work, by route template
+	r.Use(withDeadlines(config.RequestTimeout, map[string]time.Duration{
+		"/":                       config.RedirectTimeout,
+		"/api/admin/audit/export": config.ExportTimeout,
+	}))
 
 	// API routes
-	api := r.PathPrefix("/api").Subrouter()
+	// The matcher keeps short codes that merely start with "api" out of the API
+	api := r.PathPrefix("/api").MatcherFunc(func(req *http.Request, _ *mux.RouteMatch) bool { return isAPIRequest(req) }).Subrouter()
+	api.NotFoundHandler = http.HandlerFunc(notFoundAPI)
+	api.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowedAPI)
 	api.HandleFunc("/shorten", appHandlers.ShortenURL).Methods("POST")
 	api.HandleFunc("/login", appHandlers.Login).Methods("POST")
+	api.HandleFunc("/login/mfa", appHandlers.LoginMFA).Methods("POST")
+	api.HandleFunc("/oidc/login", appHandlers.OIDCLogin).Methods("GET")
+	api.HandleFunc("/oidc/callback", appHandlers.OIDCCallback).Methods("GET")
+	api.HandleFunc("/oidc/link", appHandlers.OIDCLink).Methods("POST")
+	api.HandleFunc("/oidc/link/complete", appHandlers.CompleteOIDCLink).Methods("POST")
+	api.HandleFunc("/oidc/identities", appHandlers.ListIdentities).Methods("GET")
+	api.HandleFunc("/oidc/identities/{identityID}", appHandlers.UnlinkIdentity).Methods("DELETE")
 	api.HandleFunc("/signup", appHandlers.Signup).Methods("POST")
+	api.HandleFunc("/logout", appHandlers.Logout).Methods("POST")
+	api.HandleFunc("/logout/all", appHandlers.LogoutAll).Methods("POST")
+	api.HandleFunc("/sessions", appHandlers.ListSessions).Methods("GET")
+	api.HandleFunc("/sessions/{sessionID}", appHandlers.RevokeSession).Methods("DELETE")
+	api.HandleFunc("/password/change", appHandlers.ChangePassword).Methods("POST")
+	api.HandleFunc("/password/forgot", appHandlers.ForgotPassword).Methods("POST")
+	api.HandleFunc("/password/reset", appHandlers.ResetPassword).Methods("POST")
+	api.HandleFunc("/mfa/totp/enroll", appHandlers.EnrollTOTP).Methods("POST")
+	api.HandleFunc("/mfa/totp/enable", appHandlers.EnableTOTP).Methods("POST")
+	api.HandleFunc("/mfa/totp", appHandlers.DisableTOTP).Methods("DELETE")
+	api.HandleFunc("/mfa/recovery-codes", appHandlers.RegenerateRecoveryCodes).Methods("POST")
+	api.HandleFunc("/metrics", appHandlers.RequireRole(RoleAdmin, appHandlers.Metrics)).Methods("GET")
+	api.HandleFunc("/usage", appHandlers.Usage).Methods("GET")
+	api.HandleFunc("/links", appHandlers.ListLinks).Methods("GET")
+	api.HandleFunc("/links/trash", appHandlers.ListTrash).Methods("GET")
+	api.HandleFunc("/links/{code}", appHandlers.GetLink).Methods("GET")
+	api.HandleFunc("/links/{code}", appHandlers.UpdateLink).Methods("PATCH")
+	api.HandleFunc("/links/{code}", appHandlers.DeleteLink).Methods("DELETE")
+	api.HandleFunc("/links/{code}/restore", appHandlers.RestoreLink).Methods("POST")
+	api.HandleFunc("/links/{code}/revisions", appHandlers.ListRevisions).Methods("GET")
+	api.HandleFunc("/links/{code}/analytics", appHandlers.LinkAnalytics).Methods("GET")
+	api.HandleFunc("/links/{code}/revisions/{revision}/rollback", appHandlers.RollbackLink).Methods("POST")
+	api.HandleFunc("/workspaces", appHandlers.ListWorkspaces).Methods("GET")
+	api.HandleFunc("/workspaces", appHandlers.CreateWorkspace).Methods("POST")
+	api.HandleFunc("/workspaces/current", appHandlers.SwitchWorkspace).Methods("PUT")
+	api.HandleFunc("/workspaces/{workspaceID}/members", appHandlers.ListMembers).Methods("GET")
+	api.HandleFunc("/workspaces/{workspaceID}/members/{userID}", appHandlers.SetMemberRole).Methods("PUT")
+	api.HandleFunc("/workspaces/{workspaceID}/members/{userID}", appHandlers.RemoveMember).Methods("DELETE")
+	api.HandleFunc("/workspaces/{workspaceID}/invites", appHandlers.InviteMember).Methods("POST")
+	api.HandleFunc("/invites", appHandlers.ListInvites).Methods("GET")
+	api.HandleFunc("/invites/{inviteID}/accept", appHandlers.AcceptInvite).Methods("POST")
+	api.HandleFunc("/invites/{inviteID}", appHandlers.DeleteInvite).Methods("DELETE")
+	api.HandleFunc("/admin/audit", appHandlers.RequireRole(RoleAdmin, appHandlers.ListAuditEvents)).Methods("GET")
+	api.HandleFunc("/admin/audit/export", appHandlers.RequireRole(RoleAdmin, appHandlers.ExportAuditEvents)).Methods("GET")
+	api.HandleFunc("/admin/links", appHandlers.RequireRole(RoleModerator, appHandlers.AdminListLinks)).Methods("GET")
+	api.HandleFunc("/admin/links/{code}", appHandlers.RequireRole(RoleModerator, appHandlers.AdminDeleteLink)).Methods("DELETE")
+	api.HandleFunc("/admin/links/{code}/disable", appHandlers.RequireRole(RoleModerator, appHandlers.AdminDisableLink)).Methods("POST")
+	api.HandleFunc("/admin/links/{code}/enable", appHandlers.RequireRole(RoleModerator, appHandlers.AdminEnableLink)).Methods("POST")
+	api.HandleFunc("/admin/users", appHandlers.RequireRole(RoleAdmin, appHandlers.AdminListUsers)).Methods("GET")
+	api.HandleFunc("/admin/users/{userID}", appHandlers.RequireRole(RoleAdmin, appHandlers.AdminDeleteUser)).Methods("DELETE")
+	api.HandleFunc("/admin/users/{userID}/role", appHandlers.RequireRole(RoleAdmin, appHandlers.AdminSetUserRole)).Methods("PUT")
+	api.HandleFunc("/admin/users/{userID}/plan", appHandlers.RequireRole(RoleAdmin, appHandlers.AdminSetUserPlan)).Methods("PUT")
+	api.HandleFunc("/admin/users/{userID}/disable", appHandlers.RequireRole(RoleAdmin, appHandlers.AdminDisableUser)).Methods("POST")
+	api.HandleFunc("/admin/users/{userID}/enable", appHandlers.RequireRole(RoleAdmin, appHandlers.AdminEnableUser)).Methods("POST")
+	api.HandleFunc("/admin/workspaces/{workspaceID}/plan", appHandlers.RequireRole(RoleAdmin, appHandlers.AdminSetWorkspacePlan)).Methods("PUT")
 	// Redirect route (catch-all for short codes)
 	r.PathPrefix("/").HandlerFunc(appHandlers.RedirectURL)
 
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TOTP parameters (RFC 6238 defaults understood by every authenticator app)
+const (
+	totpPeriod     = 30
+	totpDigits     = 6
+	totpSecretSize = 20
+	// totpSkew is how many periods either side of now are accepted for clock drift
+	totpSkew = 1
+)
+
+// Login challenges
+const (
+	mfaChallengePurpose = "mfa"
+	mfaChallengeTTL     = 5 * time.Minute
+)
+
+// recoveryCodeCount is how many one-time recovery codes are issued at a time
+const recoveryCodeCount = 10
+
+// RoleWorkspaceOwner can be listed in MFA_REQUIRED_ROLES to require 2FA from
+// anyone who owns a workspace, whatever their user role
+const RoleWorkspaceOwner = "workspace_owner"
+
+// ErrMFAEnrollmentRequired is returned when a user's role requires 2FA they haven't set up
+var ErrMFAEnrollmentRequired = errors.New("two-factor authentication must be enabled")
+
+// totpEncoding is the unpadded base32 used for TOTP secrets
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// EnrollTOTPResponse is returned when starting TOTP enrollment
+type EnrollTOTPResponse struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+}
+
+// MFACodeRequest carries a TOTP code or recovery code
+type MFACodeRequest struct {
+	Code string `json:"code"`
+}
+
+// MFAChallenge is the problem a login answers with when the password was
+// right but a second factor is needed. ChallengeToken is sent to
+// /api/login/mfa with the code.
+type MFAChallenge struct {
+	ErrorResponse
+	UserID         string `json:"user_id"`
+	ChallengeToken string `json:"challenge_token"`
+}
+
+// MFALoginRequest completes a login that returned an MFA challenge
+type MFALoginRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+}
+
+// DisableTOTPRequest confirms turning 2FA off with the account password
+type DisableTOTPRequest struct {
+	Password string `json:"password"`
+	// Code is a TOTP or recovery code, asked of users who sign in only through SSO
+	Code string `json:"code"`
+}
+
+// RecoveryCodesResponse lists freshly issued recovery codes, shown only once
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// totpCode returns the code for secret at the given time step
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// matchTOTP returns the time step code is valid for, allowing for clock skew
+func matchTOTP(encodedSecret, code string, now time.Time) (int64, bool) {
+	secret, err := totpEncoding.DecodeString(encodedSecret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if hmac.Equal([]byte(totpCode(secret, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// otpauthURI builds the URI authenticator apps read from a QR code
+func otpauthURI(issuer, account, secret string) string {
+	label := url.PathEscape(issuer + ":" + account)
+	params := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// normalizeRecoveryCode drops separators and case so codes can be typed loosely
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// hashRecoveryCode returns the form of a recovery code stored in the database
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// newRecoveryCodes generates recovery codes formatted as xxxxx-xxxxx
+func newRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 7)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(raw))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes, nil
+}
+
+// ValidateMFARoles checks MFA_REQUIRED_ROLES names only user roles and RoleWorkspaceOwner
+func ValidateMFARoles(roles map[string]bool) error {
+	for role := range roles {
+		if role == RoleWorkspaceOwner {
+			continue
+		}
+		if err := ValidateRole(role); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mfaRequired reports whether user's role requires 2FA they haven't enabled yet
+func (h *Handlers) mfaRequired(ctx context.Context, user *User) (bool, error) {
+	if user.TOTPEnabledAt != nil || len(h.mfaRoles) == 0 {
+		return false, nil
+	}
+	if h.mfaRoles[user.Role] {
+		return true, nil
+	}
+	if h.mfaRoles[RoleWorkspaceOwner] {
+		return h.db.OwnsWorkspace(ctx, user.ID)
+	}
+	return false, nil
+}
+
+// verifySecondFactor checks a TOTP code, spending its time step so it can't be
+// replayed, or else a recovery code, spending it
+func (h *Handlers) verifySecondFactor(ctx context.Context, user *User, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if user.TOTPSecret != nil {
+		if step, ok := matchTOTP(*user.TOTPSecret, code, time.Now()); ok {
+			return h.db.UseTOTPStep(ctx, user.ID, step)
+		}
+	}
+	if user.TOTPEnabledAt == nil {
+		return false, nil
+	}
+	return h.db.UseRecoveryCode(ctx, user.ID, hashRecoveryCode(code))
+}
+
+// requireEnrollingUser is requireUser for the endpoints a user needs to set up
+// 2FA, which stay open when their role requires it but it isn't enabled yet
+func (h *Handlers) requireEnrollingUser(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	user, _, err := h.authenticateSession(r)
+	if err != nil {
+		writeAuthError(w, r, err)
+		return nil, false
+	}
+	if user == nil {
+		writeError(w, r, http.StatusUnauthorized, ProblemAuthRequired, "Authentication required")
+		return nil, false
+	}
+	return user, true
+}
+
+// EnrollTOTP handles POST /api/mfa/totp/enroll. It generates a new secret that
+// takes effect once confirmed with EnableTOTP.
+func (h *Handlers) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("EnrollTOTP called")
+	user, ok := h.requireEnrollingUser(w, r)
+	if !ok {
+		return
+	}
+	if user.TOTPEnabledAt != nil {
+		writeError(w, r, http.StatusConflict, ProblemConflict, "Two-factor authentication is already enabled")
+		return
+	}
+
+	raw := make([]byte, totpSecretSize)
+	if _, err := rand.Read(raw); err != nil {
+		fmt.Println("Error generating TOTP secret:", err)
+		writeError(w, r, http.StatusInternalServerError, ProblemInternal, "Internal server error")
+		return
+	}
+	secret := totpEncoding.EncodeToString(raw)
+	if err := h.db.SetPendingTOTPSecret(r.Context(), user.ID, secret); err != nil {
+		fmt.Println("Database error storing TOTP secret:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	writeJSON(w, http.StatusOK, EnrollTOTPResponse{Secret: secret, OTPAuthURI: otpauthURI(h.mfaIssuer, user.UserID, secret)})
+}
+
+// EnableTOTP handles POST /api/mfa/totp/enable, confirming enrollment with a
+// code from the authenticator and returning the first recovery codes
+func (h *Handlers) EnableTOTP(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("EnableTOTP called")
+	user, ok := h.requireEnrollingUser(w, r)
+	if !ok {
+		return
+	}
+	if user.TOTPEnabledAt != nil {
+		writeError(w, r, http.StatusConflict, ProblemConflict, "Two-factor authentication is already enabled")
+		return
+	}
+	if user.TOTPSecret == nil {
+		writeError(w, r, http.StatusConflict, ProblemConflict, "Start enrollment first")
+		return
+	}
+
+	var req MFACodeRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if !h.mfaLimiter.Allow(user.UserID) {
+		writeError(w, r, http.StatusTooManyRequests, ProblemRateLimited, "Too many attempts, try again later")
+		return
+	}
+	valid, err := h.verifySecondFactor(r.Context(), user, req.Code)
+	if err != nil {
+		fmt.Println("Database error verifying TOTP code:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	if !valid {
+		writeError(w, r, http.StatusBadRequest, ProblemInvalidCode, "Invalid code")
+		return
+	}
+
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		fmt.Println("Error generating recovery codes:", err)
+		writeError(w, r, http.StatusInternalServerError, ProblemInternal, "Internal server error")
+		return
+	}
+	if err := h.db.EnableTOTP(r.Context(), user.ID, recoveryCodeHashes(codes)); err != nil {
+		fmt.Println("Database error enabling TOTP:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	h.mfaLimiter.Reset(user.UserID)
+	h.audit(r, user, AuditMFAEnable, "user", user.UserID, nil, nil)
+	writeJSON(w, http.StatusOK, RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// DisableTOTP handles DELETE /api/mfa/totp. Users whose role requires 2FA can't
+// turn it off. Users without a password confirm with a second factor instead.
+func (h *Handlers) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("DisableTOTP called")
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+	if user.TOTPEnabledAt == nil {
+		writeError(w, r, http.StatusConflict, ProblemConflict, "Two-factor authentication is not enabled")
+		return
+	}
+
+	var req DisableTOTPRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	disabled := *user
+	disabled.TOTPEnabledAt = nil
+	required, err := h.mfaRequired(r.Context(), &disabled)
+	if err != nil {
+		fmt.Println("Database error checking MFA requirement:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	if required {
+		writeError(w, r, http.StatusConflict, ProblemConflict, "Two-factor authentication is required for your account")
+		return
+	}
+
+	if user.Password == unusablePassword {
+		if !h.mfaLimiter.Allow(user.UserID) {
+			writeError(w, r, http.StatusTooManyRequests, ProblemRateLimited, "Too many attempts, try again later")
+			return
+		}
+		ok, err := h.verifySecondFactor(r.Context(), user, req.Code)
+		if err != nil {
+			fmt.Println("Database error verifying second factor:", err)
+			writeServerError(w, r, err, "Database error")
+			return
+		}
+		if !ok {
+			writeError(w, r, http.StatusBadRequest, ProblemInvalidCode, "Invalid code")
+			return
+		}
+		h.mfaLimiter.Reset(user.UserID)
+	} else if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)) != nil {
+		writeError(w, r, http.StatusForbidden, ProblemInvalidCredentials, "Password is incorrect")
+		return
+	}
+
+	if err := h.db.DisableTOTP(r.Context(), user.ID); err != nil {
+		fmt.Println("Database error disabling TOTP:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	h.audit(r, user, AuditMFADisable, "user", user.UserID, nil, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RegenerateRecoveryCodes handles POST /api/mfa/recovery-codes, replacing all
+// recovery codes after checking a current TOTP code
+func (h *Handlers) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("RegenerateRecoveryCodes called")
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+	if user.TOTPEnabledAt == nil {
+		writeError(w, r, http.StatusConflict, ProblemConflict, "Two-factor authentication is not enabled")
+		return
+	}
+
+	var req MFACodeRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if !h.mfaLimiter.Allow(user.UserID) {
+		writeError(w, r, http.StatusTooManyRequests, ProblemRateLimited, "Too many attempts, try again later")
+		return
+	}
+	step, ok := matchTOTP(*user.TOTPSecret, strings.TrimSpace(req.Code), time.Now())
+	if ok {
+		var err error
+		if ok, err = h.db.UseTOTPStep(r.Context(), user.ID, step); err != nil {
+			fmt.Println("Database error verifying TOTP code:", err)
+			writeServerError(w, r, err, "Database error")
+			return
+		}
+	}
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, ProblemInvalidCode, "Invalid code")
+		return
+	}
+
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		fmt.Println("Error generating recovery codes:", err)
+		writeError(w, r, http.StatusInternalServerError, ProblemInternal, "Internal server error")
+		return
+	}
+	if err := h.db.ReplaceRecoveryCodes(r.Context(), user.ID, recoveryCodeHashes(codes)); err != nil {
+		fmt.Println("Database error replacing recovery codes:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	h.mfaLimiter.Reset(user.UserID)
+	h.audit(r, user, AuditMFARecoveryCodes, "user", user.UserID, nil, nil)
+	writeJSON(w, http.StatusOK, RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// LoginMFA handles POST /api/login/mfa, the second step of a login that
+// returned a challenge token. It accepts a TOTP code or a recovery code.
+func (h *Handlers) LoginMFA(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("LoginMFA called")
+	var req MFALoginRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	userID, err := h.tokens.Verify(mfaChallengePurpose, req.ChallengeToken)
+	if err != nil {
+		writeError(w, r, http.StatusUnauthorized, ProblemInvalidToken, "Login challenge is invalid or has expired")
+		return
+	}
+	user, err := h.db.GetUserByUserID(r.Context(), userID)
+	if err == sql.ErrNoRows || (err == nil && (user.DisabledAt != nil || user.TOTPEnabledAt == nil)) {
+		writeError(w, r, http.StatusUnauthorized, ProblemInvalidToken, "Login challenge is invalid or has expired")
+		return
+	}
+	if err != nil {
+		fmt.Println("Database error during login:", err)
+		writeServerError(w, r, err, "Internal server error")
+		return
+	}
+	if !h.mfaLimiter.Allow(user.UserID) {
+		writeError(w, r, http.StatusTooManyRequests, ProblemRateLimited, "Too many attempts, try again later")
+		return
+	}
+
+	valid, err := h.verifySecondFactor(r.Context(), user, req.Code)
+	if err != nil {
+		fmt.Println("Database error verifying second factor:", err)
+		writeServerError(w, r, err, "Internal server error")
+		return
+	}
+	if !valid {
+		h.audit(r, user, AuditLoginFailed, "user", user.UserID, nil, nil)
+		writeError(w, r, http.StatusUnauthorized, ProblemInvalidCode, "Invalid code")
+		return
+	}
+	h.mfaLimiter.Reset(user.UserID)
+
+	token, err := h.startSession(r, user)
+	if err != nil {
+		fmt.Println("Error starting session:", err)
+		writeServerError(w, r, err, "Internal server error")
+		return
+	}
+	h.audit(r, user, AuditLogin, "user", user.UserID, nil, nil)
+	writeJSON(w, http.StatusOK, AuthResponse{Success: true, Message: "Login successful", Token: token, UserID: user.UserID})
+}
+
+// recoveryCodeHashes hashes codes for storage
+func recoveryCodeHashes(codes []string) []string {
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = hashRecoveryCode(code)
+	}
+	return hashes
+}
+
+// CreateRecoveryCodeTable creates the mfa_recovery_codes table if it doesn't exist
+func (db *Database) CreateRecoveryCodeTable(ctx context.Context) error {
+	fmt.Println("CreateRecoveryCodeTable called")
+	query := `
+		CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			code_hash CHAR(64) NOT NULL,
+			used_at TIMESTAMPTZ,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			UNIQUE (user_id, code_hash)
+		);
+	`
+
+	_, err := db.conn.ExecContext(ctx, query)
+	return err
+}
+
+// SetPendingTOTPSecret stores a secret that isn't enforced until EnableTOTP
+func (db *Database) SetPendingTOTPSecret(ctx context.Context, userID int, secret string) error {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	_, err := db.conn.ExecContext(ctx, `
+		UPDATE users SET totp_secret = $2, totp_last_step = NULL, updated_at = NOW()
+		WHERE id = $1 AND totp_enabled_at IS NULL`, userID, secret)
+	return err
+}
+
+// EnableTOTP turns on 2FA for a user and stores their recovery code hashes
+func (db *Database) EnableTOTP(ctx context.Context, userID int, codeHashes []string) error {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `UPDATE users SET totp_enabled_at = NOW(), updated_at = NOW() WHERE id = $1`, userID); err != nil {
+		return err
+	}
+	if err := replaceRecoveryCodes(ctx, tx, userID, codeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DisableTOTP turns off 2FA for a user and removes their secret and recovery codes
+func (db *Database) DisableTOTP(ctx context.Context, userID int) error {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE users SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = NULL, updated_at = NOW()
+		WHERE id = $1`, userID); err != nil {
+		return err
+	}
+	if err := replaceRecoveryCodes(ctx, tx, userID, nil); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ReplaceRecoveryCodes swaps a user's recovery codes for new ones
+func (db *Database) ReplaceRecoveryCodes(ctx context.Context, userID int, codeHashes []string) error {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := replaceRecoveryCodes(ctx, tx, userID, codeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID int, codeHashes []string) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	for _, hash := range codeHashes {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES ($1, $2)`, userID, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UseTOTPStep records that a TOTP time step was used, reporting false if it
+// or a later one already was so each code works only once
+func (db *Database) UseTOTPStep(ctx context.Context, userID int, step int64) (bool, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	result, err := db.conn.ExecContext(ctx, `
+		UPDATE users SET totp_last_step = $2
+		WHERE id = $1 AND (totp_last_step IS NULL OR totp_last_step < $2)`, userID, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// UseRecoveryCode spends a recovery code, reporting false if it is unknown or already used
+func (db *Database) UseRecoveryCode(ctx context.Context, userID int, codeHash string) (bool, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	result, err := db.conn.ExecContext(ctx, `
+		UPDATE mfa_recovery_codes SET used_at = NOW()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`, userID, codeHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// OwnsWorkspace reports whether a user is an owner of any workspace
+func (db *Database) OwnsWorkspace(ctx context.Context, userID int) (bool, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	var owns bool
+	err := db.conn.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM workspace_members WHERE user_id = $1 AND role = $2)`,
+		userID, WorkspaceOwner).Scan(&owns)
+	return owns, err
+}
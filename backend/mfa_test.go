@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 seed from RFC 6238 appendix B
+var rfc6238Secret = []byte("12345678901234567890")
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 lists 8-digit codes; a 6-digit code is their last six digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(rfc6238Secret, tt.unix/totpPeriod); got != tt.want {
+			t.Errorf("totpCode at %d = %q, want %q", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	secret := totpEncoding.EncodeToString(rfc6238Secret)
+	now := time.Unix(1111111109, 0)
+	step := now.Unix() / totpPeriod
+
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", secret, totpCode(rfc6238Secret, step), step, true},
+		{"previous step", secret, totpCode(rfc6238Secret, step-1), step - 1, true},
+		{"next step", secret, totpCode(rfc6238Secret, step+1), step + 1, true},
+		{"outside skew", secret, totpCode(rfc6238Secret, step+2), 0, false},
+		{"wrong length", secret, "12345", 0, false},
+		{"bad secret", "not base32!", totpCode(rfc6238Secret, step), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotStep, gotOK := matchTOTP(tt.secret, tt.code, now)
+			if gotStep != tt.wantStep || gotOK != tt.wantOK {
+				t.Errorf("matchTOTP = (%d, %v), want (%d, %v)", gotStep, gotOK, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
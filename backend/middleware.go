@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// recoverPanics turns a panic in a handler into a 500, as a problem for /api
+// requests, instead of dropping the connection, and logs the stack
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			// The server aborts the response itself for this one
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			log.Printf("Panic serving %s %s (request %s): %v\n%s", r.Method, r.URL.Path, requestID(r), v, debug.Stack())
+			if isAPIRequest(r) {
+				writeError(w, r, http.StatusInternalServerError, ProblemInternal, "Internal server error")
+				return
+			}
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitBody stops reading request bodies after maxBytes, so a client can't make
+// a handler buffer an unbounded upload
+func limitBody(maxBytes int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withDeadlines gives each request a context deadline that database queries
+// made with its context obey. The timeout is picked by the path template of
+// the matched route, falling back to fallback; zero means no deadline.
+func withDeadlines(fallback time.Duration, routes map[string]time.Duration) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			timeout := fallback
+			if route := mux.CurrentRoute(r); route != nil {
+				if template, err := route.GetPathTemplate(); err == nil {
+					if t, ok := routes[template]; ok {
+						timeout = t
+					}
+				}
+			}
+			if timeout <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRecoverPanics(t *testing.T) {
+	tests := []struct {
+		name        string
+		path        string
+		wantProblem bool
+	}{
+		{"api", "/api/urls", true},
+		{"api root", "/api", true},
+		{"redirect", "/abc123", false},
+		{"api lookalike", "/apiary", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				panic("boom")
+			}))
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if rec.Code != http.StatusInternalServerError {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusInternalServerError)
+			}
+			isProblem := rec.Header().Get("Content-Type") == "application/problem+json"
+			if isProblem != tt.wantProblem {
+				t.Fatalf("problem response = %v, want %v", isProblem, tt.wantProblem)
+			}
+			if !isProblem {
+				return
+			}
+			var problem ErrorResponse
+			if err := json.NewDecoder(rec.Body).Decode(&problem); err != nil {
+				t.Fatalf("decoding problem: %v", err)
+			}
+			if problem.Code != ProblemInternal {
+				t.Errorf("code = %q, want %q", problem.Code, ProblemInternal)
+			}
+			if strings.Contains(problem.Detail, "boom") {
+				t.Errorf("detail %q leaks the panic value", problem.Detail)
+			}
+		})
+	}
+}
+
+func TestRecoverPanicsRepanicsAbortHandler(t *testing.T) {
+	handler := recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	defer func() {
+		if v := recover(); v != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler", v)
+		}
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/urls", nil))
+	t.Error("http.ErrAbortHandler was swallowed")
+}
+
+func TestLimitBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		wantRead int
+		wantErr  bool
+	}{
+		{"empty", 0, 0, false},
+		{"under the limit", 10, 10, false},
+		{"at the limit", 16, 16, false},
+		{"over the limit", 17, 16, true},
+		{"far over the limit", 1 << 20, 16, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var read int
+			var readErr error
+			handler := limitBody(16, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var body []byte
+				body, readErr = io.ReadAll(r.Body)
+				read = len(body)
+			}))
+			body := strings.NewReader(strings.Repeat("x", tt.size))
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/shorten", body))
+
+			if read != tt.wantRead {
+				t.Errorf("read %d bytes, want %d", read, tt.wantRead)
+			}
+			var tooLarge *http.MaxBytesError
+			if errors.As(readErr, &tooLarge) != tt.wantErr {
+				t.Errorf("read error = %v, want MaxBytesError %v", readErr, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWithDeadlines(t *testing.T) {
+	routes := map[string]time.Duration{
+		"/api/export": time.Minute,
+		"/api/health": 0,
+	}
+	tests := []struct {
+		name         string
+		path         string
+		fallback     time.Duration
+		wantDeadline time.Duration
+	}{
+		{"fallback", "/api/urls", 5 * time.Second, 5 * time.Second},
+		{"route override", "/api/export", 5 * time.Second, time.Minute},
+		{"route without deadline", "/api/health", 5 * time.Second, 0},
+		{"no fallback", "/api/urls", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var deadline time.Time
+			var hasDeadline bool
+			router := mux.NewRouter()
+			router.Use(withDeadlines(tt.fallback, routes))
+			record := func(w http.ResponseWriter, r *http.Request) {
+				deadline, hasDeadline = r.Context().Deadline()
+			}
+			for _, path := range []string{"/api/urls", "/api/export", "/api/health"} {
+				router.HandleFunc(path, record)
+			}
+			start := time.Now()
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if hasDeadline != (tt.wantDeadline > 0) {
+				t.Fatalf("has deadline = %v, want %v", hasDeadline, tt.wantDeadline > 0)
+			}
+			if hasDeadline {
+				if got := deadline.Sub(start); got < tt.wantDeadline || got > tt.wantDeadline+time.Second {
+					t.Errorf("deadline in %v, want %v", got, tt.wantDeadline)
+				}
+			}
+		})
+	}
+}
@@ -1,11 +1,21 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"log"
+	"sync/atomic"
 	"time"
 )
 
+// ErrClickLimitReached is returned by IncrementClickCount when a link has no clicks left
+var ErrClickLimitReached = errors.New("click limit reached")
+
+// ErrInsertConflict is returned by Create when the short code or dedup key is already in use
+var ErrInsertConflict = errors.New("short code or dedup key already in use")
+
 // ShortURL represents a shortened URL in the database
 type ShortURL struct {
 	ID          int        `json:"id" db:"id"`
@@ -14,12 +24,95 @@ type ShortURL struct {
 	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
 	ExpiresAt   *time.Time `json:"expires_at" db:"expires_at"`
 	ClickCount  int        `json:"click_count" db:"click_count"`
+	OwnerID     *int       `json:"owner_id,omitempty" db:"owner_id"`
+	DedupKey    *string    `json:"-" db:"dedup_key"`
+	// Interstitial links always show a warning page before redirecting
+	Interstitial bool `json:"interstitial" db:"interstitial"`
+	// PasswordHash is the bcrypt hash of the link's passphrase, if it has one
+	PasswordHash *string `json:"-" db:"password_hash"`
+	// MaxClicks is the number of redirects allowed before the link is used up
+	MaxClicks *int `json:"max_clicks,omitempty" db:"max_clicks"`
+	// ActivatesAt is when the link goes live; PrelaunchURL is served before then
+	ActivatesAt  *time.Time `json:"activates_at,omitempty" db:"activates_at"`
+	PrelaunchURL *string    `json:"prelaunch_url,omitempty" db:"prelaunch_url"`
+	// ExpiredURL is served instead of an error once the link has expired
+	ExpiredURL *string `json:"expired_url,omitempty" db:"expired_url"`
+	// Active is cleared by the janitor once the link has expired
+	Active bool `json:"active" db:"active"`
+	// DeletedAt is set while the link is in the trash
+	DeletedAt *time.Time `json:"deleted_at,omitempty" db:"deleted_at"`
+	// RedirectType is the HTTP status used to redirect; nil means 302
+	RedirectType *int `json:"redirect_type,omitempty" db:"redirect_type"`
+	// DisabledAt is set when a moderator takes the link down
+	DisabledAt *time.Time `json:"disabled_at,omitempty" db:"disabled_at"`
+	// WorkspaceID is the workspace that owns the link; nil for personal links
+	WorkspaceID *int `json:"workspace_id,omitempty" db:"workspace_id"`
+}
+
+// isPlain reports whether the link redirects unconditionally and forever
+func (s *ShortURL) isPlain() bool {
+	return !s.Interstitial && s.PasswordHash == nil && s.MaxClicks == nil &&
+		s.ActivatesAt == nil && s.PrelaunchURL == nil && s.ExpiredURL == nil && s.ExpiresAt == nil
+}
+
+// isLive reports whether the link redirects visitors at now: it is active, not
+// in the trash, not taken down and not expired
+func (s *ShortURL) isLive(now time.Time) bool {
+	return s.Active && s.DeletedAt == nil && s.DisabledAt == nil &&
+		(s.ExpiresAt == nil || s.ExpiresAt.After(now))
+}
+
+// shortURLColumns lists the short_urls columns in the order scanShortURL reads them
+const shortURLColumns = `id, short_code, original_url, created_at, expires_at, click_count, owner_id, dedup_key, interstitial, password_hash, max_clicks, activates_at, prelaunch_url, expired_url, active, deleted_at, redirect_type, disabled_at, workspace_id`
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanShortURL reads a row selected with shortURLColumns
+func scanShortURL(row rowScanner) (*ShortURL, error) {
+	shortURL := &ShortURL{}
+	err := row.Scan(
+		&shortURL.ID,
+		&shortURL.ShortCode,
+		&shortURL.OriginalURL,
+		&shortURL.CreatedAt,
+		&shortURL.ExpiresAt,
+		&shortURL.ClickCount,
+		&shortURL.OwnerID,
+		&shortURL.DedupKey,
+		&shortURL.Interstitial,
+		&shortURL.PasswordHash,
+		&shortURL.MaxClicks,
+		&shortURL.ActivatesAt,
+		&shortURL.PrelaunchURL,
+		&shortURL.ExpiredURL,
+		&shortURL.Active,
+		&shortURL.DeletedAt,
+		&shortURL.RedirectType,
+		&shortURL.DisabledAt,
+		&shortURL.WorkspaceID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return shortURL, nil
 }
 
 // ShortenRequest represents the request body for shortening a URL
 type ShortenRequest struct {
 	URL           string `json:"url"`
 	ExpiresInDays *int   `json:"expires_in_days,omitempty"`
+	Interstitial  bool   `json:"interstitial,omitempty"`
+	Password      string `json:"password,omitempty"`
+	MaxClicks     *int   `json:"max_clicks,omitempty"`
+	// ActivatesAt and ExpiresAt are absolute RFC 3339 times
+	ActivatesAt  *time.Time `json:"activates_at,omitempty"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	PrelaunchURL string     `json:"prelaunch_url,omitempty"`
+	ExpiredURL   string     `json:"expired_url,omitempty"`
+	RedirectType *int       `json:"redirect_type,omitempty"`
 }
 
 // ShortenResponse represents the response for a shortened URL
@@ -28,112 +121,198 @@ type ShortenResponse struct {
 	OriginalURL string     `json:"original_url"`
 	CreatedAt   time.Time  `json:"created_at"`
 	ExpiresAt   *time.Time `json:"expires_at"`
+	ActivatesAt *time.Time `json:"activates_at,omitempty"`
+	// Existing is true when an earlier short URL for the same destination was returned
+	Existing bool `json:"existing"`
 }
 
-// ErrorResponse represents an error response
+// ErrorResponse is the body of every failed /api request, an RFC 7807
+// problem details object extended with a stable machine-readable code
 type ErrorResponse struct {
-	Error string `json:"error"`
+	// Type identifies the kind of problem; it is derived from Code
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	// Detail is a human-readable explanation of this occurrence
+	Detail string `json:"detail,omitempty"`
+	// Instance is the path of the request that failed
+	Instance  string       `json:"instance,omitempty"`
+	Code      string       `json:"code"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
 }
 
 // Database represents the database connection
 type Database struct {
 	conn *sql.DB
+	// queryTimeout bounds each query on top of the caller's own deadline
+	queryTimeout time.Duration
+
+	// Read replicas for reads that tolerate lag, used in turn
+	replicas      []*replica
+	maxReplicaLag time.Duration
+	nextReplica   atomic.Uint64
 }
 
-// NewDatabase creates a new database connection
-func NewDatabase(conn *sql.DB) *Database {
-	return &Database{conn: conn}
+// NewDatabase creates a new database connection whose queries give up after
+// queryTimeout, or only when their context ends if it is zero
+func NewDatabase(conn *sql.DB, queryTimeout time.Duration) *Database {
+	return &Database{conn: conn, queryTimeout: queryTimeout}
 }
 
-// GetByShortCode retrieves a short URL by its short code
-func (db *Database) GetByShortCode(shortCode string) (*ShortURL, error) {
-	fmt.Println("GetByShortCode called with shortCode:", shortCode)
-	query := `SELECT id, short_code, original_url, created_at, expires_at, click_count FROM short_urls WHERE short_code = $1`
-	shortURL := &ShortURL{}
-	err := db.conn.QueryRow(query, shortCode).Scan(
-		&shortURL.ID,
-		&shortURL.ShortCode,
-		&shortURL.OriginalURL,
-		&shortURL.CreatedAt,
-		&shortURL.ExpiresAt,
-		&shortURL.ClickCount,
-	)
-	if err != nil {
-		return nil, err
+// queryContext derives the context for one query from ctx, applying the
+// default query timeout
+func (db *Database) queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if db.queryTimeout <= 0 {
+		return context.WithCancel(ctx)
 	}
-	return shortURL, nil
+	return context.WithTimeout(ctx, db.queryTimeout)
+}
+
+// GetByShortCode retrieves a short URL by its short code, from a read replica
+// if there is a healthy one, so it can be up to the allowed replica lag old
+func (db *Database) GetByShortCode(ctx context.Context, shortCode string) (*ShortURL, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	fmt.Println("GetByShortCode called with shortCode:", shortCode)
+	query := `SELECT ` + shortURLColumns + ` FROM short_urls WHERE short_code = $1`
+	var shortURL *ShortURL
+	err := db.readReplica(ctx, func(conn *sql.DB) error {
+		var err error
+		shortURL, err = scanShortURL(conn.QueryRowContext(ctx, query, shortCode))
+		return err
+	})
+	return shortURL, err
+}
+
+// GetByShortCodePrimary is GetByShortCode reading from the primary, for
+// lookups that a change is based on
+func (db *Database) GetByShortCodePrimary(ctx context.Context, shortCode string) (*ShortURL, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	query := `SELECT ` + shortURLColumns + ` FROM short_urls WHERE short_code = $1`
+	return scanShortURL(db.conn.QueryRowContext(ctx, query, shortCode))
 }
 
-// Create inserts a new short URL and returns its ID
-func (db *Database) Create(shortURL *ShortURL) (int64, error) {
+// Create inserts a new short URL and returns its ID.
+// It returns ErrInsertConflict if the short code or dedup key is already in use,
+// or if the short code is reserved.
+func (db *Database) Create(ctx context.Context, shortURL *ShortURL) (int64, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
 	query := `
-		INSERT INTO short_urls (short_code, original_url, created_at, expires_at, click_count)
-		VALUES ($1, $2, $3, $4, $5)
+		INSERT INTO short_urls (short_code, original_url, created_at, expires_at, click_count, owner_id, dedup_key, interstitial, password_hash, max_clicks, activates_at, prelaunch_url, expired_url, redirect_type, workspace_id)
+		SELECT $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15
+		WHERE NOT EXISTS (SELECT 1 FROM reserved_codes WHERE short_code = $1)
+		ON CONFLICT DO NOTHING
 		RETURNING id`
 
 	var id int64
-	err := db.conn.QueryRow(query, shortURL.ShortCode, shortURL.OriginalURL, shortURL.CreatedAt, shortURL.ExpiresAt, shortURL.ClickCount).Scan(&id)
+	err := db.conn.QueryRowContext(ctx, query, shortURL.ShortCode, shortURL.OriginalURL, shortURL.CreatedAt, shortURL.ExpiresAt, shortURL.ClickCount, shortURL.OwnerID, shortURL.DedupKey, shortURL.Interstitial, shortURL.PasswordHash, shortURL.MaxClicks, shortURL.ActivatesAt, shortURL.PrelaunchURL, shortURL.ExpiredURL, shortURL.RedirectType, shortURL.WorkspaceID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, ErrInsertConflict
+	}
 	return id, err
 }
 
+// CountCodesOfLength counts the short codes with the given length, reading
+// from a replica if there is a healthy one
+func (db *Database) CountCodesOfLength(ctx context.Context, length int) (int64, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	var count int64
+	err := db.readReplica(ctx, func(conn *sql.DB) error {
+		return conn.QueryRowContext(ctx, `SELECT COUNT(*) FROM short_urls WHERE LENGTH(short_code) = $1`, length).Scan(&count)
+	})
+	return count, err
+}
+
 // GetByID retrieves a short URL by its ID
-func (db *Database) GetByID(id int) (*ShortURL, error) {
-	query := `SELECT id, short_code, original_url, created_at, expires_at, click_count FROM short_urls WHERE id = $1`
+func (db *Database) GetByID(ctx context.Context, id int) (*ShortURL, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
 
-	shortURL := &ShortURL{}
-	err := db.conn.QueryRow(query, id).Scan(
-		&shortURL.ID,
-		&shortURL.ShortCode,
-		&shortURL.OriginalURL,
-		&shortURL.CreatedAt,
-		&shortURL.ExpiresAt,
-		&shortURL.ClickCount,
-	)
+	query := `SELECT ` + shortURLColumns + ` FROM short_urls WHERE id = $1`
+	return scanShortURL(db.conn.QueryRowContext(ctx, query, id))
+}
 
-	if err != nil {
-		return nil, err
-	}
+// GetByDedupKey retrieves the short URL holding a dedup key
+func (db *Database) GetByDedupKey(ctx context.Context, key string) (*ShortURL, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
 
-	return shortURL, nil
+	query := `SELECT ` + shortURLColumns + ` FROM short_urls WHERE dedup_key = $1`
+	return scanShortURL(db.conn.QueryRowContext(ctx, query, key))
 }
 
-// GetByOriginalURL retrieves a short URL by its original URL
-func (db *Database) GetByOriginalURL(originalURL string) (*ShortURL, error) {
-	query := `SELECT id, short_code, original_url, created_at, expires_at, click_count FROM short_urls WHERE original_url = $1`
+// ReleaseDedupKey clears the dedup key of the link with id if it still holds key
+func (db *Database) ReleaseDedupKey(ctx context.Context, id int, key string) error {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
 
-	shortURL := &ShortURL{}
-	err := db.conn.QueryRow(query, originalURL).Scan(
-		&shortURL.ID,
-		&shortURL.ShortCode,
-		&shortURL.OriginalURL,
-		&shortURL.CreatedAt,
-		&shortURL.ExpiresAt,
-		&shortURL.ClickCount,
-	)
+	_, err := db.conn.ExecContext(ctx, `UPDATE short_urls SET dedup_key = NULL WHERE id = $1 AND dedup_key = $2`, id, key)
+	return err
+}
 
-	if err != nil {
-		return nil, err
-	}
+// GetByOriginalURL retrieves a short URL by its original URL
+func (db *Database) GetByOriginalURL(ctx context.Context, originalURL string) (*ShortURL, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
 
-	return shortURL, nil
+	query := `SELECT ` + shortURLColumns + ` FROM short_urls WHERE original_url = $1`
+	return scanShortURL(db.conn.QueryRowContext(ctx, query, originalURL))
 }
 
 // UpdateShortCode updates the short code for a given ID
-func (db *Database) UpdateShortCode(id int, shortCode string) error {
+func (db *Database) UpdateShortCode(ctx context.Context, id int, shortCode string) error {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
 	query := `UPDATE short_urls SET short_code = $1 WHERE id = $2`
-	_, err := db.conn.Exec(query, shortCode, id)
+	_, err := db.conn.ExecContext(ctx, query, shortCode, id)
 	return err
 }
 
-// IncrementClickCount increments the click count for a given ID
-func (db *Database) IncrementClickCount(id int) error {
-	query := `UPDATE short_urls SET click_count = click_count + 1 WHERE id = $1`
-	_, err := db.conn.Exec(query, id)
-	return err
+// NextSequence returns the next value of the short code sequence
+func (db *Database) NextSequence(ctx context.Context) (int64, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	var seq int64
+	err := db.conn.QueryRowContext(ctx, `SELECT nextval('short_code_seq')`).Scan(&seq)
+	return seq, err
+}
+
+// IncrementClickCount increments the click count for a given ID.
+// The limit check and increment happen in one statement so racing clicks
+// can't both take the last use; ErrClickLimitReached means none was left.
+func (db *Database) IncrementClickCount(ctx context.Context, id int) error {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	query := `
+		UPDATE short_urls SET click_count = click_count + 1
+		WHERE id = $1 AND (max_clicks IS NULL OR click_count < max_clicks)`
+	result, err := db.conn.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrClickLimitReached
+	}
+	return nil
 }
 
 // CreateTable creates the short_urls table if it doesn't exist
-func (db *Database) CreateTable() error {
+func (db *Database) CreateTable(ctx context.Context) error {
 	fmt.Println("CreateTable called")
 	query := `
 		CREATE TABLE IF NOT EXISTS short_urls (
@@ -147,23 +326,103 @@ func (db *Database) CreateTable() error {
 		
 		CREATE INDEX IF NOT EXISTS idx_short_code ON short_urls(short_code);
 		CREATE INDEX IF NOT EXISTS idx_original_url ON short_urls(original_url);
+
+		DO $$
+		BEGIN
+			IF EXISTS (SELECT 1 FROM information_schema.columns
+				WHERE table_schema = current_schema() AND table_name = 'short_urls'
+					AND column_name = 'short_code' AND character_maximum_length < 32) THEN
+				ALTER TABLE short_urls ALTER COLUMN short_code TYPE VARCHAR(32);
+			END IF;
+		END;
+		$$;
+		CREATE SEQUENCE IF NOT EXISTS short_code_seq START WITH 1;
+
+		ALTER TABLE short_urls ADD COLUMN IF NOT EXISTS owner_id INTEGER;
+		ALTER TABLE short_urls ADD COLUMN IF NOT EXISTS dedup_key TEXT;
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_dedup_key ON short_urls(dedup_key);
+		CREATE INDEX IF NOT EXISTS idx_owner_id ON short_urls(owner_id);
+
+		ALTER TABLE short_urls ADD COLUMN IF NOT EXISTS interstitial BOOLEAN NOT NULL DEFAULT FALSE;
+		ALTER TABLE short_urls ADD COLUMN IF NOT EXISTS password_hash VARCHAR(255);
+		ALTER TABLE short_urls ADD COLUMN IF NOT EXISTS max_clicks INTEGER;
+
+		DO $$
+		BEGIN
+			IF EXISTS (SELECT 1 FROM information_schema.columns
+				WHERE table_schema = current_schema() AND table_name = 'short_urls'
+					AND column_name = 'expires_at' AND data_type = 'timestamp without time zone') THEN
+				ALTER TABLE short_urls ALTER COLUMN expires_at TYPE TIMESTAMPTZ USING expires_at AT TIME ZONE 'UTC';
+			END IF;
+		END;
+		$$;
+		ALTER TABLE short_urls ADD COLUMN IF NOT EXISTS activates_at TIMESTAMPTZ;
+		ALTER TABLE short_urls ADD COLUMN IF NOT EXISTS prelaunch_url TEXT;
+		ALTER TABLE short_urls ADD COLUMN IF NOT EXISTS expired_url TEXT;
+
+		ALTER TABLE short_urls ADD COLUMN IF NOT EXISTS active BOOLEAN NOT NULL DEFAULT TRUE;
+		ALTER TABLE short_urls ADD COLUMN IF NOT EXISTS deactivated_at TIMESTAMPTZ;
+		CREATE INDEX IF NOT EXISTS idx_inactive ON short_urls(deactivated_at) WHERE NOT active;
+
+		ALTER TABLE short_urls ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+		CREATE INDEX IF NOT EXISTS idx_deleted_at ON short_urls(deleted_at) WHERE deleted_at IS NOT NULL;
+
+		ALTER TABLE short_urls ADD COLUMN IF NOT EXISTS redirect_type INTEGER;
+		ALTER TABLE short_urls ADD COLUMN IF NOT EXISTS disabled_at TIMESTAMPTZ;
+
+		ALTER TABLE short_urls ADD COLUMN IF NOT EXISTS workspace_id INTEGER;
+		CREATE INDEX IF NOT EXISTS idx_workspace_id ON short_urls(workspace_id);
 	`
 
-	_, err := db.conn.Exec(query)
+	_, err := db.conn.ExecContext(ctx, query)
 	return err
 }
 
 // User represents a user in the database
 type User struct {
-	ID        int       `json:"id" db:"id"`
-	UserID    string    `json:"user_id" db:"user_id"`
-	Password  string    `json:"-" db:"password"` // Don't include password in JSON responses
-	CreatedAt time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+	ID         int        `json:"id" db:"id"`
+	UserID     string     `json:"user_id" db:"user_id"`
+	Password   string     `json:"-" db:"password"` // Don't include password in JSON responses
+	Role       string     `json:"role" db:"role"`
+	DisabledAt *time.Time `json:"disabled_at,omitempty" db:"disabled_at"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at" db:"updated_at"`
+	// CurrentWorkspaceID is the workspace the user is working in; nil for personal links
+	CurrentWorkspaceID *int `json:"current_workspace_id,omitempty" db:"current_workspace_id"`
+	// TOTPSecret is set once enrollment starts; it is only enforced after TOTPEnabledAt
+	TOTPSecret    *string    `json:"-" db:"totp_secret"`
+	TOTPEnabledAt *time.Time `json:"totp_enabled_at,omitempty" db:"totp_enabled_at"`
+	// Plan picks the user's quota limits
+	Plan string `json:"plan" db:"plan"`
+}
+
+// userColumns lists the users columns in the order scanUser reads them
+const userColumns = `id, user_id, password, role, disabled_at, created_at, updated_at, current_workspace_id, totp_secret, totp_enabled_at, plan`
+
+// scanUser reads a row selected with userColumns
+func scanUser(row rowScanner) (*User, error) {
+	user := &User{}
+	err := row.Scan(
+		&user.ID,
+		&user.UserID,
+		&user.Password,
+		&user.Role,
+		&user.DisabledAt,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+		&user.CurrentWorkspaceID,
+		&user.TOTPSecret,
+		&user.TOTPEnabledAt,
+		&user.Plan,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
 }
 
 // CreateUserTable creates the users table if it doesn't exist
-func (db *Database) CreateUserTable() error {
+func (db *Database) CreateUserTable(ctx context.Context) error {
 	fmt.Println("CreateUserTable called")
 	query := `
 		CREATE TABLE IF NOT EXISTS users (
@@ -175,60 +434,71 @@ func (db *Database) CreateUserTable() error {
 		);
 		
 		CREATE INDEX IF NOT EXISTS idx_user_id ON users(user_id);
+
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR(20) NOT NULL DEFAULT 'user';
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled_at TIMESTAMPTZ;
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS current_workspace_id INTEGER;
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret VARCHAR(64);
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled_at TIMESTAMPTZ;
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT;
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS plan VARCHAR(32) NOT NULL DEFAULT 'free';
 	`
 
-	_, err := db.conn.Exec(query)
+	if _, err := db.conn.ExecContext(ctx, query); err != nil {
+		return err
+	}
+
+	// User IDs are unique ignoring case. Older databases may hold IDs that
+	// differ only by case; signup still rejects new clashes, but the index
+	// can only be unique once those are renamed.
+	_, err := db.conn.ExecContext(ctx, `CREATE UNIQUE INDEX IF NOT EXISTS idx_users_user_id_lower ON users (LOWER(user_id))`)
+	if err != nil {
+		log.Println("User IDs differing only by case exist, creating a non-unique index:", err)
+		_, err = db.conn.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS idx_users_user_id_lower_nonunique ON users (LOWER(user_id))`)
+	}
 	return err
 }
 
 // CreateUser inserts a new user and returns the user ID
-func (db *Database) CreateUser(userID, hashedPassword string) (*User, error) {
+func (db *Database) CreateUser(ctx context.Context, userID, hashedPassword string) (*User, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
 	query := `
 		INSERT INTO users (user_id, password, created_at, updated_at)
 		VALUES ($1, $2, NOW(), NOW())
-		RETURNING id, user_id, created_at, updated_at`
-
-	user := &User{}
-	err := db.conn.QueryRow(query, userID, hashedPassword).Scan(
-		&user.ID,
-		&user.UserID,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-	)
-
-	if err != nil {
-		return nil, err
-	}
-
-	return user, nil
+		RETURNING ` + userColumns
+	return scanUser(db.conn.QueryRowContext(ctx, query, userID, hashedPassword))
 }
 
-// GetUserByUserID retrieves a user by their user ID
-func (db *Database) GetUserByUserID(userID string) (*User, error) {
-	query := `SELECT id, user_id, password, created_at, updated_at FROM users WHERE user_id = $1`
+// GetUserByUserID retrieves a user by their user ID, ignoring case. An exact
+// match wins over IDs that only differ by case.
+func (db *Database) GetUserByUserID(ctx context.Context, userID string) (*User, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
 
-	user := &User{}
-	err := db.conn.QueryRow(query, userID).Scan(
-		&user.ID,
-		&user.UserID,
-		&user.Password,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-	)
+	query := `SELECT ` + userColumns + ` FROM users WHERE LOWER(user_id) = LOWER($1) ORDER BY user_id = $1 DESC LIMIT 1`
+	return scanUser(db.conn.QueryRowContext(ctx, query, userID))
+}
 
-	if err != nil {
-		return nil, err
-	}
+// GetUserByID retrieves a user by their numeric ID
+func (db *Database) GetUserByID(ctx context.Context, id int) (*User, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
 
-	return user, nil
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = $1`
+	return scanUser(db.conn.QueryRowContext(ctx, query, id))
 }
 
-// UserExists checks if a user with the given user ID already exists
-func (db *Database) UserExists(userID string) (bool, error) {
-	query := `SELECT COUNT(*) FROM users WHERE user_id = $1`
+// UserExists checks if a user with the given user ID already exists, ignoring case
+func (db *Database) UserExists(ctx context.Context, userID string) (bool, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	query := `SELECT COUNT(*) FROM users WHERE LOWER(user_id) = LOWER($1)`
 
 	var count int
-	err := db.conn.QueryRow(query, userID).Scan(&count)
+	err := db.conn.QueryRowContext(ctx, query, userID).Scan(&count)
 	if err != nil {
 		return false, err
 	}
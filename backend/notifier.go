@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Notifier backends
+const (
+	// NotifierLog writes notifications to the server log
+	NotifierLog = "log"
+	// NotifierFile appends notifications to a JSON Lines file
+	NotifierFile = "file"
+)
+
+// Notification is a message for a user, such as a password reset link
+type Notification struct {
+	To      string    `json:"to"`
+	Subject string    `json:"subject"`
+	Body    string    `json:"body"`
+	SentAt  time.Time `json:"sent_at"`
+}
+
+// Notifier delivers notifications to users. Implementations for email or
+// chat can be added alongside the development sinks below.
+type Notifier interface {
+	Notify(n *Notification) error
+}
+
+// NewNotifier creates the notifier named by kind. path is the output file for NotifierFile.
+func NewNotifier(kind, path string) (Notifier, error) {
+	switch kind {
+	case NotifierLog:
+		return LogNotifier{}, nil
+	case NotifierFile:
+		if path == "" {
+			return nil, fmt.Errorf("a file path is required for the %s notifier", NotifierFile)
+		}
+		return &FileNotifier{path: path}, nil
+	}
+	return nil, fmt.Errorf("unknown notifier %q", kind)
+}
+
+// LogNotifier prints notifications to the server log
+type LogNotifier struct{}
+
+// Notify logs n
+func (LogNotifier) Notify(n *Notification) error {
+	log.Printf("Notification for %s: %s\n%s", n.To, n.Subject, n.Body)
+	return nil
+}
+
+// FileNotifier appends each notification to a file as a JSON line
+type FileNotifier struct {
+	path string
+	mu   sync.Mutex
+}
+
+// Notify appends n to the file
+func (f *FileNotifier) Notify(n *Notification) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,1080 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// OIDC login flow
+const (
+	oidcFlowCookie  = "oidc_flow"
+	oidcFlowPurpose = "oidc_flow"
+	oidcFlowTTL     = 10 * time.Minute
+	oidcLinkPurpose = "oidc_link"
+	oidcLinkTTL     = 5 * time.Minute
+	// oidcLinkResultPurpose signs an IdP account waiting to be linked
+	oidcLinkResultPurpose = "oidc_link_result"
+	// oidcClockSkew is how far the IdP's clock may drift from ours
+	oidcClockSkew = time.Minute
+	// oidcKeyRefreshInterval limits JWKS refetches for unknown key IDs
+	oidcKeyRefreshInterval = time.Minute
+)
+
+// unusablePassword is stored for users provisioned through SSO. It never
+// matches a bcrypt comparison, so they can't log in with a password until
+// they set one through a password reset.
+const unusablePassword = "!"
+
+// ErrIdentityLinked is returned when an IdP account already belongs to another user
+var ErrIdentityLinked = errors.New("this SSO account is linked to another user")
+
+// OIDCConfig configures single sign-on with an OpenID Connect provider
+type OIDCConfig struct {
+	// Issuer is the IdP's issuer URL; SSO is disabled when it is empty
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is this server's /api/oidc/callback as registered with the IdP
+	RedirectURL string
+	Scopes      []string
+	// UserIDClaim names the ID token claim used as user_id for new users
+	UserIDClaim string
+	// RoleClaim names a string or list claim mapped to a role on every login;
+	// roles are left alone when it is empty
+	RoleClaim string
+	// RoleMap maps RoleClaim values to roles. Values it doesn't list are ignored.
+	RoleMap map[string]string
+	// RoleDowngrade lets a login lower the user's role to the mapped one;
+	// otherwise logins only ever raise it
+	RoleDowngrade bool
+	// AutoProvision creates a user on first login
+	AutoProvision bool
+	// LinkByUserID links a first login to the existing user whose user_id
+	// matches UserIDClaim. Only enable it if the IdP controls those names.
+	LinkByUserID bool
+	// FrontendURL receives the result of a login in its fragment
+	FrontendURL string
+}
+
+// Enabled reports whether SSO is configured
+func (c OIDCConfig) Enabled() bool {
+	return c.Issuer != ""
+}
+
+// Validate checks the configuration is usable
+func (c OIDCConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if c.ClientID == "" {
+		return errors.New("OIDC_CLIENT_ID is required")
+	}
+	for _, u := range []string{c.Issuer, c.RedirectURL, c.FrontendURL} {
+		if parsed, err := url.Parse(u); err != nil || parsed.Host == "" {
+			return fmt.Errorf("invalid URL %q", u)
+		}
+	}
+	if c.UserIDClaim == "" {
+		return errors.New("OIDC_USER_ID_CLAIM is required")
+	}
+	if c.RoleClaim != "" && len(c.RoleMap) == 0 {
+		return errors.New("OIDC_ROLE_MAP is required with OIDC_ROLE_CLAIM")
+	}
+	for value, role := range c.RoleMap {
+		if err := ValidateRole(role); err != nil {
+			return fmt.Errorf("OIDC_ROLE_MAP %s: %w", value, err)
+		}
+	}
+	return nil
+}
+
+// oidcMetadata is the part of the discovery document we use
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcTokenResponse is the token endpoint's answer to an authorization code
+type oidcTokenResponse struct {
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// jsonWebKey is one key of a JWKS document
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// OIDCProvider talks to the IdP, caching its discovery document and signing keys
+type OIDCProvider struct {
+	config OIDCConfig
+	client *http.Client
+
+	mu          sync.Mutex
+	metadata    *oidcMetadata
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+	// keysLoading is closed when the JWKS fetch in progress, if any, finishes
+	keysLoading chan struct{}
+}
+
+// NewOIDCProvider creates a provider, or returns nil when SSO is disabled.
+// Discovery happens on first use so the server starts even if the IdP is down.
+func NewOIDCProvider(config OIDCConfig) *OIDCProvider {
+	if !config.Enabled() {
+		return nil
+	}
+	return &OIDCProvider{config: config, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// getJSON fetches url into v
+func (p *OIDCProvider) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// discover returns the IdP's metadata, fetching it the first time. The fetch
+// happens outside the lock so a slow IdP doesn't hold up cached lookups.
+func (p *OIDCProvider) discover(ctx context.Context) (*oidcMetadata, error) {
+	p.mu.Lock()
+	cached := p.metadata
+	p.mu.Unlock()
+	if cached != nil {
+		return cached, nil
+	}
+
+	metadata := &oidcMetadata{}
+	if err := p.getJSON(ctx, strings.TrimSuffix(p.config.Issuer, "/")+"/.well-known/openid-configuration", metadata); err != nil {
+		return nil, fmt.Errorf("OIDC discovery: %w", err)
+	}
+	if metadata.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("OIDC discovery: issuer %q does not match %q", metadata.Issuer, p.config.Issuer)
+	}
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, errors.New("OIDC discovery: missing endpoints")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.metadata == nil {
+		p.metadata = metadata
+	}
+	return p.metadata, nil
+}
+
+// AuthorizationURL returns where to send the browser to log in
+func (p *OIDCProvider) AuthorizationURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {strings.Join(p.config.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(metadata.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return metadata.AuthorizationEndpoint + separator + params.Encode(), nil
+}
+
+// Exchange trades an authorization code for a raw ID token
+func (p *OIDCProvider) Exchange(ctx context.Context, code, verifier string) (string, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"client_id":     {p.config.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var token oidcTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("token endpoint: %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || token.Error != "" {
+		return "", fmt.Errorf("token endpoint: %s %s %s", resp.Status, token.Error, token.ErrorDescription)
+	}
+	if token.IDToken == "" {
+		return "", errors.New("token endpoint returned no id_token")
+	}
+	return token.IDToken, nil
+}
+
+// signingKey returns the IdP key with kid, refetching the JWKS when the key is
+// unknown so rotated keys are picked up. Only one fetch runs at a time, outside
+// the lock; other logins needing new keys wait for it.
+func (p *OIDCProvider) signingKey(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		p.mu.Lock()
+		if key := p.lookupKey(kid); key != nil {
+			p.mu.Unlock()
+			return key, nil
+		}
+		if loading := p.keysLoading; loading != nil {
+			p.mu.Unlock()
+			select {
+			case <-loading:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		if time.Since(p.keysFetched) < oidcKeyRefreshInterval {
+			p.mu.Unlock()
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		loading := make(chan struct{})
+		p.keysLoading = loading
+		p.keysFetched = time.Now()
+		p.mu.Unlock()
+
+		keys, err := p.fetchKeys(ctx, metadata.JWKSURI)
+
+		p.mu.Lock()
+		if err == nil {
+			p.keys = keys
+		}
+		p.keysLoading = nil
+		close(loading)
+		p.mu.Unlock()
+		if err != nil {
+			return nil, fmt.Errorf("fetching JWKS: %w", err)
+		}
+	}
+}
+
+// fetchKeys downloads the IdP's signing keys, keyed by key ID
+func (p *OIDCProvider) fetchKeys(ctx context.Context, jwksURI string) (map[string]crypto.PublicKey, error) {
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(ctx, jwksURI, &jwks); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			fmt.Println("Skipping JWKS key", jwk.Kid+":", err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+// lookupKey finds a cached key. Tokens without a kid are accepted when the IdP has a single key.
+func (p *OIDCProvider) lookupKey(kid string) crypto.PublicKey {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key
+		}
+	}
+	return p.keys[kid]
+}
+
+// publicKey decodes an RSA or EC key
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, errors.New("invalid key parameter")
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// VerifyIDToken checks an ID token's signature, issuer, audience, validity
+// period and nonce, and returns its claims
+func (p *OIDCProvider) VerifyIDToken(ctx context.Context, raw, nonce string) (map[string]any, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed ID token signature")
+	}
+	key, err := p.signingKey(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if claims["iss"] != p.config.Issuer {
+		return nil, errors.New("ID token issuer mismatch")
+	}
+	if !audienceContains(claims["aud"], p.config.ClientID) {
+		return nil, errors.New("ID token audience mismatch")
+	}
+	if azp, ok := claims["azp"].(string); ok && azp != p.config.ClientID {
+		return nil, errors.New("ID token authorized party mismatch")
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.Add(-oidcClockSkew).After(time.Unix(int64(exp), 0)) {
+		return nil, errors.New("ID token has expired")
+	}
+	iat, ok := claims["iat"].(float64)
+	if !ok || now.Add(oidcClockSkew).Before(time.Unix(int64(iat), 0)) {
+		return nil, errors.New("ID token is issued in the future")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(oidcClockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("ID token is not valid yet")
+	}
+	if claimNonce, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(claimNonce), []byte(nonce)) != 1 {
+		return nil, errors.New("ID token nonce mismatch")
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, errors.New("ID token has no subject")
+	}
+	return claims, nil
+}
+
+// decodeJWTPart decodes a base64url JSON segment of a JWT
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("malformed ID token")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("malformed ID token")
+	}
+	return nil
+}
+
+// verifyJWTSignature checks signature over signed with key for the RS* and ES* algorithms
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	hashes := map[string]crypto.Hash{
+		"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+		"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+	}
+	hash, ok := hashes[alg]
+	if !ok {
+		return fmt.Errorf("unsupported ID token algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			break
+		}
+		if rsa.VerifyPKCS1v15(key, hash, digest, signature) != nil {
+			return errors.New("invalid ID token signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(signature) != 2*size {
+			break
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("invalid ID token signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("ID token algorithm %q does not match its key", alg)
+}
+
+// audienceContains reports whether an aud claim, a string or list, includes clientID
+func audienceContains(aud any, clientID string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientID
+	case []any:
+		for _, a := range aud {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimStrings returns a string or list-of-strings claim as a slice
+func claimStrings(claims map[string]any, name string) []string {
+	switch value := claims[name].(type) {
+	case string:
+		return []string{value}
+	case []any:
+		values := []string{}
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// mapRole returns the most privileged role the RoleClaim values map to in
+// RoleMap, or RoleUser
+func (c OIDCConfig) mapRole(claims map[string]any) string {
+	role := RoleUser
+	for _, value := range claimStrings(claims, c.RoleClaim) {
+		if mapped, ok := c.RoleMap[value]; ok && roleRank[mapped] > roleRank[role] {
+			role = mapped
+		}
+	}
+	return role
+}
+
+// loginRole returns the role a user with current role has after logging in
+// with claims. Roles granted outside the IdP, e.g. with create-admin, are kept
+// unless RoleDowngrade is set.
+func (c OIDCConfig) loginRole(claims map[string]any, current string) string {
+	role := c.mapRole(claims)
+	if c.RoleDowngrade || roleRank[role] > roleRank[current] {
+		return role
+	}
+	return current
+}
+
+// oidcFlow is the state of a login in progress, kept in a signed cookie so
+// the callback can only be completed by the browser that started it
+type oidcFlow struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	// LinkSessionID is set when an existing user is linking their IdP account
+	LinkSessionID int `json:"link_session_id,omitempty"`
+}
+
+// oidcLinkResult is a verified IdP account that the session which asked to
+// link it still has to claim with CompleteOIDCLink
+type oidcLinkResult struct {
+	SessionID int            `json:"session_id"`
+	Claims    map[string]any `json:"claims"`
+}
+
+// Identity links a user to an account at the IdP
+type Identity struct {
+	ID          int        `json:"id"`
+	UserID      int        `json:"-"`
+	Issuer      string     `json:"issuer"`
+	Subject     string     `json:"subject"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastLoginAt *time.Time `json:"last_login_at,omitempty"`
+}
+
+// LinkSSOResponse tells the frontend where to send the browser to link an IdP account
+type LinkSSOResponse struct {
+	LoginURL string `json:"login_url"`
+}
+
+// CompleteSSOLinkRequest represents the request body for finishing a link
+type CompleteSSOLinkRequest struct {
+	LinkResult string `json:"link_result"`
+}
+
+// randomToken returns n random bytes encoded as base64url
+func randomToken(n int) (string, error) {
+	raw := make([]byte, n)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// OIDCLogin handles GET /api/oidc/login, redirecting the browser to the IdP.
+// With a link_token from OIDCLink the IdP account is only handed back to be
+// claimed by the session that asked for the token.
+func (h *Handlers) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("OIDCLogin called")
+	if h.oidc == nil {
+		writeError(w, r, http.StatusNotFound, ProblemSSODisabled, "SSO is not configured")
+		return
+	}
+
+	flow := oidcFlow{}
+	if linkToken := r.URL.Query().Get("link_token"); linkToken != "" {
+		subject, err := h.tokens.Verify(oidcLinkPurpose, linkToken)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, ProblemInvalidToken, "Link request is invalid or has expired")
+			return
+		}
+		flow.LinkSessionID, _ = strconv.Atoi(subject)
+	}
+	var err error
+	for _, v := range []*string{&flow.State, &flow.Nonce, &flow.Verifier} {
+		if *v, err = randomToken(32); err != nil {
+			fmt.Println("Error generating OIDC flow state:", err)
+			writeError(w, r, http.StatusInternalServerError, ProblemInternal, "Internal server error")
+			return
+		}
+	}
+
+	authURL, err := h.oidc.AuthorizationURL(r.Context(), flow.State, flow.Nonce, flow.Verifier)
+	if err != nil {
+		fmt.Println("Error building authorization URL:", err)
+		writeError(w, r, http.StatusBadGateway, ProblemUpstream, "SSO provider unavailable")
+		return
+	}
+	encoded, _ := json.Marshal(flow)
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcFlowCookie,
+		Value:    h.tokens.Issue(oidcFlowPurpose, string(encoded), oidcFlowTTL),
+		Path:     "/api/oidc",
+		MaxAge:   int(oidcFlowTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// OIDCLink handles POST /api/oidc/link. It returns a short-lived login URL for
+// the IdP account to link. The account is only linked once the current session
+// claims it with CompleteOIDCLink, so a login URL sent to someone else can't
+// link their account.
+func (h *Handlers) OIDCLink(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("OIDCLink called")
+	if h.oidc == nil {
+		writeError(w, r, http.StatusNotFound, ProblemSSODisabled, "SSO is not configured")
+		return
+	}
+	_, session, ok := h.requireSession(w, r)
+	if !ok {
+		return
+	}
+	token := h.tokens.Issue(oidcLinkPurpose, strconv.Itoa(session.ID), oidcLinkTTL)
+	writeJSON(w, http.StatusOK, LinkSSOResponse{LoginURL: "/api/oidc/login?link_token=" + url.QueryEscape(token)})
+}
+
+// CompleteOIDCLink handles POST /api/oidc/link/complete, linking the IdP
+// account in a link_result from the callback to the current user. Only the
+// session that started the link can complete it.
+func (h *Handlers) CompleteOIDCLink(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("CompleteOIDCLink called")
+	if h.oidc == nil {
+		writeError(w, r, http.StatusNotFound, ProblemSSODisabled, "SSO is not configured")
+		return
+	}
+	user, session, ok := h.requireSession(w, r)
+	if !ok {
+		return
+	}
+	var req CompleteSSOLinkRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	var result oidcLinkResult
+	encoded, err := h.tokens.Verify(oidcLinkResultPurpose, req.LinkResult)
+	if err == nil {
+		err = json.Unmarshal([]byte(encoded), &result)
+	}
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ProblemInvalidToken, "Link result is invalid or has expired")
+		return
+	}
+	if result.SessionID != session.ID {
+		writeError(w, r, http.StatusForbidden, ProblemForbidden, "The link was started from another session")
+		return
+	}
+
+	if _, err := h.ssoUser(r, result.Claims, user.ID); err != nil {
+		var refused ssoRefusal
+		switch {
+		case errors.Is(err, ErrIdentityLinked):
+			writeError(w, r, http.StatusConflict, ProblemConflict, err.Error())
+		case errors.As(err, &refused):
+			writeError(w, r, http.StatusForbidden, ProblemForbidden, err.Error())
+		default:
+			fmt.Println("Error linking SSO account:", err)
+			writeServerError(w, r, err, "Database error")
+		}
+		return
+	}
+	identities, err := h.db.ListIdentities(r.Context(), user.ID)
+	if err != nil {
+		fmt.Println("Database error listing identities:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	writeJSON(w, http.StatusOK, identities)
+}
+
+// OIDCCallback handles GET /api/oidc/callback, where the IdP sends the browser
+// back. The result is passed to the frontend in the URL fragment: a session
+// token, an MFA challenge, an IdP account to link, or an error.
+func (h *Handlers) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("OIDCCallback called")
+	if h.oidc == nil {
+		writeError(w, r, http.StatusNotFound, ProblemSSODisabled, "SSO is not configured")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcFlowCookie, Value: "", Path: "/api/oidc", MaxAge: -1, HttpOnly: true})
+
+	query := r.URL.Query()
+	if idpError := query.Get("error"); idpError != "" {
+		fmt.Println("IdP returned an error:", idpError, query.Get("error_description"))
+		h.finishOIDC(w, r, url.Values{"error": {"Sign-in was cancelled or refused"}})
+		return
+	}
+
+	var flow oidcFlow
+	cookie, err := r.Cookie(oidcFlowCookie)
+	if err == nil {
+		var encoded string
+		if encoded, err = h.tokens.Verify(oidcFlowPurpose, cookie.Value); err == nil {
+			err = json.Unmarshal([]byte(encoded), &flow)
+		}
+	}
+	if err != nil || subtle.ConstantTimeCompare([]byte(flow.State), []byte(query.Get("state"))) != 1 {
+		h.finishOIDC(w, r, url.Values{"error": {"Sign-in expired, please try again"}})
+		return
+	}
+
+	rawIDToken, err := h.oidc.Exchange(r.Context(), query.Get("code"), flow.Verifier)
+	if err != nil {
+		fmt.Println("Error exchanging authorization code:", err)
+		h.finishOIDC(w, r, url.Values{"error": {"Could not complete sign-in"}})
+		return
+	}
+	claims, err := h.oidc.VerifyIDToken(r.Context(), rawIDToken, flow.Nonce)
+	if err != nil {
+		fmt.Println("Error verifying ID token:", err)
+		h.finishOIDC(w, r, url.Values{"error": {"Could not complete sign-in"}})
+		return
+	}
+
+	if flow.LinkSessionID != 0 {
+		encoded, _ := json.Marshal(oidcLinkResult{SessionID: flow.LinkSessionID, Claims: claims})
+		h.finishOIDC(w, r, url.Values{"link_result": {h.tokens.Issue(oidcLinkResultPurpose, string(encoded), oidcLinkTTL)}})
+		return
+	}
+
+	user, err := h.ssoUser(r, claims, 0)
+	if err != nil {
+		fmt.Println("SSO login refused:", err)
+		message := "Could not complete sign-in"
+		var refused ssoRefusal
+		if errors.As(err, &refused) || errors.Is(err, ErrIdentityLinked) {
+			message = err.Error()
+		}
+		h.finishOIDC(w, r, url.Values{"error": {message}})
+		return
+	}
+	if user.DisabledAt != nil {
+		h.audit(r, user, AuditLoginFailed, "user", user.UserID, nil, nil)
+		h.finishOIDC(w, r, url.Values{"error": {"Account disabled"}})
+		return
+	}
+	if user.TOTPEnabledAt != nil {
+		h.finishOIDC(w, r, url.Values{
+			"mfa_required":    {"1"},
+			"challenge_token": {h.tokens.Issue(mfaChallengePurpose, user.UserID, mfaChallengeTTL)},
+			"user_id":         {user.UserID},
+		})
+		return
+	}
+
+	token, err := h.startSession(r, user)
+	if err != nil {
+		fmt.Println("Error starting session:", err)
+		h.finishOIDC(w, r, url.Values{"error": {"Internal server error"}})
+		return
+	}
+	h.audit(r, user, AuditLogin, "user", user.UserID, nil, map[string]any{"method": "sso"})
+	h.finishOIDC(w, r, url.Values{"token": {token}, "user_id": {user.UserID}})
+}
+
+// finishOIDC sends the browser to the frontend with result in the fragment,
+// which isn't sent to servers or kept in logs
+func (h *Handlers) finishOIDC(w http.ResponseWriter, r *http.Request, result url.Values) {
+	http.Redirect(w, r, h.oidc.config.FrontendURL+"#"+result.Encode(), http.StatusFound)
+}
+
+// ssoRefusal is a reason for refusing an SSO login that can be shown to the user
+type ssoRefusal string
+
+func (e ssoRefusal) Error() string { return string(e) }
+
+// ssoUser finds, links or provisions the user for a verified ID token
+func (h *Handlers) ssoUser(r *http.Request, claims map[string]any, linkUserID int) (*User, error) {
+	config := h.oidc.config
+	subject := claims["sub"].(string)
+
+	user, err := h.db.GetUserByIdentity(r.Context(), config.Issuer, subject)
+	switch {
+	case err == nil && linkUserID != 0 && user.ID != linkUserID:
+		return nil, ErrIdentityLinked
+	case err == sql.ErrNoRows && linkUserID != 0:
+		if user, err = h.db.GetUserByID(r.Context(), linkUserID); err != nil {
+			return nil, err
+		}
+		if err = h.linkIdentity(r, user, subject); err != nil {
+			return nil, err
+		}
+	case err == sql.ErrNoRows:
+		if user, err = h.provisionSSOUser(r, claims, subject); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	}
+
+	if err := h.db.TouchIdentity(r.Context(), config.Issuer, subject); err != nil {
+		fmt.Println("Error updating identity last login:", err)
+	}
+	if config.RoleClaim != "" {
+		if role := config.loginRole(claims, user.Role); role != user.Role {
+			updated, err := h.db.SetUserRole(r.Context(), user.ID, role)
+			if err != nil {
+				return nil, err
+			}
+			h.audit(r, nil, AuditAdminUserRole, "user", user.UserID, map[string]any{"role": user.Role}, map[string]any{"role": role})
+			user = updated
+		}
+	}
+	return user, nil
+}
+
+// provisionSSOUser links the first login of an IdP account to the user with a
+// matching user_id, or creates one, as configured
+func (h *Handlers) provisionSSOUser(r *http.Request, claims map[string]any, subject string) (*User, error) {
+	config := h.oidc.config
+	userIDs := claimStrings(claims, config.UserIDClaim)
+	if len(userIDs) != 1 {
+		return nil, fmt.Errorf("ID token has no usable %s claim", config.UserIDClaim)
+	}
+	// The IdP's naming rules apply rather than USER_ID_CHARSET, so e.g. emails work
+	userID := NormalizeUserID(userIDs[0])
+	if userID == "" || len(userID) > maxUserIDLength {
+		return nil, fmt.Errorf("ID token has no usable %s claim", config.UserIDClaim)
+	}
+
+	existing, err := h.db.GetUserByUserID(r.Context(), userID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if existing != nil {
+		if !config.LinkByUserID {
+			return nil, ssoRefusal("An account named " + userID + " already exists. Sign in with your password and link SSO from your account.")
+		}
+		return existing, h.linkIdentity(r, existing, subject)
+	}
+	if !config.AutoProvision {
+		return nil, ssoRefusal("No account is linked to this SSO login")
+	}
+
+	user, err := h.db.CreateSSOUser(r.Context(), userID, config.Issuer, subject)
+	if err != nil {
+		return nil, err
+	}
+	h.audit(r, user, AuditSSOProvision, "user", user.UserID, nil, map[string]any{"issuer": config.Issuer, "subject": subject})
+	return user, nil
+}
+
+// linkIdentity links the IdP account to user
+func (h *Handlers) linkIdentity(r *http.Request, user *User, subject string) error {
+	if err := h.db.CreateIdentity(r.Context(), user.ID, h.oidc.config.Issuer, subject); err != nil {
+		return err
+	}
+	h.audit(r, user, AuditSSOLink, "user", user.UserID, nil, map[string]any{"issuer": h.oidc.config.Issuer, "subject": subject})
+	return nil
+}
+
+// ListIdentities handles GET /api/oidc/identities
+func (h *Handlers) ListIdentities(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("ListIdentities called")
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+	identities, err := h.db.ListIdentities(r.Context(), user.ID)
+	if err != nil {
+		fmt.Println("Database error listing identities:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	writeJSON(w, http.StatusOK, identities)
+}
+
+// UnlinkIdentity handles DELETE /api/oidc/identities/{identityID}. Users
+// without a password can't remove their last identity.
+func (h *Handlers) UnlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("UnlinkIdentity called")
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["identityID"])
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, ProblemNotFound, "Identity not found")
+		return
+	}
+
+	identities, err := h.db.ListIdentities(r.Context(), user.ID)
+	if err != nil {
+		fmt.Println("Database error listing identities:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	var identity *Identity
+	for _, candidate := range identities {
+		if candidate.ID == id {
+			identity = candidate
+		}
+	}
+	if identity == nil {
+		writeError(w, r, http.StatusNotFound, ProblemNotFound, "Identity not found")
+		return
+	}
+	if len(identities) == 1 && user.Password == unusablePassword {
+		writeError(w, r, http.StatusConflict, ProblemConflict, "Set a password before unlinking your only SSO login")
+		return
+	}
+
+	if err := h.db.DeleteIdentity(r.Context(), user.ID, id); err != nil {
+		fmt.Println("Database error unlinking identity:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	h.audit(r, user, AuditSSOUnlink, "user", user.UserID, map[string]any{"issuer": identity.Issuer, "subject": identity.Subject}, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CreateIdentityTable creates the user_identities table if it doesn't exist
+func (db *Database) CreateIdentityTable(ctx context.Context) error {
+	fmt.Println("CreateIdentityTable called")
+	query := `
+		CREATE TABLE IF NOT EXISTS user_identities (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			issuer TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			last_login_at TIMESTAMPTZ,
+			UNIQUE (issuer, subject)
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_user_identities_user ON user_identities(user_id);
+	`
+
+	_, err := db.conn.ExecContext(ctx, query)
+	return err
+}
+
+// GetUserByIdentity returns the user linked to an IdP account
+func (db *Database) GetUserByIdentity(ctx context.Context, issuer, subject string) (*User, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = (
+		SELECT user_id FROM user_identities WHERE issuer = $1 AND subject = $2)`
+	return scanUser(db.conn.QueryRowContext(ctx, query, issuer, subject))
+}
+
+// CreateIdentity links an IdP account to a user, returning ErrIdentityLinked
+// if it is already linked
+func (db *Database) CreateIdentity(ctx context.Context, userID int, issuer, subject string) error {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	result, err := db.conn.ExecContext(ctx, `
+		INSERT INTO user_identities (user_id, issuer, subject) VALUES ($1, $2, $3)
+		ON CONFLICT (issuer, subject) DO NOTHING`, userID, issuer, subject)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrIdentityLinked
+	}
+	return nil
+}
+
+// CreateSSOUser creates a user without a usable password, linked to an IdP account
+func (db *Database) CreateSSOUser(ctx context.Context, userID, issuer, subject string) (*User, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO users (user_id, password) VALUES ($1, $2) RETURNING ` + userColumns
+	user, err := scanUser(tx.QueryRowContext(ctx, query, userID, unusablePassword))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO user_identities (user_id, issuer, subject) VALUES ($1, $2, $3)`,
+		user.ID, issuer, subject); err != nil {
+		return nil, err
+	}
+	return user, tx.Commit()
+}
+
+// TouchIdentity records a login through an IdP account
+func (db *Database) TouchIdentity(ctx context.Context, issuer, subject string) error {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	_, err := db.conn.ExecContext(ctx, `UPDATE user_identities SET last_login_at = NOW() WHERE issuer = $1 AND subject = $2`, issuer, subject)
+	return err
+}
+
+// ListIdentities returns the IdP accounts linked to a user
+func (db *Database) ListIdentities(ctx context.Context, userID int) ([]*Identity, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	rows, err := db.conn.QueryContext(ctx, `
+		SELECT id, user_id, issuer, subject, created_at, last_login_at
+		FROM user_identities WHERE user_id = $1 ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []*Identity{}
+	for rows.Next() {
+		identity := &Identity{}
+		if err := rows.Scan(&identity.ID, &identity.UserID, &identity.Issuer, &identity.Subject,
+			&identity.CreatedAt, &identity.LastLoginAt); err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+	return identities, rows.Err()
+}
+
+// DeleteIdentity unlinks one of a user's IdP accounts
+func (db *Database) DeleteIdentity(ctx context.Context, userID, id int) error {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	_, err := db.conn.ExecContext(ctx, `DELETE FROM user_identities WHERE id = $1 AND user_id = $2`, id, userID)
+	return err
+}
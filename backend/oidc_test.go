@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"shorturl-backend/internal/mockidp"
+)
+
+const testClientID = "shorturl"
+
+// startMockIdP serves a mock IdP and returns it with a provider configured for it
+func startMockIdP(t *testing.T) (*mockidp.Provider, *OIDCProvider) {
+	t.Helper()
+	var idp *mockidp.Provider
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idp.Handler().ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	var err error
+	idp, err = mockidp.New(srv.URL, testClientID, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := NewOIDCProvider(OIDCConfig{
+		Issuer:       srv.URL,
+		ClientID:     testClientID,
+		ClientSecret: "secret",
+		RedirectURL:  "http://app.test/api/oidc/callback",
+		Scopes:       []string{"openid", "profile"},
+	})
+	return idp, provider
+}
+
+func TestOIDCRoundTrip(t *testing.T) {
+	_, provider := startMockIdP(t)
+	ctx := context.Background()
+
+	authURL, err := provider.AuthorizationURL(ctx, "the-state", "the-nonce", "the-verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// login_hint makes the mock IdP sign in straight away and redirect back
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(authURL + "&login_hint=alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorization endpoint answered %s, want a redirect", resp.Status)
+	}
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(callback.String(), "http://app.test/api/oidc/callback?") {
+		t.Fatalf("redirected to %s, want the callback", callback)
+	}
+	if state := callback.Query().Get("state"); state != "the-state" {
+		t.Errorf("state = %q, want %q", state, "the-state")
+	}
+	code := callback.Query().Get("code")
+
+	if _, err := provider.Exchange(ctx, code, "wrong-verifier"); err == nil {
+		t.Error("Exchange succeeded with the wrong PKCE verifier")
+	}
+	// The failed exchange used the code up
+	resp, err = client.Get(authURL + "&login_hint=alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback, _ = url.Parse(resp.Header.Get("Location"))
+	code = callback.Query().Get("code")
+
+	idToken, err := provider.Exchange(ctx, code, "the-verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provider.VerifyIDToken(ctx, idToken, "other-nonce"); err == nil {
+		t.Error("VerifyIDToken accepted a token for another nonce")
+	}
+	claims, err := provider.VerifyIDToken(ctx, idToken, "the-nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["sub"] != "alice" || claims["preferred_username"] != "alice" {
+		t.Errorf("claims = %v, want sub and preferred_username alice", claims)
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	idp, provider := startMockIdP(t)
+	now := time.Now()
+	skew := oidcClockSkew / 2
+
+	tests := []struct {
+		name    string
+		claims  map[string]any
+		wantErr string
+	}{
+		{"valid", nil, ""},
+		{"expired", map[string]any{"exp": now.Add(-oidcClockSkew - time.Minute).Unix()}, "expired"},
+		{"expired within skew", map[string]any{"exp": now.Add(-skew).Unix()}, ""},
+		{"missing exp", map[string]any{"exp": nil}, "expired"},
+		{"issued in the future", map[string]any{"iat": now.Add(oidcClockSkew + time.Minute).Unix()}, "issued in the future"},
+		{"issued within skew", map[string]any{"iat": now.Add(skew).Unix()}, ""},
+		{"missing iat", map[string]any{"iat": nil}, "issued in the future"},
+		{"not valid yet", map[string]any{"nbf": now.Add(oidcClockSkew + time.Minute).Unix()}, "not valid yet"},
+		{"valid within skew", map[string]any{"nbf": now.Add(skew).Unix()}, ""},
+		{"other issuer", map[string]any{"iss": "https://evil.test"}, "issuer"},
+		{"other audience", map[string]any{"aud": "someone-else"}, "audience"},
+		{"audience list", map[string]any{"aud": []string{"someone-else", testClientID}}, ""},
+		{"other authorized party", map[string]any{"azp": "someone-else"}, "authorized party"},
+		{"wrong nonce", map[string]any{"nonce": "other-nonce"}, "nonce"},
+		{"no subject", map[string]any{"sub": ""}, "subject"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := map[string]any{
+				"iss":   idp.Issuer(),
+				"aud":   testClientID,
+				"sub":   "alice",
+				"nonce": "the-nonce",
+				"iat":   now.Unix(),
+				"exp":   now.Add(5 * time.Minute).Unix(),
+			}
+			for k, v := range tt.claims {
+				if v == nil {
+					delete(claims, k)
+					continue
+				}
+				claims[k] = v
+			}
+			token, err := idp.Sign(claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = provider.VerifyIDToken(context.Background(), token, "the-nonce")
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("VerifyIDToken: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("VerifyIDToken error = %v, want one mentioning %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// A payload from another token must not pass with this token's signature
+	genuine, _ := idp.Sign(map[string]any{"iss": idp.Issuer(), "aud": testClientID, "sub": "alice", "nonce": "the-nonce", "iat": now.Unix(), "exp": now.Add(time.Minute).Unix()})
+	other, _ := idp.Sign(map[string]any{"iss": idp.Issuer(), "aud": testClientID, "sub": "mallory", "nonce": "the-nonce", "iat": now.Unix(), "exp": now.Add(time.Minute).Unix()})
+	g, o := strings.Split(genuine, "."), strings.Split(other, ".")
+	if _, err := provider.VerifyIDToken(context.Background(), g[0]+"."+o[1]+"."+g[2], "the-nonce"); err == nil {
+		t.Error("VerifyIDToken accepted a token with a swapped payload")
+	}
+}
+
+func TestLoginRole(t *testing.T) {
+	roleMap := map[string]string{"shorturl-admins": RoleAdmin, "support": RoleModerator}
+	tests := []struct {
+		name      string
+		groups    any
+		current   string
+		downgrade bool
+		want      string
+	}{
+		{"no claim", nil, RoleUser, false, RoleUser},
+		{"mapped", []any{"support"}, RoleUser, false, RoleModerator},
+		{"single string", "shorturl-admins", RoleUser, false, RoleAdmin},
+		{"highest mapped wins", []any{"support", "shorturl-admins"}, RoleUser, false, RoleAdmin},
+		{"unmapped role name ignored", []any{"admin"}, RoleUser, false, RoleUser},
+		{"unmapped values ignored", []any{"engineering", "support"}, RoleUser, false, RoleModerator},
+		{"admin kept without downgrade", []any{"support"}, RoleAdmin, false, RoleAdmin},
+		{"admin kept without groups", nil, RoleAdmin, false, RoleAdmin},
+		{"admin lowered with downgrade", []any{"support"}, RoleAdmin, true, RoleModerator},
+		{"lowered to user with downgrade", nil, RoleModerator, true, RoleUser},
+		{"raised with downgrade", []any{"shorturl-admins"}, RoleModerator, true, RoleAdmin},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := OIDCConfig{RoleClaim: "groups", RoleMap: roleMap, RoleDowngrade: tt.downgrade}
+			claims := map[string]any{"sub": "123"}
+			if tt.groups != nil {
+				claims["groups"] = tt.groups
+			}
+			if got := config.loginRole(claims, tt.current); got != tt.want {
+				t.Errorf("loginRole = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+// pageStyle is shared by the server-rendered HTML pages
+const pageStyle = `
+        body {
+            font-family: Arial, sans-serif;
+            padding: 50px;
+            background-color: #f8f9fa;
+            color: #212529;
+        }
+        .card {
+            max-width: 640px;
+            margin: 0 auto;
+            background: #fff;
+            border-radius: 8px;
+            padding: 2rem;
+            box-shadow: 0 2px 8px rgba(0, 0, 0, 0.08);
+        }
+        .warning { color: #856404; background: #fff3cd; padding: 1rem; border-radius: 4px; }
+        .destination { word-break: break-all; font-family: monospace; font-size: 1.1rem; }
+        dl { display: grid; grid-template-columns: max-content auto; gap: 0.5rem 1rem; color: #6c757d; }
+        dt { font-weight: bold; }
+        .button {
+            display: inline-block;
+            margin-top: 1.5rem;
+            padding: 0.75rem 1.5rem;
+            background: #007bff;
+            color: #fff;
+            border: none;
+            border-radius: 4px;
+            font-size: 1rem;
+            text-decoration: none;
+            cursor: pointer;
+        }
+`
+
+// PreviewPage is the data rendered by the preview and interstitial templates
+type PreviewPage struct {
+	ShortURL     *ShortURL
+	Creator      string
+	ContinueURL  string
+	Interstitial bool
+	// HideDestination leaves out the URL of links with a click limit
+	HideDestination bool
+}
+
+var previewTemplate = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html>
+<head>
+    <title>{{if .Interstitial}}You are leaving this site{{else}}Link preview{{end}}</title>
+    <meta name="robots" content="noindex">
+    <style>` + pageStyle + `</style>
+</head>
+<body>
+    <div class="card">
+        {{if .Interstitial}}
+        <h1>You are leaving this site</h1>
+        <p class="warning">This link points to an external website. Make sure you trust the destination before continuing.</p>
+        {{else}}
+        <h1>Link preview</h1>
+        {{end}}
+        {{if .HideDestination}}
+        <p>This link can only be opened a limited number of times, so where it goes is only shown when you continue.</p>
+        {{else}}
+        <p>This short link goes to:</p>
+        <p class="destination">{{.ShortURL.OriginalURL}}</p>
+        {{end}}
+        <dl>
+            <dt>Short code</dt><dd>{{.ShortURL.ShortCode}}</dd>
+            <dt>Created by</dt><dd>{{if .Creator}}{{.Creator}}{{else}}Anonymous{{end}}</dd>
+            <dt>Created</dt><dd>{{.ShortURL.CreatedAt.Format "Jan 2, 2006 15:04 MST"}}</dd>
+            <dt>Expires</dt><dd>{{if .ShortURL.ExpiresAt}}{{.ShortURL.ExpiresAt.Format "Jan 2, 2006 15:04 MST"}}{{else}}Never{{end}}</dd>
+            <dt>Clicks</dt><dd>{{.ShortURL.ClickCount}}</dd>
+        </dl>
+        <a class="button" href="{{.ContinueURL}}" rel="noreferrer">Continue to destination</a>
+    </div>
+</body>
+</html>`))
+
+// renderPreviewPage renders the link preview or interstitial warning page
+func (h *Handlers) renderPreviewPage(w http.ResponseWriter, page *PreviewPage) {
+	fmt.Println("Rendering preview page for:", page.ShortURL.ShortCode)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := previewTemplate.Execute(w, page); err != nil {
+		fmt.Println("Error rendering preview page:", err)
+	}
+}
+
+// UnlockPage is the data rendered by the passphrase form
+type UnlockPage struct {
+	ShortCode string
+	Error     string
+}
+
+var unlockTemplate = template.Must(template.New("unlock").Parse(`<!DOCTYPE html>
+<html>
+<head>
+    <title>Protected link</title>
+    <meta name="robots" content="noindex">
+    <style>` + pageStyle + `
+        input { width: 100%; padding: 0.75rem; font-size: 1rem; box-sizing: border-box; }
+        .error { color: #dc3545; }
+    </style>
+</head>
+<body>
+    <div class="card">
+        <h1>This link is protected</h1>
+        <p>Enter the passphrase to continue.</p>
+        {{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+        <form method="POST">
+            <input type="password" name="password" autocomplete="current-password" autofocus required>
+            <button class="button" type="submit">Unlock</button>
+        </form>
+    </div>
+</body>
+</html>`))
+
+// renderUnlockPage renders the passphrase form for a protected link
+func (h *Handlers) renderUnlockPage(w http.ResponseWriter, shortURL *ShortURL, message string, statusCode int) {
+	fmt.Println("Rendering unlock page for:", shortURL.ShortCode)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	if err := unlockTemplate.Execute(w, &UnlockPage{ShortCode: shortURL.ShortCode, Error: message}); err != nil {
+		fmt.Println("Error rendering unlock page:", err)
+	}
+}
+
+var usedUpTemplate = template.Must(template.New("used-up").Parse(`<!DOCTYPE html>
+<html>
+<head>
+    <title>Link used up</title>
+    <meta name="robots" content="noindex">
+    <style>` + pageStyle + `</style>
+</head>
+<body>
+    <div class="card">
+        <h1>This link has been used up</h1>
+        <p>It could only be opened a limited number of times and has no uses left. Ask whoever shared it for a new link.</p>
+    </div>
+</body>
+</html>`))
+
+// renderUsedUpPage renders the page shown once a link has reached its click limit
+func (h *Handlers) renderUsedUpPage(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusGone)
+	if err := usedUpTemplate.Execute(w, nil); err != nil {
+		fmt.Println("Error rendering used up page:", err)
+	}
+}
+
+var botTemplate = template.Must(template.New("bot").Parse(`<!DOCTYPE html>
+<html>
+<head>
+    <title>Open in a browser</title>
+    <meta name="robots" content="noindex">
+    <style>` + pageStyle + `</style>
+</head>
+<body>
+    <div class="card">
+        <h1>Open this link in a browser</h1>
+        <p>It can only be opened a limited number of times, so it isn't shown to previews, crawlers or scripts.</p>
+    </div>
+</body>
+</html>`))
+
+// renderBotPage renders the page bots get instead of a link with a click limit
+func (h *Handlers) renderBotPage(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	if err := botTemplate.Execute(w, nil); err != nil {
+		fmt.Println("Error rendering bot page:", err)
+	}
+}
+
+var notYetActiveTemplate = template.Must(template.New("not-yet-active").Parse(`<!DOCTYPE html>
+<html>
+<head>
+    <title>Coming soon</title>
+    <meta name="robots" content="noindex">
+    <style>` + pageStyle + `</style>
+</head>
+<body>
+    <div class="card">
+        <h1>This link isn't live yet</h1>
+        <p>It will start working on {{.Format "Jan 2, 2006 at 15:04 MST"}}.</p>
+    </div>
+</body>
+</html>`))
+
+// renderNotYetActivePage renders the page shown before a link's activation time
+func (h *Handlers) renderNotYetActivePage(w http.ResponseWriter, activatesAt time.Time) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusNotFound)
+	if err := notYetActiveTemplate.Execute(w, activatesAt.UTC()); err != nil {
+		fmt.Println("Error rendering not yet active page:", err)
+	}
+}
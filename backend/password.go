@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrInvalidResetToken is returned for reset tokens that are unknown, used or expired
+var ErrInvalidResetToken = errors.New("invalid or expired reset token")
+
+// ChangePasswordRequest represents the request body for changing a password
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// ForgotPasswordRequest represents the request body for requesting a reset token
+type ForgotPasswordRequest struct {
+	UserID string `json:"user_id"`
+}
+
+// ResetPasswordRequest represents the request body for resetting a password with a token
+type ResetPasswordRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+// hashResetToken returns the form of a reset token stored in the database
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ChangePassword handles POST /api/password/change. Every session of the user
+// ends; the response carries a token for a new session on this device.
+func (h *Handlers) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("ChangePassword called")
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	var req ChangePasswordRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.CurrentPassword)) != nil {
+		writeError(w, r, http.StatusForbidden, ProblemInvalidCredentials, "Current password is incorrect")
+		return
+	}
+	if fieldErrors := h.passwordPolicy.Check("new_password", req.NewPassword, user.UserID); len(fieldErrors) > 0 {
+		writeFieldErrors(w, r, http.StatusBadRequest, ProblemValidation, fieldErrors)
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		fmt.Println("Error hashing password:", err)
+		writeError(w, r, http.StatusInternalServerError, ProblemInternal, "Internal server error")
+		return
+	}
+	updated, err := h.db.UpdatePassword(r.Context(), user.ID, string(hashedPassword))
+	if err != nil {
+		fmt.Println("Database error changing password:", err)
+		writeServerError(w, r, err, "Internal server error")
+		return
+	}
+
+	h.audit(r, user, AuditPasswordChange, "user", user.UserID, nil, nil)
+
+	token, err := h.startSession(r, updated)
+	if err != nil {
+		fmt.Println("Error starting session:", err)
+		writeJSON(w, http.StatusOK, AuthResponse{Success: true, Message: "Password changed, please log in again", UserID: updated.UserID})
+		return
+	}
+	writeJSON(w, http.StatusOK, AuthResponse{
+		Success: true,
+		Message: "Password changed",
+		Token:   token,
+		UserID:  updated.UserID,
+	})
+}
+
+// ForgotPassword handles POST /api/password/forgot. It always answers 202 so
+// it can't be used to find out which user IDs exist.
+func (h *Handlers) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("ForgotPassword called")
+	var req ForgotPasswordRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	req.UserID = NormalizeUserID(req.UserID)
+	if !h.resetLimiter.Allow(clientIP(r)) {
+		writeError(w, r, http.StatusTooManyRequests, ProblemRateLimited, "Too many reset requests, try again later")
+		return
+	}
+
+	accepted := AuthResponse{Success: true, Message: "If the account exists, a reset token has been sent"}
+	user, err := h.db.GetUserByUserID(r.Context(), req.UserID)
+	if err == sql.ErrNoRows || (err == nil && user.DisabledAt != nil) {
+		writeJSON(w, http.StatusAccepted, accepted)
+		return
+	}
+	if err != nil {
+		fmt.Println("Database error looking up user:", err)
+		writeServerError(w, r, err, "Internal server error")
+		return
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		fmt.Println("Error generating reset token:", err)
+		writeError(w, r, http.StatusInternalServerError, ProblemInternal, "Internal server error")
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	expiresAt := time.Now().Add(h.resetTTL)
+	if err := h.db.CreatePasswordReset(r.Context(), user.ID, hashResetToken(token), expiresAt); err != nil {
+		fmt.Println("Database error creating reset token:", err)
+		writeServerError(w, r, err, "Internal server error")
+		return
+	}
+
+	body := fmt.Sprintf("Use this token to reset your password before %s:\n\n%s\n", expiresAt.UTC().Format(time.RFC1123), token)
+	if h.resetURL != "" {
+		body += "\nOr open " + h.resetURL + "?token=" + url.QueryEscape(token) + "\n"
+	}
+	if err := h.notifier.Notify(&Notification{To: user.UserID, Subject: "Reset your password", Body: body, SentAt: time.Now()}); err != nil {
+		fmt.Println("Error sending reset token:", err)
+	}
+
+	h.audit(r, nil, AuditPasswordResetRequest, "user", user.UserID, nil, nil)
+	writeJSON(w, http.StatusAccepted, accepted)
+}
+
+// ResetPassword handles POST /api/password/reset, spending a reset token
+func (h *Handlers) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("ResetPassword called")
+	var req ResetPasswordRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if fieldErrors := h.passwordPolicy.Check("new_password", req.NewPassword, ""); len(fieldErrors) > 0 {
+		writeFieldErrors(w, r, http.StatusBadRequest, ProblemValidation, fieldErrors)
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		fmt.Println("Error hashing password:", err)
+		writeError(w, r, http.StatusInternalServerError, ProblemInternal, "Internal server error")
+		return
+	}
+	user, err := h.db.ConsumePasswordReset(r.Context(), hashResetToken(req.Token), string(hashedPassword))
+	if err == ErrInvalidResetToken {
+		writeError(w, r, http.StatusBadRequest, ProblemInvalidToken, "Invalid or expired reset token")
+		return
+	}
+	if err != nil {
+		fmt.Println("Database error resetting password:", err)
+		writeServerError(w, r, err, "Internal server error")
+		return
+	}
+
+	h.audit(r, user, AuditPasswordReset, "user", user.UserID, nil, nil)
+	writeJSON(w, http.StatusOK, AuthResponse{Success: true, Message: "Password reset, please log in", UserID: user.UserID})
+}
+
+// CreatePasswordResetTable creates the password_resets table if it doesn't exist
+func (db *Database) CreatePasswordResetTable(ctx context.Context) error {
+	fmt.Println("CreatePasswordResetTable called")
+	query := `
+		CREATE TABLE IF NOT EXISTS password_resets (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			token_hash CHAR(64) UNIQUE NOT NULL,
+			expires_at TIMESTAMPTZ NOT NULL,
+			used_at TIMESTAMPTZ,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_password_resets_user ON password_resets(user_id) WHERE used_at IS NULL;
+	`
+
+	_, err := db.conn.ExecContext(ctx, query)
+	return err
+}
+
+// CreatePasswordReset stores the hash of a reset token for a user
+func (db *Database) CreatePasswordReset(ctx context.Context, userID int, tokenHash string, expiresAt time.Time) error {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	_, err := db.conn.ExecContext(ctx, `INSERT INTO password_resets (user_id, token_hash, expires_at) VALUES ($1, $2, $3)`,
+		userID, tokenHash, expiresAt)
+	return err
+}
+
+// UpdatePassword sets a user's password hash and ends their sessions and pending resets
+func (db *Database) UpdatePassword(ctx context.Context, id int, hashedPassword string) (*User, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	user, err := setPassword(ctx, tx, id, hashedPassword)
+	if err != nil {
+		return nil, err
+	}
+	return user, tx.Commit()
+}
+
+// ConsumePasswordReset marks a reset token used and sets the new password in
+// one transaction, so each token works exactly once
+func (db *Database) ConsumePasswordReset(ctx context.Context, tokenHash, hashedPassword string) (*User, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	err = tx.QueryRowContext(ctx, `
+		UPDATE password_resets SET used_at = NOW()
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING user_id`, tokenHash).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidResetToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := setPassword(ctx, tx, userID, hashedPassword)
+	if err != nil {
+		return nil, err
+	}
+	return user, tx.Commit()
+}
+
+// setPassword updates the password inside tx, ending every session and
+// spending any outstanding reset tokens
+func setPassword(ctx context.Context, tx *sql.Tx, id int, hashedPassword string) (*User, error) {
+	query := `UPDATE users SET password = $2, updated_at = NOW() WHERE id = $1 RETURNING ` + userColumns
+	user, err := scanUser(tx.QueryRowContext(ctx, query, id, hashedPassword))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM sessions WHERE user_id = $1`, id); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE password_resets SET used_at = NOW() WHERE user_id = $1 AND used_at IS NULL`, id); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
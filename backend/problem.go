@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Problem codes identify the kind of failure in ErrorResponse.Code. They are
+// part of the API: clients switch on them, so never change an existing one.
+const (
+	ProblemInvalidRequest        = "invalid_request"
+	ProblemInvalidJSON           = "invalid_json"
+	ProblemPayloadTooLarge       = "payload_too_large"
+	ProblemValidation            = "validation_failed"
+	ProblemAuthRequired          = "authentication_required"
+	ProblemInvalidToken          = "invalid_token"
+	ProblemInvalidCredentials    = "invalid_credentials"
+	ProblemInvalidCode           = "invalid_code"
+	ProblemAccountDisabled       = "account_disabled"
+	ProblemMFARequired           = "mfa_required"
+	ProblemMFAEnrollmentRequired = "mfa_enrollment_required"
+	ProblemForbidden             = "forbidden"
+	ProblemNotFound              = "not_found"
+	ProblemMethodNotAllowed      = "method_not_allowed"
+	ProblemConflict              = "conflict"
+	ProblemAlreadyExists         = "already_exists"
+	ProblemLastOwner             = "last_owner"
+	ProblemGone                  = "gone"
+	ProblemRateLimited           = "rate_limited"
+	ProblemQuotaExceeded         = "quota_exceeded"
+	ProblemSSODisabled           = "sso_disabled"
+	ProblemUpstream              = "upstream_error"
+	ProblemUnavailable           = "unavailable"
+	ProblemTimeout               = "timeout"
+	ProblemInternal              = "internal_error"
+)
+
+// problemTypePrefix turns a problem code into the RFC 7807 type URI
+const problemTypePrefix = "urn:shorturl:problem:"
+
+// requestIDHeader carries the request ID in both directions
+const requestIDHeader = "X-Request-ID"
+
+// requestIDContextKey stores the request ID in the request context
+const requestIDContextKey contextKey = "requestID"
+
+// validRequestID limits the request IDs accepted from clients or proxies
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// newProblem builds the ErrorResponse for a failure of r
+func newProblem(r *http.Request, status int, code, detail string) *ErrorResponse {
+	return &ErrorResponse{
+		Type:      problemTypePrefix + code,
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		Code:      code,
+		RequestID: requestID(r),
+	}
+}
+
+// writeProblem writes problem, an ErrorResponse or a type embedding one, as
+// application/problem+json
+func writeProblem(w http.ResponseWriter, status int, problem any) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Del("Content-Length")
+	writeJSONBody(w, status, problem)
+}
+
+// writeError writes an ErrorResponse with the given status, code and detail
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	writeProblem(w, status, newProblem(r, status, code, detail))
+}
+
+// serverFailure picks the status, code and detail for a request that failed
+// with err: 504 when a database query ran out of time, 503 when it was
+// cancelled, e.g. because the client went away, and otherwise a 500 with detail
+func serverFailure(r *http.Request, err error, detail string) (int, string, string) {
+	var pqErr *pq.Error
+	canceled := errors.Is(err, context.Canceled)
+	timedOut := errors.Is(err, context.DeadlineExceeded)
+	// Postgres reports query_canceled both for statement_timeout and when the
+	// driver cancels the query because its context ended
+	if errors.As(err, &pqErr) && pqErr.Code == "57014" {
+		canceled = errors.Is(r.Context().Err(), context.Canceled)
+		timedOut = !canceled
+	}
+	switch {
+	case timedOut:
+		return http.StatusGatewayTimeout, ProblemTimeout, "The database took too long to respond, try again"
+	case canceled:
+		return http.StatusServiceUnavailable, ProblemUnavailable, "The request was cancelled"
+	}
+	return http.StatusInternalServerError, ProblemInternal, detail
+}
+
+// writeServerError writes the problem for a request that failed with err
+func writeServerError(w http.ResponseWriter, r *http.Request, err error, detail string) {
+	status, code, detail := serverFailure(r, err, detail)
+	writeError(w, r, status, code, detail)
+}
+
+// writeFieldErrors writes a validation failure listing the rejected fields
+func writeFieldErrors(w http.ResponseWriter, r *http.Request, status int, code string, fieldErrors []FieldError) {
+	problem := newProblem(r, status, code, fieldErrors[0].Message)
+	problem.Errors = fieldErrors
+	writeProblem(w, status, problem)
+}
+
+// isAPIRequest reports whether r is for the JSON API rather than a redirect or page
+func isAPIRequest(r *http.Request) bool {
+	return r.URL.Path == "/api" || strings.HasPrefix(r.URL.Path, "/api/")
+}
+
+// requestID returns the ID assigned to r by withRequestID
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
+
+// withRequestID gives every request an ID, reusing a well-formed X-Request-ID
+// from the client or a proxy, and echoes it in the response
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			raw := make([]byte, 8)
+			rand.Read(raw)
+			id = hex.EncodeToString(raw)
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDContextKey, id)))
+	})
+}
+
+// notFoundAPI answers /api requests that match no route
+func notFoundAPI(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotFound, ProblemNotFound, "No such API endpoint")
+}
+
+// methodNotAllowedAPI answers /api requests whose path exists but not for this method
+func methodNotAllowedAPI(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusMethodNotAllowed, ProblemMethodNotAllowed, r.Method+" is not supported for this endpoint")
+}
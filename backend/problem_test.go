@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestWithRequestID(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		reused bool
+	}{
+		{"none", "", false},
+		{"uuid", "3f2b8c1e-7d4a-4e0b-9c6f-1a2b3c4d5e6f", true},
+		{"proxy style", "req:1234.abc_DEF", true},
+		{"64 characters", strings.Repeat("a", 64), true},
+		{"too long", strings.Repeat("a", 65), false},
+		{"spaces", "not an id", false},
+		{"header injection", "abc\r\nSet-Cookie: x=1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen string
+			handler := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen = requestID(r)
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/api/urls", nil)
+			if tt.header != "" {
+				req.Header.Set(requestIDHeader, tt.header)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if !validRequestID.MatchString(seen) {
+				t.Fatalf("request ID %q is not well formed", seen)
+			}
+			if got := rec.Header().Get(requestIDHeader); got != seen {
+				t.Errorf("response %s = %q, want %q", requestIDHeader, got, seen)
+			}
+			if (seen == tt.header) != tt.reused {
+				t.Errorf("request ID = %q, reused %v, want %v", seen, seen == tt.header, tt.reused)
+			}
+		})
+	}
+}
+
+func TestAPIProblems(t *testing.T) {
+	tests := []struct {
+		name       string
+		handler    http.HandlerFunc
+		method     string
+		wantStatus int
+		wantCode   string
+		wantDetail string
+	}{
+		{"not found", notFoundAPI, http.MethodGet, http.StatusNotFound, ProblemNotFound, "No such API endpoint"},
+		{"method not allowed", methodNotAllowedAPI, http.MethodPatch, http.StatusMethodNotAllowed, ProblemMethodNotAllowed, "PATCH is not supported for this endpoint"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/api/nowhere", nil)
+			req.Header.Set(requestIDHeader, "test-request")
+			rec := httptest.NewRecorder()
+			withRequestID(tt.handler).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/problem+json" {
+				t.Errorf("Content-Type = %q, want application/problem+json", ct)
+			}
+			var problem ErrorResponse
+			if err := json.NewDecoder(rec.Body).Decode(&problem); err != nil {
+				t.Fatalf("decoding problem: %v", err)
+			}
+			want := ErrorResponse{
+				Type:      problemTypePrefix + tt.wantCode,
+				Title:     http.StatusText(tt.wantStatus),
+				Status:    tt.wantStatus,
+				Detail:    tt.wantDetail,
+				Instance:  "/api/nowhere",
+				Code:      tt.wantCode,
+				RequestID: "test-request",
+			}
+			if !reflect.DeepEqual(problem, want) {
+				t.Errorf("problem = %+v, want %+v", problem, want)
+			}
+		})
+	}
+}
+
+func TestServerFailure(t *testing.T) {
+	queryCanceled := &pq.Error{Code: "57014", Message: "canceling statement due to user request"}
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	expiredCtx, cancelExpired := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancelExpired()
+
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		err        error
+		wantStatus int
+		wantCode   string
+		wantDetail string
+	}{
+		{"plain error", context.Background(), errors.New("connection refused"), http.StatusInternalServerError, ProblemInternal, "Failed to load"},
+		{"unique violation", context.Background(), &pq.Error{Code: "23505"}, http.StatusInternalServerError, ProblemInternal, "Failed to load"},
+		{"deadline exceeded", expiredCtx, context.DeadlineExceeded, http.StatusGatewayTimeout, ProblemTimeout, "The database took too long to respond, try again"},
+		{"wrapped deadline", expiredCtx, fmt.Errorf("query: %w", context.DeadlineExceeded), http.StatusGatewayTimeout, ProblemTimeout, "The database took too long to respond, try again"},
+		{"client went away", canceledCtx, context.Canceled, http.StatusServiceUnavailable, ProblemUnavailable, "The request was cancelled"},
+		{"statement timeout", context.Background(), queryCanceled, http.StatusGatewayTimeout, ProblemTimeout, "The database took too long to respond, try again"},
+		{"query canceled by deadline", expiredCtx, queryCanceled, http.StatusGatewayTimeout, ProblemTimeout, "The database took too long to respond, try again"},
+		{"query canceled by client", canceledCtx, queryCanceled, http.StatusServiceUnavailable, ProblemUnavailable, "The request was cancelled"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/urls", nil).WithContext(tt.ctx)
+			status, code, detail := serverFailure(r, tt.err, "Failed to load")
+			if status != tt.wantStatus || code != tt.wantCode || detail != tt.wantDetail {
+				t.Errorf("serverFailure = %d %q %q, want %d %q %q", status, code, detail, tt.wantStatus, tt.wantCode, tt.wantDetail)
+			}
+		})
+	}
+}
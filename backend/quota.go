@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Quotas on link creation, each enforced per user and per workspace
+const (
+	// QuotaLinksPerDay limits links created since midnight UTC
+	QuotaLinksPerDay = "links_per_day"
+	// QuotaLinksPerMonth limits links created since the start of the month, UTC
+	QuotaLinksPerMonth = "links_per_month"
+	// QuotaActiveLinks limits links that still redirect or can be made to
+	QuotaActiveLinks = "active_links"
+)
+
+// Quota scopes
+const (
+	QuotaScopeUser      = "user"
+	QuotaScopeWorkspace = "workspace"
+)
+
+// creationQuotas are checked whenever a new link is created
+var creationQuotas = []string{QuotaLinksPerDay, QuotaLinksPerMonth, QuotaActiveLinks}
+
+// PlanFree is the plan of new users and workspaces. It always exists.
+const PlanFree = "free"
+
+// validPlanName limits plan names to what can be part of an environment variable name
+var validPlanName = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+
+// QuotaConfig holds the limits for one scope; zero means unlimited
+type QuotaConfig struct {
+	LinksPerDay   int
+	LinksPerMonth int
+	ActiveLinks   int
+}
+
+// limit returns the configured limit for quota
+func (c QuotaConfig) limit(quota string) int {
+	switch quota {
+	case QuotaLinksPerDay:
+		return c.LinksPerDay
+	case QuotaLinksPerMonth:
+		return c.LinksPerMonth
+	case QuotaActiveLinks:
+		return c.ActiveLinks
+	}
+	return 0
+}
+
+// QuotaPlan holds the limits for users and workspaces on a plan
+type QuotaPlan struct {
+	User      QuotaConfig
+	Workspace QuotaConfig
+}
+
+// ValidatePlan checks that plan is one of the configured plans
+func (h *Handlers) ValidatePlan(plan string) error {
+	if _, ok := h.quotaPlans[plan]; !ok {
+		return fmt.Errorf("unknown plan %q", plan)
+	}
+	return nil
+}
+
+// quotaPlan returns the limits of plan. Users and workspaces on a plan that
+// has since been removed from the configuration get the free plan's limits.
+func (h *Handlers) quotaPlan(plan string) QuotaPlan {
+	if limits, ok := h.quotaPlans[plan]; ok {
+		return limits
+	}
+	return h.quotaPlans[PlanFree]
+}
+
+// QuotaUsage is the consumption of one quota
+type QuotaUsage struct {
+	Used int64 `json:"used"`
+	// Limit is nil when the quota is unlimited
+	Limit *int `json:"limit"`
+	// ResetsAt is when a periodic quota starts counting from zero again
+	ResetsAt *time.Time `json:"resets_at,omitempty"`
+}
+
+// QuotaError is the response body when a quota has been reached, a problem
+// extended with the quota and its usage
+type QuotaError struct {
+	ErrorResponse
+	Scope string `json:"scope"`
+	Quota string `json:"quota"`
+	QuotaUsage
+}
+
+// UsageResponse reports consumption against every quota
+type UsageResponse struct {
+	Plan string                `json:"plan"`
+	User map[string]QuotaUsage `json:"user"`
+	// Workspace is the current workspace's usage, if the user is working in one
+	Workspace     map[string]QuotaUsage `json:"workspace,omitempty"`
+	WorkspaceID   *int                  `json:"workspace_id,omitempty"`
+	WorkspacePlan string                `json:"workspace_plan,omitempty"`
+}
+
+// LinkCounts are the link totals quotas are measured against
+type LinkCounts struct {
+	Today     int64
+	ThisMonth int64
+	Active    int64
+}
+
+// quotaScope is a user or workspace whose links are counted by column
+type quotaScope struct {
+	name   string
+	column string
+	id     int
+	limits QuotaConfig
+}
+
+// quotaUsage measures counts against limits at now
+func quotaUsage(counts *LinkCounts, limits QuotaConfig, now time.Time) map[string]QuotaUsage {
+	day, month := periodStarts(now)
+	nextDay, nextMonth := day.AddDate(0, 0, 1), month.AddDate(0, 1, 0)
+
+	usage := map[string]QuotaUsage{
+		QuotaLinksPerDay:   {Used: counts.Today, ResetsAt: &nextDay},
+		QuotaLinksPerMonth: {Used: counts.ThisMonth, ResetsAt: &nextMonth},
+		QuotaActiveLinks:   {Used: counts.Active},
+	}
+	for quota, u := range usage {
+		if limit := limits.limit(quota); limit > 0 {
+			u.Limit = &limit
+			usage[quota] = u
+		}
+	}
+	return usage
+}
+
+// periodStarts returns the start of now's UTC day and month
+func periodStarts(now time.Time) (day, month time.Time) {
+	now = now.UTC()
+	day = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return day, month
+}
+
+// exceededQuota checks quotas for a user and, if set, the workspace they are
+// creating in, each with the limits of its plan. It returns the first quota
+// that has been reached, or nil. Checks happen before the link is created, so
+// concurrent requests can overshoot a limit by a few links.
+func (h *Handlers) exceededQuota(ctx context.Context, user *User, workspaceID *int, quotas ...string) (*QuotaError, error) {
+	scopes := []quotaScope{{QuotaScopeUser, "owner_id", user.ID, h.quotaPlan(user.Plan).User}}
+	if workspaceID != nil {
+		plan, err := h.db.GetWorkspacePlan(ctx, *workspaceID)
+		if err != nil {
+			return nil, err
+		}
+		scopes = append(scopes, quotaScope{QuotaScopeWorkspace, "workspace_id", *workspaceID, h.quotaPlan(plan).Workspace})
+	}
+
+	now := time.Now()
+	for _, scope := range scopes {
+		counts, err := h.db.CountLinks(ctx, scope.column, scope.id, now)
+		if err != nil {
+			return nil, err
+		}
+		usage := quotaUsage(counts, scope.limits, now)
+		for _, quota := range quotas {
+			u := usage[quota]
+			if u.Limit != nil && u.Used >= int64(*u.Limit) {
+				return &QuotaError{
+					ErrorResponse: ErrorResponse{Detail: fmt.Sprintf("The %s quota of %d %s has been reached", scope.name, *u.Limit, quota)},
+					Scope:         scope.name,
+					Quota:         quota,
+					QuotaUsage:    u,
+				}, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// writeQuotaError writes a 429 with Retry-After for periodic quotas, which free
+// up on their own, and a 403 for the others
+func writeQuotaError(w http.ResponseWriter, r *http.Request, quotaErr *QuotaError) {
+	fmt.Println("Quota reached:", quotaErr.Scope, quotaErr.Quota)
+	status := http.StatusForbidden
+	if quotaErr.ResetsAt != nil {
+		retryAfter := int(time.Until(*quotaErr.ResetsAt).Seconds()) + 1
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		status = http.StatusTooManyRequests
+	}
+	quotaErr.ErrorResponse = *newProblem(r, status, ProblemQuotaExceeded, quotaErr.Detail)
+	writeProblem(w, status, quotaErr)
+}
+
+// enforceQuotas writes an error and returns false if any of quotas has been reached
+func (h *Handlers) enforceQuotas(w http.ResponseWriter, r *http.Request, user *User, workspaceID *int, quotas ...string) bool {
+	quotaErr, err := h.exceededQuota(r.Context(), user, workspaceID, quotas...)
+	if err != nil {
+		fmt.Println("Database error checking quotas:", err)
+		writeServerError(w, r, err, "Database error")
+		return false
+	}
+	if quotaErr != nil {
+		writeQuotaError(w, r, quotaErr)
+		return false
+	}
+	return true
+}
+
+// Usage handles GET /api/usage
+func (h *Handlers) Usage(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Usage called")
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+	workspace, ok := h.currentWorkspace(w, r, user, WorkspaceViewer)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	counts, err := h.db.CountLinks(r.Context(), "owner_id", user.ID, now)
+	if err != nil {
+		fmt.Println("Database error counting links:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	response := UsageResponse{Plan: user.Plan, User: quotaUsage(counts, h.quotaPlan(user.Plan).User, now)}
+
+	if workspace != nil {
+		counts, err := h.db.CountLinks(r.Context(), "workspace_id", workspace.ID, now)
+		if err != nil {
+			fmt.Println("Database error counting links:", err)
+			writeServerError(w, r, err, "Database error")
+			return
+		}
+		response.Workspace = quotaUsage(counts, h.quotaPlan(workspace.Plan).Workspace, now)
+		response.WorkspaceID = &workspace.ID
+		response.WorkspacePlan = workspace.Plan
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// CountLinks counts the links whose column (owner_id or workspace_id) is id.
+// Links in the trash still count towards the periods they were created in.
+func (db *Database) CountLinks(ctx context.Context, column string, id int, now time.Time) (*LinkCounts, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	if column != "owner_id" && column != "workspace_id" {
+		return nil, fmt.Errorf("cannot count links by %q", column)
+	}
+	day, month := periodStarts(now)
+	query := `
+		SELECT
+			COUNT(*) FILTER (WHERE created_at >= $2),
+			COUNT(*) FILTER (WHERE created_at >= $3),
+			COUNT(*) FILTER (WHERE active AND deleted_at IS NULL)
+		FROM short_urls
+		WHERE ` + column + ` = $1`
+	counts := &LinkCounts{}
+	err := db.conn.QueryRowContext(ctx, query, id, day, month).Scan(&counts.Today, &counts.ThisMonth, &counts.Active)
+	return counts, err
+}
+
+// GetWorkspacePlan returns the plan of a workspace
+func (db *Database) GetWorkspacePlan(ctx context.Context, id int) (string, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	var plan string
+	err := db.conn.QueryRowContext(ctx, `SELECT plan FROM workspaces WHERE id = $1`, id).Scan(&plan)
+	return plan, err
+}
+
+// SetUserPlan moves a user to another plan
+func (db *Database) SetUserPlan(ctx context.Context, id int, plan string) (*User, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	query := `UPDATE users SET plan = $2, updated_at = NOW() WHERE id = $1 RETURNING ` + userColumns
+	return scanUser(db.conn.QueryRowContext(ctx, query, id, plan))
+}
+
+// SetWorkspacePlan moves a workspace to another plan
+func (db *Database) SetWorkspacePlan(ctx context.Context, id int, plan string) (*Workspace, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	workspace := &Workspace{}
+	err := db.conn.QueryRowContext(ctx, `UPDATE workspaces SET plan = $2 WHERE id = $1 RETURNING id, name, created_at, plan`, id, plan).
+		Scan(&workspace.ID, &workspace.Name, &workspace.CreatedAt, &workspace.Plan)
+	if err != nil {
+		return nil, err
+	}
+	return workspace, nil
+}
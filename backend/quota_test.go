@@ -0,0 +1,184 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPeriodStarts(t *testing.T) {
+	plus5 := time.FixedZone("UTC+5", 5*60*60)
+	tests := []struct {
+		name      string
+		now       time.Time
+		wantDay   time.Time
+		wantMonth time.Time
+	}{
+		{
+			"midday",
+			time.Date(2024, 3, 15, 12, 30, 0, 0, time.UTC),
+			time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC),
+			time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			"midnight",
+			time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			"last nanosecond of the year",
+			time.Date(2024, 12, 31, 23, 59, 59, 999999999, time.UTC),
+			time.Date(2024, 12, 31, 0, 0, 0, 0, time.UTC),
+			time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			"local time ahead of UTC",
+			time.Date(2024, 4, 1, 2, 0, 0, 0, plus5),
+			time.Date(2024, 3, 31, 0, 0, 0, 0, time.UTC),
+			time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			day, month := periodStarts(tt.now)
+			if !day.Equal(tt.wantDay) || !month.Equal(tt.wantMonth) {
+				t.Errorf("periodStarts = %v, %v, want %v, %v", day, month, tt.wantDay, tt.wantMonth)
+			}
+		})
+	}
+}
+
+func TestQuotaUsage(t *testing.T) {
+	counts := &LinkCounts{Today: 3, ThisMonth: 40, Active: 12}
+	tests := []struct {
+		name          string
+		now           time.Time
+		limits        QuotaConfig
+		wantLimits    map[string]int
+		wantNextDay   time.Time
+		wantNextMonth time.Time
+	}{
+		{
+			"unlimited",
+			time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC),
+			QuotaConfig{},
+			map[string]int{},
+			time.Date(2024, 3, 16, 0, 0, 0, 0, time.UTC),
+			time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			"all limited",
+			time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC),
+			QuotaConfig{LinksPerDay: 10, LinksPerMonth: 100, ActiveLinks: 50},
+			map[string]int{QuotaLinksPerDay: 10, QuotaLinksPerMonth: 100, QuotaActiveLinks: 50},
+			time.Date(2024, 3, 16, 0, 0, 0, 0, time.UTC),
+			time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			"only active links",
+			time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC),
+			QuotaConfig{ActiveLinks: 5},
+			map[string]int{QuotaActiveLinks: 5},
+			time.Date(2024, 3, 16, 0, 0, 0, 0, time.UTC),
+			time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			"end of a leap February",
+			time.Date(2024, 2, 29, 23, 0, 0, 0, time.UTC),
+			QuotaConfig{},
+			map[string]int{},
+			time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			"end of the year",
+			time.Date(2024, 12, 31, 18, 0, 0, 0, time.UTC),
+			QuotaConfig{},
+			map[string]int{},
+			time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			usage := quotaUsage(counts, tt.limits, tt.now)
+
+			used := map[string]int64{QuotaLinksPerDay: 3, QuotaLinksPerMonth: 40, QuotaActiveLinks: 12}
+			for quota, want := range used {
+				if got := usage[quota].Used; got != want {
+					t.Errorf("%s used = %d, want %d", quota, got, want)
+				}
+			}
+			for _, quota := range creationQuotas {
+				limit := usage[quota].Limit
+				want, limited := tt.wantLimits[quota]
+				switch {
+				case limited && (limit == nil || *limit != want):
+					t.Errorf("%s limit = %v, want %d", quota, limit, want)
+				case !limited && limit != nil:
+					t.Errorf("%s limit = %d, want unlimited", quota, *limit)
+				}
+			}
+
+			if r := usage[QuotaLinksPerDay].ResetsAt; r == nil || !r.Equal(tt.wantNextDay) {
+				t.Errorf("daily quota resets at %v, want %v", r, tt.wantNextDay)
+			}
+			if r := usage[QuotaLinksPerMonth].ResetsAt; r == nil || !r.Equal(tt.wantNextMonth) {
+				t.Errorf("monthly quota resets at %v, want %v", r, tt.wantNextMonth)
+			}
+			if r := usage[QuotaActiveLinks].ResetsAt; r != nil {
+				t.Errorf("active links quota resets at %v, want never", r)
+			}
+		})
+	}
+}
+
+func TestLoadQuotaPlans(t *testing.T) {
+	t.Setenv("USER_MAX_ACTIVE_LINKS", "100")
+	t.Setenv("WORKSPACE_MAX_LINKS_PER_DAY", "50")
+	t.Setenv("QUOTA_PLANS", "pro, team_plus, Bad-Name, free")
+	t.Setenv("PRO_USER_MAX_ACTIVE_LINKS", "1000")
+	t.Setenv("PRO_USER_MAX_LINKS_PER_MONTH", "5000")
+	t.Setenv("TEAM_PLUS_WORKSPACE_MAX_ACTIVE_LINKS", "20000")
+
+	plans := loadQuotaPlans()
+	want := map[string]QuotaPlan{
+		PlanFree:    {User: QuotaConfig{ActiveLinks: 100}, Workspace: QuotaConfig{LinksPerDay: 50}},
+		"pro":       {User: QuotaConfig{LinksPerMonth: 5000, ActiveLinks: 1000}},
+		"team_plus": {Workspace: QuotaConfig{ActiveLinks: 20000}},
+	}
+	if len(plans) != len(want) {
+		t.Errorf("loaded plans %v, want %v", plans, want)
+	}
+	for name, limits := range want {
+		if got, ok := plans[name]; !ok || got != limits {
+			t.Errorf("plan %q = %+v, want %+v", name, got, limits)
+		}
+	}
+}
+
+func TestQuotaPlan(t *testing.T) {
+	free := QuotaPlan{User: QuotaConfig{ActiveLinks: 10}}
+	pro := QuotaPlan{User: QuotaConfig{ActiveLinks: 1000}}
+	h := &Handlers{quotaPlans: map[string]QuotaPlan{PlanFree: free, "pro": pro}}
+	tests := []struct {
+		plan    string
+		want    QuotaPlan
+		wantErr bool
+	}{
+		{PlanFree, free, false},
+		{"pro", pro, false},
+		{"enterprise", free, true},
+		{"", free, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.plan, func(t *testing.T) {
+			if got := h.quotaPlan(tt.plan); got != tt.want {
+				t.Errorf("quotaPlan(%q) = %+v, want %+v", tt.plan, got, tt.want)
+			}
+			if err := h.ValidatePlan(tt.plan); (err != nil) != tt.wantErr {
+				t.Errorf("ValidatePlan(%q) = %v, want error %v", tt.plan, err, tt.wantErr)
+			}
+		})
+	}
+}
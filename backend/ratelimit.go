@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a fixed-window, in-memory limiter keyed by arbitrary strings
+type RateLimiter struct {
+	limit  int
+	window time.Duration
+
+	mu      sync.Mutex
+	windows map[string]*rateWindow
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// NewRateLimiter allows limit events per key in each window
+func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+	return &RateLimiter{limit: limit, window: window, windows: make(map[string]*rateWindow)}
+}
+
+// Allow records an event for key and reports whether it is within the limit
+func (l *RateLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.evict(now)
+	win, ok := l.windows[key]
+	if !ok || now.Sub(win.start) >= l.window {
+		win = &rateWindow{start: now}
+		l.windows[key] = win
+	}
+	win.count++
+	return win.count <= l.limit
+}
+
+// Reset forgets all events recorded for key
+func (l *RateLimiter) Reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.windows, key)
+}
+
+// evict drops expired windows so the map doesn't grow without bound
+func (l *RateLimiter) evict(now time.Time) {
+	if len(l.windows) < 10000 {
+		return
+	}
+	for key, win := range l.windows {
+		if now.Sub(win.start) >= l.window {
+			delete(l.windows, key)
+		}
+	}
+}
+
+// clientIP returns the IP address of the remote end of the connection
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
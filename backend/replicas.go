@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// PoolConfig tunes a database connection pool
+type PoolConfig struct {
+	// MaxOpenConns limits connections in use or idle; zero means unlimited
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+}
+
+// Validate checks the pool settings are usable
+func (c PoolConfig) Validate() error {
+	if c.MaxOpenConns < 0 || c.MaxIdleConns < 0 {
+		return fmt.Errorf("connection limits must not be negative, got %d open and %d idle", c.MaxOpenConns, c.MaxIdleConns)
+	}
+	if c.ConnMaxLifetime < 0 || c.ConnMaxIdleTime < 0 {
+		return fmt.Errorf("connection lifetimes must not be negative")
+	}
+	return nil
+}
+
+// Apply sets the pool settings on conn
+func (c PoolConfig) Apply(conn *sql.DB) {
+	conn.SetMaxOpenConns(c.MaxOpenConns)
+	conn.SetMaxIdleConns(c.MaxIdleConns)
+	conn.SetConnMaxLifetime(c.ConnMaxLifetime)
+	conn.SetConnMaxIdleTime(c.ConnMaxIdleTime)
+}
+
+// ReplicaConfig configures the read replicas
+type ReplicaConfig struct {
+	URLs []string
+	// MaxLag is how far behind the primary a replica may be and still serve reads
+	MaxLag        time.Duration
+	CheckInterval time.Duration
+}
+
+// Validate checks the replica settings are usable
+func (c ReplicaConfig) Validate() error {
+	if len(c.URLs) == 0 {
+		return nil
+	}
+	if c.MaxLag <= 0 {
+		return fmt.Errorf("max replica lag must be positive, got %s", c.MaxLag)
+	}
+	if c.CheckInterval <= 0 {
+		return fmt.Errorf("replica check interval must be positive, got %s", c.CheckInterval)
+	}
+	return nil
+}
+
+// replicaLagQuery measures how far a replica is behind. A replica that has
+// replayed everything it received counts as current even if the primary has
+// been idle, and a server that isn't in recovery is never behind.
+const replicaLagQuery = `
+	SELECT CASE
+		WHEN NOT pg_is_in_recovery() OR pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+		ELSE COALESCE(EXTRACT(EPOCH FROM NOW() - pg_last_xact_replay_timestamp()), 0)
+	END`
+
+// replica is a read replica and what its last health check found
+type replica struct {
+	name string
+	conn *sql.DB
+
+	mu      sync.Mutex
+	healthy bool
+	lag     time.Duration
+}
+
+// ReplicaStatus describes a replica for the metrics endpoint
+type ReplicaStatus struct {
+	Name    string
+	Healthy bool
+	Lag     time.Duration
+}
+
+// replicaName identifies a replica in logs without the credentials in its DSN
+func replicaName(i int, dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return fmt.Sprintf("replica-%d", i+1)
+}
+
+// SetReplicas routes reads that tolerate lag to conns, keyed by their DSNs.
+// Replicas serve nothing until MonitorReplicas finds them healthy.
+func (db *Database) SetReplicas(dsns []string, conns []*sql.DB, maxLag time.Duration) {
+	db.replicas = nil
+	for i, conn := range conns {
+		db.replicas = append(db.replicas, &replica{name: replicaName(i, dsns[i]), conn: conn})
+	}
+	db.maxReplicaLag = maxLag
+}
+
+// MonitorReplicas checks the replicas now and then every interval until ctx is
+// cancelled
+func (db *Database) MonitorReplicas(ctx context.Context, interval time.Duration) {
+	if len(db.replicas) == 0 {
+		return
+	}
+	db.checkReplicas(ctx)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				db.checkReplicas(ctx)
+			}
+		}
+	}()
+}
+
+// checkReplicas measures each replica's lag and decides whether it may serve reads
+func (db *Database) checkReplicas(ctx context.Context) {
+	for _, rep := range db.replicas {
+		queryCtx, cancel := db.queryContext(ctx)
+		var seconds float64
+		err := rep.conn.QueryRowContext(queryCtx, replicaLagQuery).Scan(&seconds)
+		cancel()
+
+		lag := time.Duration(seconds * float64(time.Second))
+		if err == nil && lag > db.maxReplicaLag {
+			err = fmt.Errorf("%s behind the primary", lag.Round(time.Millisecond))
+		}
+		rep.mu.Lock()
+		rep.lag = lag
+		rep.mu.Unlock()
+		rep.setHealth(err == nil, err)
+	}
+}
+
+// setHealth records whether the replica may serve reads, logging changes
+func (rep *replica) setHealth(healthy bool, err error) {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	if healthy != rep.healthy {
+		if healthy {
+			log.Printf("Read replica %s is healthy", rep.name)
+		} else {
+			log.Printf("Read replica %s is unhealthy, reading from the primary: %v", rep.name, err)
+		}
+	}
+	rep.healthy = healthy
+}
+
+// isHealthy reports whether the replica may serve reads
+func (rep *replica) isHealthy() bool {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	return rep.healthy
+}
+
+// PoolStats reports on the primary's connection pool
+func (db *Database) PoolStats() sql.DBStats {
+	return db.conn.Stats()
+}
+
+// ReplicaStatuses reports each replica's last health check
+func (db *Database) ReplicaStatuses() []ReplicaStatus {
+	statuses := make([]ReplicaStatus, 0, len(db.replicas))
+	for _, rep := range db.replicas {
+		rep.mu.Lock()
+		statuses = append(statuses, ReplicaStatus{Name: rep.name, Healthy: rep.healthy, Lag: rep.lag})
+		rep.mu.Unlock()
+	}
+	return statuses
+}
+
+// pickReplica returns the next healthy replica in turn, or nil if there is none
+func (db *Database) pickReplica() *replica {
+	n := len(db.replicas)
+	start := int(db.nextReplica.Add(1) % uint64(max(n, 1)))
+	for i := 0; i < n; i++ {
+		if rep := db.replicas[(start+i)%n]; rep.isHealthy() {
+			return rep
+		}
+	}
+	return nil
+}
+
+// readReplica runs read against a healthy replica, or the primary if there is
+// none. If the replica fails, read is retried on the primary; that includes
+// sql.ErrNoRows, since rows just written may not have replicated yet. Any other
+// failure takes the replica out of rotation until its next health check,
+// unless it was caused by the caller's context ending.
+func (db *Database) readReplica(ctx context.Context, read func(conn *sql.DB) error) error {
+	rep := db.pickReplica()
+	if rep == nil {
+		return read(db.conn)
+	}
+	err := read(rep.conn)
+	if err == nil {
+		return nil
+	}
+	if err != sql.ErrNoRows && ctx.Err() == nil {
+		rep.setHealth(false, err)
+	}
+	if ctx.Err() != nil {
+		return err
+	}
+	return read(db.conn)
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Revision actions
+const (
+	RevisionCreate   = "create"
+	RevisionEdit     = "edit"
+	RevisionRollback = "rollback"
+)
+
+// LinkState holds the mutable fields of a short URL, as captured by a revision.
+// Revisions only keep the hash of the link's current password: once it is
+// removed or replaced, older hashes are dropped and PasswordRedacted is set.
+type LinkState struct {
+	OriginalURL  string     `json:"original_url"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+	ActivatesAt  *time.Time `json:"activates_at"`
+	Interstitial bool       `json:"interstitial"`
+	MaxClicks    *int       `json:"max_clicks"`
+	PrelaunchURL *string    `json:"prelaunch_url"`
+	ExpiredURL   *string    `json:"expired_url"`
+	RedirectType *int       `json:"redirect_type"`
+	PasswordHash *string    `json:"password_hash,omitempty"`
+	// PasswordRedacted marks a state whose password hash was dropped
+	PasswordRedacted bool `json:"password_redacted,omitempty"`
+}
+
+// stateOf returns the mutable fields of shortURL
+func stateOf(shortURL *ShortURL) LinkState {
+	return LinkState{
+		OriginalURL:  shortURL.OriginalURL,
+		ExpiresAt:    shortURL.ExpiresAt,
+		ActivatesAt:  shortURL.ActivatesAt,
+		Interstitial: shortURL.Interstitial,
+		MaxClicks:    shortURL.MaxClicks,
+		PrelaunchURL: shortURL.PrelaunchURL,
+		ExpiredURL:   shortURL.ExpiredURL,
+		RedirectType: shortURL.RedirectType,
+		PasswordHash: shortURL.PasswordHash,
+	}
+}
+
+// apply copies the state onto shortURL
+func (s LinkState) apply(shortURL *ShortURL) {
+	shortURL.OriginalURL = s.OriginalURL
+	shortURL.ExpiresAt = s.ExpiresAt
+	shortURL.ActivatesAt = s.ActivatesAt
+	shortURL.Interstitial = s.Interstitial
+	shortURL.MaxClicks = s.MaxClicks
+	shortURL.PrelaunchURL = s.PrelaunchURL
+	shortURL.ExpiredURL = s.ExpiredURL
+	shortURL.RedirectType = s.RedirectType
+	shortURL.PasswordHash = s.PasswordHash
+}
+
+// publicState is a LinkState safe to return from the API
+type publicState struct {
+	LinkState
+	PasswordHash *string `json:"password_hash,omitempty"` // shadows the hash so it is never encoded
+	HasPassword  bool    `json:"has_password"`
+}
+
+func (s LinkState) public() publicState {
+	return publicState{LinkState: s, HasPassword: s.PasswordHash != nil || s.PasswordRedacted}
+}
+
+// FieldChange is one changed field in a revision
+type FieldChange struct {
+	From any `json:"from"`
+	To   any `json:"to"`
+}
+
+// diffStates returns the fields that differ between two states, keyed by JSON name.
+// Password hashes are never included, only whether a password is set or changed.
+func diffStates(before, after LinkState) map[string]FieldChange {
+	changes := diffJSON(before.public(), after.public())
+	if before.PasswordHash != nil && after.PasswordHash != nil && *before.PasswordHash != *after.PasswordHash {
+		changes["password"] = FieldChange{From: "set", To: "changed"}
+	}
+	return changes
+}
+
+// jsonValue round-trips v through JSON so values compare the way clients see them
+func jsonValue(v any) any {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var out any
+	json.Unmarshal(data, &out)
+	return out
+}
+
+// LinkRevision is one recorded change to a link
+type LinkRevision struct {
+	ID        int                    `json:"id"`
+	LinkID    int                    `json:"link_id"`
+	Revision  int                    `json:"revision"`
+	Action    string                 `json:"action"`
+	ActorID   *int                   `json:"actor_id"`
+	Actor     *string                `json:"actor,omitempty"`
+	State     LinkState              `json:"-"`
+	Changes   map[string]FieldChange `json:"changes"`
+	CreatedAt time.Time              `json:"created_at"`
+}
+
+// MarshalJSON encodes the revision with its public state
+func (rev *LinkRevision) MarshalJSON() ([]byte, error) {
+	type revision LinkRevision
+	return json.Marshal(struct {
+		*revision
+		State publicState `json:"state"`
+	}{(*revision)(rev), rev.State.public()})
+}
+
+// optional is a JSON field that distinguishes absent from null
+type optional[T any] struct {
+	Set   bool
+	Value *T
+}
+
+// UnmarshalJSON records that the field was present and decodes it, keeping null as nil
+func (o *optional[T]) UnmarshalJSON(data []byte) error {
+	o.Set = true
+	if bytes.Equal(data, []byte("null")) {
+		o.Value = nil
+		return nil
+	}
+	o.Value = new(T)
+	return json.Unmarshal(data, o.Value)
+}
+
+// UpdateLinkRequest represents the request body for editing a link.
+// Absent fields are left unchanged; null clears a field.
+type UpdateLinkRequest struct {
+	URL          optional[string]    `json:"url"`
+	ExpiresAt    optional[time.Time] `json:"expires_at"`
+	ActivatesAt  optional[time.Time] `json:"activates_at"`
+	Interstitial optional[bool]      `json:"interstitial"`
+	MaxClicks    optional[int]       `json:"max_clicks"`
+	PrelaunchURL optional[string]    `json:"prelaunch_url"`
+	ExpiredURL   optional[string]    `json:"expired_url"`
+	RedirectType optional[int]       `json:"redirect_type"`
+	Password     optional[string]    `json:"password"`
+}
+
+// UpdateLink handles PATCH /api/links/{code}
+func (h *Handlers) UpdateLink(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("UpdateLink called")
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+	shortURL, ok := h.accessibleLink(w, r, user, WorkspaceEditor)
+	if !ok {
+		return
+	}
+
+	var req UpdateLinkRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	state := stateOf(shortURL)
+	if req.URL.Set {
+		if req.URL.Value == nil || *req.URL.Value == "" {
+			writeError(w, r, http.StatusBadRequest, ProblemInvalidRequest, "URL is required")
+			return
+		}
+		state.OriginalURL = NormalizeURL(*req.URL.Value)
+	}
+	if req.ExpiresAt.Set {
+		state.ExpiresAt = utcTime(req.ExpiresAt.Value)
+	}
+	if req.ActivatesAt.Set {
+		state.ActivatesAt = utcTime(req.ActivatesAt.Value)
+	}
+	if req.Interstitial.Set {
+		state.Interstitial = req.Interstitial.Value != nil && *req.Interstitial.Value
+	}
+	if req.MaxClicks.Set {
+		if req.MaxClicks.Value != nil && *req.MaxClicks.Value < 1 {
+			writeError(w, r, http.StatusBadRequest, ProblemInvalidRequest, "max_clicks must be at least 1")
+			return
+		}
+		state.MaxClicks = req.MaxClicks.Value
+	}
+	if req.RedirectType.Set {
+		if req.RedirectType.Value != nil && !validRedirectType(*req.RedirectType.Value) {
+			writeError(w, r, http.StatusBadRequest, ProblemInvalidRequest, "redirect_type must be 301, 302, 307 or 308")
+			return
+		}
+		state.RedirectType = req.RedirectType.Value
+	}
+	for _, fallback := range []struct {
+		name   string
+		field  optional[string]
+		target **string
+	}{
+		{"prelaunch_url", req.PrelaunchURL, &state.PrelaunchURL},
+		{"expired_url", req.ExpiredURL, &state.ExpiredURL},
+	} {
+		if !fallback.field.Set {
+			continue
+		}
+		if fallback.field.Value == nil || *fallback.field.Value == "" {
+			*fallback.target = nil
+			continue
+		}
+		normalized := NormalizeURL(*fallback.field.Value)
+		if !ValidateURL(normalized) {
+			writeError(w, r, http.StatusBadRequest, ProblemInvalidRequest, "Invalid "+fallback.name)
+			return
+		}
+		*fallback.target = &normalized
+	}
+	if req.Password.Set {
+		state.PasswordHash = nil
+		if req.Password.Value != nil && *req.Password.Value != "" {
+			hashedPassword, err := bcrypt.GenerateFromPassword([]byte(*req.Password.Value), bcrypt.DefaultCost)
+			if err != nil {
+				fmt.Println("Error hashing link password:", err)
+				if err == bcrypt.ErrPasswordTooLong {
+					writeError(w, r, http.StatusBadRequest, ProblemInvalidRequest, "Password must be at most 72 bytes")
+				} else {
+					writeError(w, r, http.StatusInternalServerError, ProblemInternal, "Failed to update link")
+				}
+				return
+			}
+			hash := string(hashedPassword)
+			state.PasswordHash = &hash
+		}
+	}
+	if state.ActivatesAt != nil && state.ExpiresAt != nil && !state.ExpiresAt.After(*state.ActivatesAt) {
+		writeError(w, r, http.StatusBadRequest, ProblemInvalidRequest, "expires_at must be after activates_at")
+		return
+	}
+
+	h.saveLinkState(w, r, shortURL, state, user, RevisionEdit)
+}
+
+// ListRevisions handles GET /api/links/{code}/revisions
+func (h *Handlers) ListRevisions(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("ListRevisions called")
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+	shortURL, ok := h.accessibleLink(w, r, user, WorkspaceViewer)
+	if !ok {
+		return
+	}
+
+	revisions, err := h.db.ListRevisions(r.Context(), shortURL.ID)
+	if err != nil {
+		fmt.Println("Database error listing revisions:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	writeJSON(w, http.StatusOK, revisions)
+}
+
+// RollbackLink handles POST /api/links/{code}/revisions/{revision}/rollback.
+// The link is restored to the state captured by that revision, recorded as a new revision.
+func (h *Handlers) RollbackLink(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("RollbackLink called")
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+	shortURL, ok := h.accessibleLink(w, r, user, WorkspaceEditor)
+	if !ok {
+		return
+	}
+
+	number, err := strconv.Atoi(mux.Vars(r)["revision"])
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ProblemInvalidRequest, "Invalid revision number")
+		return
+	}
+	revision, err := h.db.GetRevision(r.Context(), shortURL.ID, number)
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, ProblemNotFound, "Revision not found")
+		return
+	}
+	if err != nil {
+		fmt.Println("Database error looking up revision:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+
+	// A dropped password can't be restored, so the link keeps its current one
+	state := revision.State
+	if state.PasswordRedacted {
+		if shortURL.PasswordHash == nil {
+			writeError(w, r, http.StatusConflict, ProblemConflict, "This revision's password was removed; set a new password on the link first")
+			return
+		}
+		state.PasswordHash = shortURL.PasswordHash
+		state.PasswordRedacted = false
+	}
+
+	h.saveLinkState(w, r, shortURL, state, user, RevisionRollback)
+}
+
+// saveLinkState applies state to the link, records the revision and writes the updated link
+func (h *Handlers) saveLinkState(w http.ResponseWriter, r *http.Request, shortURL *ShortURL, state LinkState, actor *User, action string) {
+	if len(diffStates(stateOf(shortURL), state)) == 0 {
+		writeJSON(w, http.StatusOK, shortURL)
+		return
+	}
+
+	// Editing an expired link back to life makes it count as active again
+	reactivates := !shortURL.Active && shortURL.DeletedAt == nil && (state.ExpiresAt == nil || state.ExpiresAt.After(time.Now()))
+	if reactivates && !h.enforceQuotas(w, r, actor, shortURL.WorkspaceID, QuotaActiveLinks) {
+		return
+	}
+
+	updated, err := h.db.UpdateLinkState(r.Context(), shortURL.ID, state, &actor.ID, action)
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, ProblemNotFound, "Link not found")
+		return
+	}
+	if err != nil {
+		fmt.Println("Database error updating link:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	fmt.Println("Updated link:", updated.ShortCode)
+	auditAction := AuditLinkUpdate
+	if action == RevisionRollback {
+		auditAction = AuditLinkRollback
+	}
+	h.audit(r, actor, auditAction, "link", updated.ShortCode, shortURL, updated)
+	writeJSON(w, http.StatusOK, updated)
+}
+
+// utcTime returns a copy of t in UTC, or nil
+func utcTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	utc := t.UTC()
+	return &utc
+}
+
+// CreateRevisionTable creates the link_revisions table if it doesn't exist and drops
+// password hashes from revisions that aren't their link's current one. Older
+// tables get the foreign key to short_urls, after dropping the revisions of
+// links that are already gone.
+func (db *Database) CreateRevisionTable(ctx context.Context) error {
+	fmt.Println("CreateRevisionTable called")
+	query := `
+		CREATE TABLE IF NOT EXISTS link_revisions (
+			id SERIAL PRIMARY KEY,
+			link_id INTEGER NOT NULL REFERENCES short_urls(id) ON DELETE CASCADE,
+			revision INTEGER NOT NULL,
+			action VARCHAR(20) NOT NULL,
+			actor_id INTEGER,
+			state JSONB NOT NULL,
+			changes JSONB NOT NULL DEFAULT '{}',
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			UNIQUE (link_id, revision)
+		);
+		DO $$
+		BEGIN
+			IF NOT EXISTS (SELECT 1 FROM information_schema.table_constraints
+				WHERE table_schema = current_schema() AND table_name = 'link_revisions'
+					AND constraint_name = 'link_revisions_link_id_fkey') THEN
+				DELETE FROM link_revisions r WHERE NOT EXISTS (SELECT 1 FROM short_urls s WHERE s.id = r.link_id);
+				ALTER TABLE link_revisions ADD CONSTRAINT link_revisions_link_id_fkey
+					FOREIGN KEY (link_id) REFERENCES short_urls(id) ON DELETE CASCADE;
+			END IF;
+		END;
+		$$;
+
+		UPDATE link_revisions r SET state = (r.state - 'password_hash') || '{"password_redacted": true}'
+		WHERE r.state ? 'password_hash' AND NOT EXISTS (
+			SELECT 1 FROM short_urls s WHERE s.id = r.link_id AND s.password_hash = r.state->>'password_hash'
+		);
+	`
+
+	_, err := db.conn.ExecContext(ctx, query)
+	return err
+}
+
+// UpdateLinkState saves new mutable fields for a link and records the change as a
+// revision in the same transaction. The first edit also records the link's
+// original state as revision 1 so it can be rolled back to.
+func (db *Database) UpdateLinkState(ctx context.Context, id int, state LinkState, actorID *int, action string) (*ShortURL, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	current, err := scanShortURL(tx.QueryRowContext(ctx, `SELECT `+shortURLColumns+` FROM short_urls WHERE id = $1 FOR UPDATE`, id))
+	if err != nil {
+		return nil, err
+	}
+	before := stateOf(current)
+
+	var latest int
+	if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(revision), 0) FROM link_revisions WHERE link_id = $1`, id).Scan(&latest); err != nil {
+		return nil, err
+	}
+	if latest == 0 {
+		if err := insertRevision(ctx, tx, id, 1, RevisionCreate, current.OwnerID, before, nil, current.CreatedAt); err != nil {
+			return nil, err
+		}
+		latest = 1
+	}
+
+	// A changed destination or redirect type, new access rules or an expiry
+	// invalidate the dedup key, and a new expiry in the future brings back a
+	// link the janitor deactivated
+	updated := *current
+	state.apply(&updated)
+	clearDedup := dedupVariant(&updated) != dedupVariant(current) || !updated.isPlain()
+	reactivate := updated.ExpiresAt == nil || updated.ExpiresAt.After(time.Now())
+
+	query := `
+		UPDATE short_urls SET
+			original_url = $2, expires_at = $3, activates_at = $4, interstitial = $5, max_clicks = $6,
+			prelaunch_url = $7, expired_url = $8, redirect_type = $9, password_hash = $10,
+			dedup_key = CASE WHEN $11 THEN NULL ELSE dedup_key END,
+			active = active OR $12,
+			deactivated_at = CASE WHEN $12 THEN NULL ELSE deactivated_at END
+		WHERE id = $1
+		RETURNING ` + shortURLColumns
+	result, err := scanShortURL(tx.QueryRowContext(ctx, query, id, state.OriginalURL, state.ExpiresAt, state.ActivatesAt, state.Interstitial,
+		state.MaxClicks, state.PrelaunchURL, state.ExpiredURL, state.RedirectType, state.PasswordHash, clearDedup, reactivate))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := insertRevision(ctx, tx, id, latest+1, action, actorID, state, diffStates(before, state), time.Now()); err != nil {
+		return nil, err
+	}
+	if before.PasswordHash != nil && (state.PasswordHash == nil || *state.PasswordHash != *before.PasswordHash) {
+		if err := redactPasswordHashes(ctx, tx, id, state.PasswordHash); err != nil {
+			return nil, err
+		}
+	}
+	return result, tx.Commit()
+}
+
+// redactPasswordHashes drops every password hash but current from a link's revisions inside tx
+func redactPasswordHashes(ctx context.Context, tx *sql.Tx, linkID int, current *string) error {
+	_, err := tx.ExecContext(ctx, `
+		UPDATE link_revisions SET state = (state - 'password_hash') || '{"password_redacted": true}'
+		WHERE link_id = $1 AND state ? 'password_hash' AND state->>'password_hash' IS DISTINCT FROM $2`,
+		linkID, current)
+	return err
+}
+
+// insertRevision records a revision inside tx
+func insertRevision(ctx context.Context, tx *sql.Tx, linkID, revision int, action string, actorID *int, state LinkState, changes map[string]FieldChange, at time.Time) error {
+	stateJSON, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if changes == nil {
+		changes = map[string]FieldChange{}
+	}
+	changesJSON, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO link_revisions (link_id, revision, action, actor_id, state, changes, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		linkID, revision, action, actorID, stateJSON, changesJSON, at)
+	return err
+}
+
+// revisionColumns lists the link_revisions columns in the order scanRevision reads them
+const revisionColumns = `r.id, r.link_id, r.revision, r.action, r.actor_id, u.user_id, r.state, r.changes, r.created_at`
+
+// scanRevision reads a row selected with revisionColumns
+func scanRevision(row rowScanner) (*LinkRevision, error) {
+	rev := &LinkRevision{}
+	var state, changes []byte
+	if err := row.Scan(&rev.ID, &rev.LinkID, &rev.Revision, &rev.Action, &rev.ActorID, &rev.Actor, &state, &changes, &rev.CreatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(state, &rev.State); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(changes, &rev.Changes); err != nil {
+		return nil, err
+	}
+	return rev, nil
+}
+
+// ListRevisions returns a link's revisions, newest first
+func (db *Database) ListRevisions(ctx context.Context, linkID int) ([]*LinkRevision, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	query := `SELECT ` + revisionColumns + ` FROM link_revisions r LEFT JOIN users u ON u.id = r.actor_id
+		WHERE r.link_id = $1 ORDER BY r.revision DESC`
+	rows, err := db.conn.QueryContext(ctx, query, linkID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []*LinkRevision{}
+	for rows.Next() {
+		rev, err := scanRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+	return revisions, rows.Err()
+}
+
+// GetRevision retrieves one revision of a link
+func (db *Database) GetRevision(ctx context.Context, linkID, revision int) (*LinkRevision, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	query := `SELECT ` + revisionColumns + ` FROM link_revisions r LEFT JOIN users u ON u.id = r.actor_id
+		WHERE r.link_id = $1 AND r.revision = $2`
+	return scanRevision(db.conn.QueryRowContext(ctx, query, linkID, revision))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLinkStateRoundTrip(t *testing.T) {
+	expires := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	link := &ShortURL{
+		ID:           7,
+		ShortCode:    "abc123",
+		OriginalURL:  "https://example.com",
+		ExpiresAt:    &expires,
+		Interstitial: true,
+		MaxClicks:    intPtr(3),
+		ExpiredURL:   stringPtr("https://example.com/gone"),
+		RedirectType: intPtr(307),
+		PasswordHash: stringPtr("hash"),
+	}
+	state := stateOf(link)
+
+	restored := &ShortURL{ID: 7, ShortCode: "abc123", OriginalURL: "https://example.org"}
+	state.apply(restored)
+	if !reflect.DeepEqual(restored, link) {
+		t.Errorf("apply(stateOf(link)) = %+v, want %+v", restored, link)
+	}
+}
+
+func TestDiffStates(t *testing.T) {
+	base := LinkState{OriginalURL: "https://example.com", MaxClicks: intPtr(3)}
+	with := func(change func(*LinkState)) LinkState {
+		s := base
+		change(&s)
+		return s
+	}
+	tests := []struct {
+		name   string
+		before LinkState
+		after  LinkState
+		want   map[string]FieldChange
+	}{
+		{"unchanged", base, base, map[string]FieldChange{}},
+		{
+			"destination",
+			base,
+			with(func(s *LinkState) { s.OriginalURL = "https://example.org" }),
+			map[string]FieldChange{"original_url": {From: "https://example.com", To: "https://example.org"}},
+		},
+		{
+			"click limit removed",
+			base,
+			with(func(s *LinkState) { s.MaxClicks = nil }),
+			map[string]FieldChange{"max_clicks": {From: float64(3), To: nil}},
+		},
+		{
+			"password set",
+			base,
+			with(func(s *LinkState) { s.PasswordHash = stringPtr("hash") }),
+			map[string]FieldChange{"has_password": {From: false, To: true}},
+		},
+		{
+			"password changed",
+			with(func(s *LinkState) { s.PasswordHash = stringPtr("old") }),
+			with(func(s *LinkState) { s.PasswordHash = stringPtr("new") }),
+			map[string]FieldChange{"password": {From: "set", To: "changed"}},
+		},
+		{
+			"password removed",
+			with(func(s *LinkState) { s.PasswordHash = stringPtr("hash") }),
+			base,
+			map[string]FieldChange{"has_password": {From: true, To: false}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := diffStates(tt.before, tt.after)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffStates = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRevisionJSONHidesPasswordHash(t *testing.T) {
+	rev := &LinkRevision{
+		LinkID:   7,
+		Revision: 2,
+		Action:   "update",
+		State:    LinkState{OriginalURL: "https://example.com", PasswordHash: stringPtr("$2a$10$secret")},
+	}
+	data, err := json.Marshal(rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "secret") || strings.Contains(string(data), "password_hash") {
+		t.Errorf("revision JSON %s includes the password hash", data)
+	}
+	if !strings.Contains(string(data), `"has_password":true`) {
+		t.Errorf("revision JSON %s does not report the password", data)
+	}
+}
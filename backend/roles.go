@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// User roles, from least to most privileged
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// roleRank orders roles so a higher role includes the permissions of lower ones
+var roleRank = map[string]int{
+	RoleUser:      0,
+	RoleModerator: 1,
+	RoleAdmin:     2,
+}
+
+// ErrAccountDisabled is returned when a disabled user tries to authenticate
+var ErrAccountDisabled = errors.New("account disabled")
+
+// ValidateRole checks that role is a known role
+func ValidateRole(role string) error {
+	if _, ok := roleRank[role]; !ok {
+		return fmt.Errorf("unknown role %q", role)
+	}
+	return nil
+}
+
+// hasRole reports whether user has role or a more privileged one
+func hasRole(user *User, role string) bool {
+	rank, ok := roleRank[user.Role]
+	return ok && rank >= roleRank[role]
+}
+
+type contextKey string
+
+// userContextKey holds the *User authorized by RequireRole
+const userContextKey contextKey = "user"
+
+// currentUser returns the user authorized by RequireRole
+func currentUser(r *http.Request) *User {
+	user, _ := r.Context().Value(userContextKey).(*User)
+	return user
+}
+
+// RequireRole wraps next so it only runs for authenticated users with at least role.
+// The user is available to next through currentUser.
+func (h *Handlers) RequireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := h.requireUser(w, r)
+		if !ok {
+			return
+		}
+		if !hasRole(user, role) {
+			fmt.Printf("User %s with role %s denied %s access to %s\n", user.UserID, user.Role, role, r.URL.Path)
+			writeError(w, r, http.StatusForbidden, ProblemForbidden, "Insufficient permissions")
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), userContextKey, user)))
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestHasRole(t *testing.T) {
+	tests := []struct {
+		role string
+		need string
+		want bool
+	}{
+		{RoleUser, RoleUser, true},
+		{RoleUser, RoleModerator, false},
+		{RoleUser, RoleAdmin, false},
+		{RoleModerator, RoleUser, true},
+		{RoleModerator, RoleModerator, true},
+		{RoleModerator, RoleAdmin, false},
+		{RoleAdmin, RoleUser, true},
+		{RoleAdmin, RoleModerator, true},
+		{RoleAdmin, RoleAdmin, true},
+		{"", RoleUser, false},
+		{"superuser", RoleUser, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.role+"/"+tt.need, func(t *testing.T) {
+			if got := hasRole(&User{Role: tt.role}, tt.need); got != tt.want {
+				t.Errorf("hasRole(%q, %q) = %v, want %v", tt.role, tt.need, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateRole(t *testing.T) {
+	tests := []struct {
+		role    string
+		wantErr bool
+	}{
+		{RoleUser, false},
+		{RoleModerator, false},
+		{RoleAdmin, false},
+		{"", true},
+		{"Admin", true},
+		{"owner", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.role, func(t *testing.T) {
+			if err := ValidateRole(tt.role); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateRole(%q) = %v, want error %v", tt.role, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// sessionTouchInterval limits how often a session's last_seen_at is updated
+const sessionTouchInterval = time.Minute
+
+// Session is a logged-in device. The bearer token is only ever stored as a hash.
+type Session struct {
+	ID         int       `json:"id"`
+	UserID     int       `json:"-"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	// Current marks the session making the request
+	Current bool `json:"current"`
+}
+
+// hashSessionToken returns the form of a session token stored in the database
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// startSession creates a session for user on the requesting device and returns its bearer token
+func (h *Handlers) startSession(r *http.Request, user *User) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	session := &Session{
+		UserID:    user.ID,
+		UserAgent: r.UserAgent(),
+		IP:        clientIP(r),
+		ExpiresAt: time.Now().Add(h.sessionTTL),
+	}
+	if err := h.db.CreateSession(r.Context(), session, hashSessionToken(token)); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Logout handles POST /api/logout, ending the current session
+func (h *Handlers) Logout(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Logout called")
+	user, session, err := h.authenticateSession(r)
+	if err != nil {
+		writeAuthError(w, r, err)
+		return
+	}
+	if session == nil {
+		writeError(w, r, http.StatusUnauthorized, ProblemAuthRequired, "Authentication required")
+		return
+	}
+
+	err = h.db.DeleteSession(r.Context(), user.ID, session.ID)
+	if err == sql.ErrNoRows {
+		// A concurrent logout or revocation already ended it
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err != nil {
+		fmt.Println("Database error ending session:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	h.audit(r, user, AuditLogout, "session", strconv.Itoa(session.ID), nil, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// LogoutAll handles POST /api/logout/all, ending every session of the user including this one
+func (h *Handlers) LogoutAll(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("LogoutAll called")
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	if _, err := h.db.DeleteUserSessions(r.Context(), user.ID); err != nil {
+		fmt.Println("Database error ending sessions:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	h.audit(r, user, AuditLogoutAll, "user", user.UserID, nil, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListSessions handles GET /api/sessions
+func (h *Handlers) ListSessions(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("ListSessions called")
+	user, current, err := h.authenticate(r)
+	if err != nil {
+		writeAuthError(w, r, err)
+		return
+	}
+	if user == nil {
+		writeError(w, r, http.StatusUnauthorized, ProblemAuthRequired, "Authentication required")
+		return
+	}
+
+	sessions, err := h.db.ListSessions(r.Context(), user.ID)
+	if err != nil {
+		fmt.Println("Database error listing sessions:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	for _, session := range sessions {
+		session.Current = session.ID == current.ID
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+// RevokeSession handles DELETE /api/sessions/{sessionID}
+func (h *Handlers) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("RevokeSession called")
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["sessionID"])
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, ProblemNotFound, "Session not found")
+		return
+	}
+
+	err = h.db.DeleteSession(r.Context(), user.ID, id)
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, ProblemNotFound, "Session not found")
+		return
+	}
+	if err != nil {
+		fmt.Println("Database error revoking session:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	h.audit(r, user, AuditSessionRevoke, "session", strconv.Itoa(id), nil, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CreateSessionTable creates the sessions table if it doesn't exist
+func (db *Database) CreateSessionTable(ctx context.Context) error {
+	fmt.Println("CreateSessionTable called")
+	query := `
+		CREATE TABLE IF NOT EXISTS sessions (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			token_hash CHAR(64) UNIQUE NOT NULL,
+			user_agent TEXT NOT NULL DEFAULT '',
+			ip VARCHAR(45) NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			last_seen_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			expires_at TIMESTAMPTZ NOT NULL
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id);
+		CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions(expires_at);
+	`
+
+	_, err := db.conn.ExecContext(ctx, query)
+	return err
+}
+
+// sessionColumns lists the sessions columns in the order scanSession reads them
+const sessionColumns = `s.id, s.user_id, s.user_agent, s.ip, s.created_at, s.last_seen_at, s.expires_at`
+
+// scanSession reads a row selected with sessionColumns
+func scanSession(row rowScanner) (*Session, error) {
+	session := &Session{}
+	err := row.Scan(&session.ID, &session.UserID, &session.UserAgent, &session.IP,
+		&session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// CreateSession stores a new session under the hash of its token
+func (db *Database) CreateSession(ctx context.Context, session *Session, tokenHash string) error {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	query := `
+		INSERT INTO sessions (user_id, token_hash, user_agent, ip, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at, last_seen_at`
+	return db.conn.QueryRowContext(ctx, query, session.UserID, tokenHash, session.UserAgent, session.IP, session.ExpiresAt).
+		Scan(&session.ID, &session.CreatedAt, &session.LastSeenAt)
+}
+
+// GetSession returns the unexpired session with the token hash, recording that it was just used
+func (db *Database) GetSession(ctx context.Context, tokenHash string) (*Session, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	query := `SELECT ` + sessionColumns + ` FROM sessions s WHERE s.token_hash = $1 AND s.expires_at > NOW()`
+	session, err := scanSession(db.conn.QueryRowContext(ctx, query, tokenHash))
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Since(session.LastSeenAt) > sessionTouchInterval {
+		if _, err := db.conn.ExecContext(ctx, `UPDATE sessions SET last_seen_at = NOW() WHERE id = $1`, session.ID); err != nil {
+			fmt.Println("Error updating session last seen:", err)
+		}
+	}
+	return session, nil
+}
+
+// ListSessions returns a user's unexpired sessions, most recently used first
+func (db *Database) ListSessions(ctx context.Context, userID int) ([]*Session, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	query := `SELECT ` + sessionColumns + ` FROM sessions s WHERE s.user_id = $1 AND s.expires_at > NOW() ORDER BY s.last_seen_at DESC`
+	rows, err := db.conn.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// DeleteSession ends one of a user's sessions, returning sql.ErrNoRows if they have no such session
+func (db *Database) DeleteSession(ctx context.Context, userID, id int) error {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	result, err := db.conn.ExecContext(ctx, `DELETE FROM sessions WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteUserSessions ends every session of a user
+func (db *Database) DeleteUserSessions(ctx context.Context, userID int) (int64, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	result, err := db.conn.ExecContext(ctx, `DELETE FROM sessions WHERE user_id = $1`, userID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// PurgeExpiredSessions removes sessions past their expiry
+func (db *Database) PurgeExpiredSessions(ctx context.Context) (int64, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	result, err := db.conn.ExecContext(ctx, `DELETE FROM sessions WHERE expires_at < NOW()`)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
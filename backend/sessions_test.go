@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestHashSessionToken(t *testing.T) {
+	tests := []struct {
+		token string
+		want  string
+	}{
+		{"", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{"abc", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.token, func(t *testing.T) {
+			if got := hashSessionToken(tt.token); got != tt.want {
+				t.Errorf("hashSessionToken(%q) = %s, want %s", tt.token, got, tt.want)
+			}
+		})
+	}
+}
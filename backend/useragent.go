@@ -0,0 +1,131 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Device types of a click
+const (
+	DeviceDesktop = "desktop"
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceBot     = "bot"
+)
+
+// unknownDimension names a browser or OS the parser doesn't recognize
+const unknownDimension = "Other"
+
+// UserAgent is what a User-Agent header says about the visitor's software.
+// Versions are major versions only, or empty if unknown.
+type UserAgent struct {
+	Browser        string
+	BrowserVersion string
+	OS             string
+	OSVersion      string
+	DeviceType     string
+}
+
+// uaRule recognizes one browser or OS. The first submatch of pattern, if any,
+// is the version.
+type uaRule struct {
+	name    string
+	pattern *regexp.Regexp
+}
+
+// browserRules are tried in order, so browsers built on others, which mention
+// them too, come first: Edge and Opera before Chrome, Chrome before Safari.
+var browserRules = []uaRule{
+	{"Edge", regexp.MustCompile(`Edg(?:e|A|iOS)?/(\d+)`)},
+	{"Opera", regexp.MustCompile(`(?:OPR|OPiOS|OPT)/(\d+)`)},
+	{"Opera Mini", regexp.MustCompile(`Opera Mini/(\d+)`)},
+	{"Opera", regexp.MustCompile(`Opera.*Version/(\d+)`)},
+	{"Samsung Internet", regexp.MustCompile(`SamsungBrowser/(\d+)`)},
+	{"Yandex Browser", regexp.MustCompile(`YaBrowser/(\d+)`)},
+	{"UC Browser", regexp.MustCompile(`UCBrowser/(\d+)`)},
+	{"Vivaldi", regexp.MustCompile(`Vivaldi/(\d+)`)},
+	{"Brave", regexp.MustCompile(`Brave/(\d+)`)},
+	{"Facebook", regexp.MustCompile(`FB(?:AV|_IAB)/(?:FB4A;FBAV/)?(\d+)`)},
+	{"Instagram", regexp.MustCompile(`Instagram (\d+)`)},
+	{"Chrome", regexp.MustCompile(`CriOS/(\d+)`)},
+	{"Firefox", regexp.MustCompile(`FxiOS/(\d+)`)},
+	{"Firefox", regexp.MustCompile(`Firefox/(\d+)`)},
+	{"Chrome WebView", regexp.MustCompile(`; wv\).*Chrome/(\d+)`)},
+	{"Chromium", regexp.MustCompile(`Chromium/(\d+)`)},
+	{"Chrome", regexp.MustCompile(`Chrome/(\d+)`)},
+	{"Safari", regexp.MustCompile(`Version/(\d+).*Safari/`)},
+	{"Safari", regexp.MustCompile(`(?:iPhone|iPad|iPod).*AppleWebKit/[\d.]+ \(KHTML, like Gecko\) Mobile/`)},
+	{"Internet Explorer", regexp.MustCompile(`MSIE (\d+)`)},
+	{"Internet Explorer", regexp.MustCompile(`Trident/.*rv:(\d+)`)},
+	{"curl", regexp.MustCompile(`^curl/(\d+)`)},
+	{"Wget", regexp.MustCompile(`^Wget/(\d+)`)},
+	{"Python Requests", regexp.MustCompile(`python-requests/(\d+)`)},
+	{"Go HTTP client", regexp.MustCompile(`Go-http-client/(\d+)`)},
+}
+
+// osRules are tried in order, so Android comes before Linux and iOS before macOS
+var osRules = []uaRule{
+	{"Windows Phone", regexp.MustCompile(`Windows Phone(?: OS)? (\d+)`)},
+	{"Windows", regexp.MustCompile(`Windows NT (\d+\.\d+)`)},
+	{"iOS", regexp.MustCompile(`(?:iPhone|iPad|iPod).*? OS (\d+)`)},
+	{"macOS", regexp.MustCompile(`Mac OS X (\d+)`)},
+	{"Android", regexp.MustCompile(`Android (\d+)`)},
+	{"Android", regexp.MustCompile(`Android`)},
+	{"Chrome OS", regexp.MustCompile(`CrOS`)},
+	{"Linux", regexp.MustCompile(`Linux|X11`)},
+}
+
+// windowsVersions names Windows NT kernel versions; Windows 11 still says 10.0
+var windowsVersions = map[string]string{
+	"10.0": "10",
+	"6.3":  "8.1",
+	"6.2":  "8",
+	"6.1":  "7",
+	"6.0":  "Vista",
+	"5.1":  "XP",
+}
+
+// mobileMarkers and tabletMarkers pick out handheld devices in a User-Agent
+var (
+	tabletMarkers = regexp.MustCompile(`iPad|Tablet|Kindle|Silk/|PlayBook|Nexus (?:7|9|10)\b`)
+	mobileMarkers = regexp.MustCompile(`Mobi|iPhone|iPod|Windows Phone|BlackBerry|BB10|Opera Mini|IEMobile`)
+)
+
+// ParseUserAgent extracts the browser, OS and device type from a User-Agent
+// header. It only uses the rules above, so it never makes network lookups.
+// iPads asking for desktop sites claim to be Macs and are counted as desktops.
+func ParseUserAgent(header string) UserAgent {
+	var ua UserAgent
+	ua.Browser, ua.BrowserVersion = matchUARule(browserRules, header)
+	ua.OS, ua.OSVersion = matchUARule(osRules, header)
+	if ua.OS == "Windows" {
+		ua.OSVersion = windowsVersions[ua.OSVersion]
+	}
+
+	switch {
+	case tabletMarkers.MatchString(header):
+		ua.DeviceType = DeviceTablet
+	case mobileMarkers.MatchString(header):
+		ua.DeviceType = DeviceMobile
+	case ua.OS == "Android":
+		// Android phones say "Mobile"; tablets don't
+		ua.DeviceType = DeviceTablet
+	default:
+		ua.DeviceType = DeviceDesktop
+	}
+	return ua
+}
+
+// matchUARule returns the name and version from the first rule matching header
+func matchUARule(rules []uaRule, header string) (string, string) {
+	for _, rule := range rules {
+		if m := rule.pattern.FindStringSubmatch(header); m != nil {
+			version := ""
+			if len(m) > 1 {
+				version = strings.TrimSpace(m[1])
+			}
+			return rule.name, version
+		}
+	}
+	return unknownDimension, ""
+}
@@ -0,0 +1,79 @@
+package main
+
+import "testing"
+
+func TestParseUserAgent(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   UserAgent
+	}{
+		{
+			"Chrome on Windows",
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+			UserAgent{"Chrome", "120", "Windows", "10", DeviceDesktop},
+		},
+		{
+			"Edge on Windows",
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.2210.91",
+			UserAgent{"Edge", "120", "Windows", "10", DeviceDesktop},
+		},
+		{
+			"Firefox on Linux",
+			"Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0",
+			UserAgent{"Firefox", "121", "Linux", "", DeviceDesktop},
+		},
+		{
+			"Safari on macOS",
+			"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Safari/605.1.15",
+			UserAgent{"Safari", "17", "macOS", "10", DeviceDesktop},
+		},
+		{
+			"Safari on iPhone",
+			"Mozilla/5.0 (iPhone; CPU iPhone OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Mobile/15E148 Safari/604.1",
+			UserAgent{"Safari", "17", "iOS", "17", DeviceMobile},
+		},
+		{
+			"Chrome on iPad",
+			"Mozilla/5.0 (iPad; CPU OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/120.0.6099.119 Mobile/15E148 Safari/604.1",
+			UserAgent{"Chrome", "120", "iOS", "17", DeviceTablet},
+		},
+		{
+			"Samsung Internet on Android phone",
+			"Mozilla/5.0 (Linux; Android 13; SM-S901B) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/23.0 Chrome/115.0.0.0 Mobile Safari/537.36",
+			UserAgent{"Samsung Internet", "23", "Android", "13", DeviceMobile},
+		},
+		{
+			"Chrome on Android tablet",
+			"Mozilla/5.0 (Linux; Android 12; SM-X700) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+			UserAgent{"Chrome", "120", "Android", "12", DeviceTablet},
+		},
+		{
+			"Android WebView",
+			"Mozilla/5.0 (Linux; Android 13; Pixel 7; wv) AppleWebKit/537.36 (KHTML, like Gecko) Version/4.0 Chrome/120.0.0.0 Mobile Safari/537.36",
+			UserAgent{"Chrome WebView", "120", "Android", "13", DeviceMobile},
+		},
+		{
+			"Internet Explorer 11",
+			"Mozilla/5.0 (Windows NT 6.1; Trident/7.0; rv:11.0) like Gecko",
+			UserAgent{"Internet Explorer", "11", "Windows", "7", DeviceDesktop},
+		},
+		{
+			"curl",
+			"curl/8.4.0",
+			UserAgent{"curl", "8", unknownDimension, "", DeviceDesktop},
+		},
+		{
+			"empty",
+			"",
+			UserAgent{unknownDimension, "", unknownDimension, "", DeviceDesktop},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseUserAgent(tt.header); got != tt.want {
+				t.Errorf("ParseUserAgent = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
-	"math/rand"
+	"io"
+	"net/http"
 	"strings"
-	"time"
 )
 
 const (
@@ -12,17 +14,6 @@ const (
 	base62Chars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 )
 
-// GenerateRandomCode generates a random alphanumeric string of length n
-func GenerateRandomCode(n int) string {
-	fmt.Println("GenerateRandomCode called with length:", n)
-	rand.Seed(time.Now().UnixNano())
-	b := make([]byte, n)
-	for i := range b {
-		b[i] = base62Chars[rand.Intn(len(base62Chars))]
-	}
-	return string(b)
-}
-
 // ValidateURL performs basic URL validation
 func ValidateURL(url string) bool {
 	fmt.Println("ValidateURL called with url:", url)
@@ -39,3 +30,57 @@ func NormalizeURL(url string) string {
 	fmt.Println("Normalized URL:", url)
 	return url
 }
+
+// writeJSON writes v as a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, statusCode int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	writeJSONBody(w, statusCode, v)
+}
+
+// writeJSONBody writes the status and v as JSON, leaving the Content-Type to the caller
+func writeJSONBody(w http.ResponseWriter, statusCode int, v any) {
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Println("Error encoding JSON response:", err)
+	}
+}
+
+// decodeJSON strictly decodes the request body into v: it must be a single JSON
+// value with no fields v doesn't have. On failure it writes the problem and
+// returns false.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(v)
+	if err == nil && decoder.Decode(&struct{}{}) != io.EOF {
+		err = errors.New("request body must contain a single JSON object")
+	}
+	if err == nil {
+		return true
+	}
+	fmt.Println("Error decoding JSON:", err)
+
+	var tooLarge *http.MaxBytesError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	detail := "Invalid JSON"
+	switch {
+	case errors.As(err, &tooLarge):
+		writeError(w, r, http.StatusRequestEntityTooLarge, ProblemPayloadTooLarge, fmt.Sprintf("Request body must not be larger than %d bytes", tooLarge.Limit))
+		return false
+	case errors.Is(err, io.EOF):
+		detail = "Request body must not be empty"
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		detail = "Request body contains badly-formed JSON"
+	case errors.As(err, &syntaxErr):
+		detail = fmt.Sprintf("Request body contains badly-formed JSON (at position %d)", syntaxErr.Offset)
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		detail = fmt.Sprintf("Field %q has the wrong type", typeErr.Field)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		detail = "Unknown field " + strings.TrimPrefix(err.Error(), "json: unknown field ")
+	case strings.HasPrefix(err.Error(), "request body must contain"):
+		detail = "Request body must contain a single JSON object"
+	}
+	writeError(w, r, http.StatusBadRequest, ProblemInvalidJSON, detail)
+	return false
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDecodeJSON(t *testing.T) {
+	type request struct {
+		URL   string `json:"url"`
+		Count int    `json:"count"`
+	}
+	tests := []struct {
+		name       string
+		body       string
+		limit      int64
+		want       request
+		wantStatus int
+		wantCode   string
+		wantDetail string
+	}{
+		{name: "valid", body: `{"url":"https://example.com","count":2}`, want: request{URL: "https://example.com", Count: 2}},
+		{name: "trailing whitespace", body: "{\"url\":\"https://example.com\"}\n", want: request{URL: "https://example.com"}},
+		{name: "empty", body: "", wantStatus: http.StatusBadRequest, wantCode: ProblemInvalidJSON, wantDetail: "Request body must not be empty"},
+		{name: "truncated", body: `{"url":"https://exa`, wantStatus: http.StatusBadRequest, wantCode: ProblemInvalidJSON, wantDetail: "Request body contains badly-formed JSON"},
+		{name: "syntax error", body: `{"url" "x"}`, wantStatus: http.StatusBadRequest, wantCode: ProblemInvalidJSON, wantDetail: "Request body contains badly-formed JSON (at position 8)"},
+		{name: "wrong type", body: `{"count":"two"}`, wantStatus: http.StatusBadRequest, wantCode: ProblemInvalidJSON, wantDetail: `Field "count" has the wrong type`},
+		{name: "unknown field", body: `{"url":"https://example.com","admin":true}`, wantStatus: http.StatusBadRequest, wantCode: ProblemInvalidJSON, wantDetail: `Unknown field "admin"`},
+		{name: "two objects", body: `{"url":"a"}{"url":"b"}`, wantStatus: http.StatusBadRequest, wantCode: ProblemInvalidJSON, wantDetail: "Request body must contain a single JSON object"},
+		{name: "not an object", body: `[1,2]`, wantStatus: http.StatusBadRequest, wantCode: ProblemInvalidJSON, wantDetail: "Invalid JSON"},
+		{name: "too large", body: `{"url":"` + strings.Repeat("a", 64) + `"}`, limit: 32, wantStatus: http.StatusRequestEntityTooLarge, wantCode: ProblemPayloadTooLarge, wantDetail: "Request body must not be larger than 32 bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(tt.body))
+			if tt.limit > 0 {
+				req.Body = http.MaxBytesReader(rec, req.Body, tt.limit)
+			}
+			var got request
+			ok := decodeJSON(rec, req, &got)
+
+			if ok != (tt.wantStatus == 0) {
+				t.Fatalf("decodeJSON = %v, want %v", ok, tt.wantStatus == 0)
+			}
+			if ok {
+				if got != tt.want {
+					t.Errorf("decoded %+v, want %+v", got, tt.want)
+				}
+				return
+			}
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			var problem ErrorResponse
+			if err := json.NewDecoder(rec.Body).Decode(&problem); err != nil {
+				t.Fatalf("decoding problem: %v", err)
+			}
+			if problem.Code != tt.wantCode || problem.Detail != tt.wantDetail {
+				t.Errorf("problem = %q %q, want %q %q", problem.Code, problem.Detail, tt.wantCode, tt.wantDetail)
+			}
+		})
+	}
+}
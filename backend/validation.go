@@ -0,0 +1,166 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// User ID character sets
+const (
+	// CharsetAlphanumeric allows ASCII letters and digits
+	CharsetAlphanumeric = "alphanumeric"
+	// CharsetUsername also allows '.', '_' and '-' between other characters
+	CharsetUsername = "username"
+	// CharsetUnicode allows letters and digits in any script, plus '.', '_' and '-'
+	CharsetUnicode = "unicode"
+)
+
+// maxUserIDLength is the size of the users.user_id column
+const maxUserIDLength = 50
+
+// bcryptMaxBytes is the most bcrypt hashes; anything longer is silently ignored
+const bcryptMaxBytes = 72
+
+// Validation error codes, stable for clients to switch on
+const (
+	ValidationRequired          = "required"
+	ValidationTooShort          = "too_short"
+	ValidationTooLong           = "too_long"
+	ValidationInvalidCharacters = "invalid_characters"
+	ValidationTaken             = "taken"
+	ValidationCommonPassword    = "common_password"
+	ValidationContainsUserID    = "contains_user_id"
+)
+
+//go:embed common_passwords.txt
+var commonPasswordList string
+
+// commonPasswords is commonPasswordList as a lowercase set
+var commonPasswords = func() map[string]bool {
+	set := make(map[string]bool)
+	for _, line := range strings.Split(commonPasswordList, "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			set[strings.ToLower(line)] = true
+		}
+	}
+	return set
+}()
+
+// FieldError describes why one request field was rejected
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// UserIDPolicy configures which user IDs can sign up
+type UserIDPolicy struct {
+	MinLength int
+	MaxLength int
+	Charset   string
+}
+
+// Validate checks the policy itself is usable
+func (p UserIDPolicy) Validate() error {
+	switch p.Charset {
+	case CharsetAlphanumeric, CharsetUsername, CharsetUnicode:
+	default:
+		return fmt.Errorf("unknown user ID charset %q", p.Charset)
+	}
+	if p.MinLength < 1 || p.MaxLength < p.MinLength || p.MaxLength > maxUserIDLength {
+		return fmt.Errorf("user ID length must be between 1 and %d characters, got %d-%d", maxUserIDLength, p.MinLength, p.MaxLength)
+	}
+	return nil
+}
+
+// NormalizeUserID trims a user ID and applies Unicode NFKC normalization, so
+// look-alike forms such as full-width letters become one canonical ID
+func NormalizeUserID(userID string) string {
+	return norm.NFKC.String(strings.TrimSpace(userID))
+}
+
+// Check returns what is wrong with a normalized user ID, if anything
+func (p UserIDPolicy) Check(userID string) []FieldError {
+	length := utf8.RuneCountInString(userID)
+	switch {
+	case userID == "":
+		return []FieldError{{"user_id", ValidationRequired, "User ID is required"}}
+	case length < p.MinLength:
+		return []FieldError{{"user_id", ValidationTooShort, fmt.Sprintf("User ID must be at least %d characters long", p.MinLength)}}
+	case length > p.MaxLength:
+		return []FieldError{{"user_id", ValidationTooLong, fmt.Sprintf("User ID must be at most %d characters long", p.MaxLength)}}
+	case !p.validCharacters(userID):
+		return []FieldError{{"user_id", ValidationInvalidCharacters, p.charsetDescription()}}
+	}
+	return nil
+}
+
+// validCharacters reports whether every character of userID is in the charset
+func (p UserIDPolicy) validCharacters(userID string) bool {
+	runes := []rune(userID)
+	for i, r := range runes {
+		isASCIIAlnum := r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r))
+		switch {
+		case isASCIIAlnum:
+		case p.Charset == CharsetUnicode && (unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r)):
+		case p.Charset != CharsetAlphanumeric && strings.ContainsRune("._-", r):
+			// Separators can't start or end the ID, or repeat
+			if i == 0 || i == len(runes)-1 || strings.ContainsRune("._-", runes[i-1]) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// charsetDescription explains the charset in an error message
+func (p UserIDPolicy) charsetDescription() string {
+	switch p.Charset {
+	case CharsetAlphanumeric:
+		return "User ID may only contain letters A-Z and digits"
+	case CharsetUnicode:
+		return "User ID may only contain letters, digits and single '.', '_' or '-' between them"
+	}
+	return "User ID may only contain letters A-Z, digits and single '.', '_' or '-' between them"
+}
+
+// PasswordPolicy configures which passwords are accepted
+type PasswordPolicy struct {
+	MinLength   int
+	CheckCommon bool
+}
+
+// Validate checks the policy itself is usable
+func (p PasswordPolicy) Validate() error {
+	if p.MinLength < 1 || p.MinLength > bcryptMaxBytes {
+		return fmt.Errorf("minimum password length must be between 1 and %d, got %d", bcryptMaxBytes, p.MinLength)
+	}
+	return nil
+}
+
+// Check returns what is wrong with a new password for userID, reported under
+// field. Length is counted in characters, but at most 72 bytes are allowed
+// because bcrypt ignores the rest.
+func (p PasswordPolicy) Check(field, password, userID string) []FieldError {
+	lower := strings.ToLower(password)
+	switch {
+	case password == "":
+		return []FieldError{{field, ValidationRequired, "Password is required"}}
+	case utf8.RuneCountInString(password) < p.MinLength:
+		return []FieldError{{field, ValidationTooShort, fmt.Sprintf("Password must be at least %d characters long", p.MinLength)}}
+	case len(password) > bcryptMaxBytes:
+		return []FieldError{{field, ValidationTooLong, fmt.Sprintf("Password must be at most %d bytes", bcryptMaxBytes)}}
+	case userID != "" && strings.Contains(lower, strings.ToLower(userID)):
+		return []FieldError{{field, ValidationContainsUserID, "Password must not contain your user ID"}}
+	case p.CheckCommon && commonPasswords[lower]:
+		return []FieldError{{field, ValidationCommonPassword, "This password is too common, choose another"}}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeUserID(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"alice", "alice"},
+		{"  alice\t", "alice"},
+		{"ａｌｉｃｅ", "alice"},
+		{"café", "café"},
+		{"café", "café"},
+		{"ﬁle", "file"},
+	}
+	for _, tt := range tests {
+		if got := NormalizeUserID(tt.in); got != tt.want {
+			t.Errorf("NormalizeUserID(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestUserIDPolicyCheck(t *testing.T) {
+	tests := []struct {
+		charset string
+		userID  string
+		want    string
+	}{
+		{CharsetUsername, "", ValidationRequired},
+		{CharsetUsername, "ab", ValidationTooShort},
+		{CharsetUsername, strings.Repeat("a", 21), ValidationTooLong},
+		{CharsetUsername, "alice", ""},
+		{CharsetUsername, "alice.smith", ""},
+		{CharsetUsername, ".alice", ValidationInvalidCharacters},
+		{CharsetUsername, "alice-", ValidationInvalidCharacters},
+		{CharsetUsername, "al..ice", ValidationInvalidCharacters},
+		{CharsetUsername, "josé", ValidationInvalidCharacters},
+		{CharsetAlphanumeric, "alice_smith", ValidationInvalidCharacters},
+		{CharsetAlphanumeric, "alice42", ""},
+		{CharsetUnicode, "josé", ""},
+		{CharsetUnicode, "josé", ""},
+		{CharsetUnicode, "ユーザー", ""},
+		{CharsetUnicode, "alice smith", ValidationInvalidCharacters},
+	}
+	for _, tt := range tests {
+		policy := UserIDPolicy{MinLength: 3, MaxLength: 20, Charset: tt.charset}
+		if got := firstCode(policy.Check(tt.userID)); got != tt.want {
+			t.Errorf("%s Check(%q) = %q, want %q", tt.charset, tt.userID, got, tt.want)
+		}
+	}
+}
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	tests := []struct {
+		name        string
+		checkCommon bool
+		password    string
+		userID      string
+		want        string
+	}{
+		{"empty", true, "", "alice", ValidationRequired},
+		{"short", true, "abc123", "alice", ValidationTooShort},
+		{"short in bytes but long in characters", true, "ééééééééé", "alice", ""},
+		{"over bcrypt limit", true, strings.Repeat("é", 37), "alice", ValidationTooLong},
+		{"contains user ID", true, "my-ALICE-secret", "alice", ValidationContainsUserID},
+		{"common", true, "password123", "alice", ValidationCommonPassword},
+		{"common unchecked", false, "password123", "alice", ""},
+		{"good", true, "correct horse battery", "alice", ""},
+		{"no user ID", true, "correct horse battery", "", ""},
+	}
+	policy := PasswordPolicy{MinLength: 8}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy.CheckCommon = tt.checkCommon
+			errs := policy.Check("password", tt.password, tt.userID)
+			if got := firstCode(errs); got != tt.want {
+				t.Errorf("Check(%q) = %q, want %q", tt.password, got, tt.want)
+			}
+			for _, e := range errs {
+				if e.Field != "password" {
+					t.Errorf("Check reported field %q, want %q", e.Field, "password")
+				}
+			}
+		})
+	}
+}
+
+// firstCode returns the code of the first field error, or "" if there are none
+func firstCode(errs []FieldError) string {
+	if len(errs) == 0 {
+		return ""
+	}
+	return errs[0].Code
+}
@@ -0,0 +1,807 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Workspace membership roles, from least to most privileged
+const (
+	// WorkspaceViewer can see the workspace's links and their history
+	WorkspaceViewer = "viewer"
+	// WorkspaceEditor can also create, edit, delete and restore links
+	WorkspaceEditor = "editor"
+	// WorkspaceOwner can also invite members and change their roles
+	WorkspaceOwner = "owner"
+)
+
+// workspaceRoleRank orders workspace roles like roleRank orders user roles
+var workspaceRoleRank = map[string]int{
+	WorkspaceViewer: 0,
+	WorkspaceEditor: 1,
+	WorkspaceOwner:  2,
+}
+
+// ErrLastOwner is returned when a change would leave a workspace without an owner
+var ErrLastOwner = errors.New("workspace must keep at least one owner")
+
+// ValidateWorkspaceRole checks that role is a known workspace role
+func ValidateWorkspaceRole(role string) error {
+	if _, ok := workspaceRoleRank[role]; !ok {
+		return fmt.Errorf("unknown workspace role %q", role)
+	}
+	return nil
+}
+
+// hasWorkspaceRole reports whether role is need or a more privileged one
+func hasWorkspaceRole(role, need string) bool {
+	rank, ok := workspaceRoleRank[role]
+	return ok && rank >= workspaceRoleRank[need]
+}
+
+// Workspace is a group of users sharing ownership of links
+type Workspace struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	// Plan picks the workspace's quota limits
+	Plan string `json:"plan"`
+	// Role is the requesting user's role in the workspace
+	Role string `json:"role,omitempty"`
+}
+
+// WorkspaceMember is a user's membership of a workspace
+type WorkspaceMember struct {
+	ID       int       `json:"-"`
+	UserID   string    `json:"user_id"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// WorkspaceInvite is a pending invitation for a user to join a workspace
+type WorkspaceInvite struct {
+	ID            int       `json:"id"`
+	WorkspaceID   int       `json:"workspace_id"`
+	WorkspaceName string    `json:"workspace_name"`
+	InviteeID     int       `json:"-"`
+	UserID        string    `json:"user_id"`
+	Role          string    `json:"role"`
+	InvitedBy     string    `json:"invited_by"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// CreateWorkspaceRequest represents the request body for creating a workspace
+type CreateWorkspaceRequest struct {
+	Name string `json:"name"`
+}
+
+// InviteRequest represents the request body for inviting a user to a workspace
+type InviteRequest struct {
+	UserID string `json:"user_id"`
+	Role   string `json:"role"`
+}
+
+// SwitchWorkspaceRequest selects the workspace to work in; null switches back to personal links
+type SwitchWorkspaceRequest struct {
+	WorkspaceID *int `json:"workspace_id"`
+}
+
+// WorkspacesResponse lists the user's workspaces and the one they are working in
+type WorkspacesResponse struct {
+	CurrentWorkspaceID *int         `json:"current_workspace_id"`
+	Workspaces         []*Workspace `json:"workspaces"`
+}
+
+// currentWorkspace returns the workspace user is working in, or nil for their
+// personal links. It writes a 403 if they have since left it or their role is below need.
+func (h *Handlers) currentWorkspace(w http.ResponseWriter, r *http.Request, user *User, need string) (*Workspace, bool) {
+	if user.CurrentWorkspaceID == nil {
+		return nil, true
+	}
+	workspace, err := h.db.GetMembership(r.Context(), *user.CurrentWorkspaceID, user.ID)
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusForbidden, ProblemForbidden, "You are no longer a member of your current workspace")
+		return nil, false
+	}
+	if err != nil {
+		fmt.Println("Database error looking up membership:", err)
+		writeServerError(w, r, err, "Database error")
+		return nil, false
+	}
+	if !hasWorkspaceRole(workspace.Role, need) {
+		writeError(w, r, http.StatusForbidden, ProblemForbidden, "Insufficient workspace permissions")
+		return nil, false
+	}
+	return workspace, true
+}
+
+// memberWorkspace looks up the workspace in the {workspaceID} route variable
+// and checks user's role in it is at least need. Non-members get a 404.
+func (h *Handlers) memberWorkspace(w http.ResponseWriter, r *http.Request, user *User, need string) (*Workspace, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["workspaceID"])
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, ProblemNotFound, "Workspace not found")
+		return nil, false
+	}
+	workspace, err := h.db.GetMembership(r.Context(), id, user.ID)
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, ProblemNotFound, "Workspace not found")
+		return nil, false
+	}
+	if err != nil {
+		fmt.Println("Database error looking up membership:", err)
+		writeServerError(w, r, err, "Database error")
+		return nil, false
+	}
+	if !hasWorkspaceRole(workspace.Role, need) {
+		writeError(w, r, http.StatusForbidden, ProblemForbidden, "Insufficient workspace permissions")
+		return nil, false
+	}
+	return workspace, true
+}
+
+// CreateWorkspace handles POST /api/workspaces. The creator becomes its owner.
+func (h *Handlers) CreateWorkspace(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("CreateWorkspace called")
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	var req CreateWorkspaceRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 100 {
+		writeError(w, r, http.StatusBadRequest, ProblemInvalidRequest, "name must be between 1 and 100 characters")
+		return
+	}
+
+	workspace, err := h.db.CreateWorkspace(r.Context(), req.Name, user.ID)
+	if err != nil {
+		fmt.Println("Database error creating workspace:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	h.audit(r, user, AuditWorkspaceCreate, "workspace", strconv.Itoa(workspace.ID), nil, workspace)
+	writeJSON(w, http.StatusCreated, workspace)
+}
+
+// ListWorkspaces handles GET /api/workspaces
+func (h *Handlers) ListWorkspaces(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("ListWorkspaces called")
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	workspaces, err := h.db.ListWorkspaces(r.Context(), user.ID)
+	if err != nil {
+		fmt.Println("Database error listing workspaces:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	writeJSON(w, http.StatusOK, WorkspacesResponse{CurrentWorkspaceID: user.CurrentWorkspaceID, Workspaces: workspaces})
+}
+
+// SwitchWorkspace handles PUT /api/workspaces/current
+func (h *Handlers) SwitchWorkspace(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("SwitchWorkspace called")
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	var req SwitchWorkspaceRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if req.WorkspaceID != nil {
+		_, err := h.db.GetMembership(r.Context(), *req.WorkspaceID, user.ID)
+		if err == sql.ErrNoRows {
+			writeError(w, r, http.StatusNotFound, ProblemNotFound, "Workspace not found")
+			return
+		}
+		if err != nil {
+			fmt.Println("Database error looking up membership:", err)
+			writeServerError(w, r, err, "Database error")
+			return
+		}
+	}
+
+	if err := h.db.SetCurrentWorkspace(r.Context(), user.ID, req.WorkspaceID); err != nil {
+		fmt.Println("Database error switching workspace:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	writeJSON(w, http.StatusOK, SwitchWorkspaceRequest{WorkspaceID: req.WorkspaceID})
+}
+
+// ListMembers handles GET /api/workspaces/{workspaceID}/members
+func (h *Handlers) ListMembers(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("ListMembers called")
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+	workspace, ok := h.memberWorkspace(w, r, user, WorkspaceViewer)
+	if !ok {
+		return
+	}
+
+	members, err := h.db.ListMembers(r.Context(), workspace.ID)
+	if err != nil {
+		fmt.Println("Database error listing members:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	writeJSON(w, http.StatusOK, members)
+}
+
+// InviteMember handles POST /api/workspaces/{workspaceID}/invites. Inviting a
+// user who already has a pending invite updates its role.
+func (h *Handlers) InviteMember(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("InviteMember called")
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+	workspace, ok := h.memberWorkspace(w, r, user, WorkspaceOwner)
+	if !ok {
+		return
+	}
+
+	var req InviteRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if err := ValidateWorkspaceRole(req.Role); err != nil {
+		writeError(w, r, http.StatusBadRequest, ProblemInvalidRequest, err.Error())
+		return
+	}
+	invitee, err := h.db.GetUserByUserID(r.Context(), req.UserID)
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, ProblemNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		fmt.Println("Database error looking up user:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	if _, err := h.db.GetMembership(r.Context(), workspace.ID, invitee.ID); err == nil {
+		writeError(w, r, http.StatusConflict, ProblemAlreadyExists, "User is already a member")
+		return
+	} else if err != sql.ErrNoRows {
+		fmt.Println("Database error looking up membership:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+
+	invite, err := h.db.CreateInvite(r.Context(), workspace.ID, invitee.ID, req.Role, user.ID)
+	if err != nil {
+		fmt.Println("Database error creating invite:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	h.audit(r, user, AuditWorkspaceInvite, "workspace", strconv.Itoa(workspace.ID), nil, invite)
+	writeJSON(w, http.StatusCreated, invite)
+}
+
+// ListInvites handles GET /api/invites, listing the user's pending invitations
+func (h *Handlers) ListInvites(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("ListInvites called")
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	invites, err := h.db.ListInvites(r.Context(), user.ID)
+	if err != nil {
+		fmt.Println("Database error listing invites:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	writeJSON(w, http.StatusOK, invites)
+}
+
+// invite looks up the invite in the {inviteID} route variable. Only the
+// invitee and the workspace's owners can see it.
+func (h *Handlers) invite(w http.ResponseWriter, r *http.Request, user *User) (*WorkspaceInvite, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["inviteID"])
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, ProblemNotFound, "Invite not found")
+		return nil, false
+	}
+	invite, err := h.db.GetInvite(r.Context(), id)
+	if err == nil && invite.InviteeID != user.ID {
+		var workspace *Workspace
+		workspace, err = h.db.GetMembership(r.Context(), invite.WorkspaceID, user.ID)
+		if err == nil && workspace.Role != WorkspaceOwner {
+			err = sql.ErrNoRows
+		}
+	}
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, ProblemNotFound, "Invite not found")
+		return nil, false
+	}
+	if err != nil {
+		fmt.Println("Database error looking up invite:", err)
+		writeServerError(w, r, err, "Database error")
+		return nil, false
+	}
+	return invite, true
+}
+
+// AcceptInvite handles POST /api/invites/{inviteID}/accept
+func (h *Handlers) AcceptInvite(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("AcceptInvite called")
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+	invite, ok := h.invite(w, r, user)
+	if !ok {
+		return
+	}
+	if invite.InviteeID != user.ID {
+		writeError(w, r, http.StatusForbidden, ProblemForbidden, "Only the invited user can accept an invite")
+		return
+	}
+
+	workspace, err := h.db.AcceptInvite(r.Context(), invite)
+	if err != nil {
+		fmt.Println("Database error accepting invite:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	h.audit(r, user, AuditWorkspaceJoin, "workspace", strconv.Itoa(workspace.ID), nil, workspace)
+	writeJSON(w, http.StatusOK, workspace)
+}
+
+// DeleteInvite handles DELETE /api/invites/{inviteID}, declining or revoking an invite
+func (h *Handlers) DeleteInvite(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("DeleteInvite called")
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+	invite, ok := h.invite(w, r, user)
+	if !ok {
+		return
+	}
+
+	if err := h.db.DeleteInvite(r.Context(), invite.ID); err != nil {
+		fmt.Println("Database error deleting invite:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	h.audit(r, user, AuditWorkspaceInviteRevoke, "workspace", strconv.Itoa(invite.WorkspaceID), invite, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// workspaceMember looks up the member in the {userID} route variable
+func (h *Handlers) workspaceMember(w http.ResponseWriter, r *http.Request, workspace *Workspace) (*User, bool) {
+	member, err := h.db.GetUserByUserID(r.Context(), mux.Vars(r)["userID"])
+	if err == nil {
+		_, err = h.db.GetMembership(r.Context(), workspace.ID, member.ID)
+	}
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, ProblemNotFound, "Member not found")
+		return nil, false
+	}
+	if err != nil {
+		fmt.Println("Database error looking up member:", err)
+		writeServerError(w, r, err, "Database error")
+		return nil, false
+	}
+	return member, true
+}
+
+// SetMemberRole handles PUT /api/workspaces/{workspaceID}/members/{userID}
+func (h *Handlers) SetMemberRole(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("SetMemberRole called")
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+	workspace, ok := h.memberWorkspace(w, r, user, WorkspaceOwner)
+	if !ok {
+		return
+	}
+
+	var req SetRoleRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if err := ValidateWorkspaceRole(req.Role); err != nil {
+		writeError(w, r, http.StatusBadRequest, ProblemInvalidRequest, err.Error())
+		return
+	}
+	member, ok := h.workspaceMember(w, r, workspace)
+	if !ok {
+		return
+	}
+
+	err := h.db.SetMemberRole(r.Context(), workspace.ID, member.ID, req.Role)
+	if err == ErrLastOwner {
+		writeError(w, r, http.StatusConflict, ProblemLastOwner, "A workspace must keep at least one owner")
+		return
+	}
+	if err != nil {
+		fmt.Println("Database error updating member:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	h.audit(r, user, AuditWorkspaceMemberRole, "workspace", strconv.Itoa(workspace.ID), nil, WorkspaceMember{UserID: member.UserID, Role: req.Role})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RemoveMember handles DELETE /api/workspaces/{workspaceID}/members/{userID}.
+// Owners can remove anyone and every member can remove themselves to leave.
+func (h *Handlers) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("RemoveMember called")
+	user, ok := h.requireUser(w, r)
+	if !ok {
+		return
+	}
+	need := WorkspaceOwner
+	if mux.Vars(r)["userID"] == user.UserID {
+		need = WorkspaceViewer
+	}
+	workspace, ok := h.memberWorkspace(w, r, user, need)
+	if !ok {
+		return
+	}
+	member, ok := h.workspaceMember(w, r, workspace)
+	if !ok {
+		return
+	}
+
+	err := h.db.RemoveMember(r.Context(), workspace.ID, member.ID)
+	if err == ErrLastOwner {
+		writeError(w, r, http.StatusConflict, ProblemLastOwner, "A workspace must keep at least one owner")
+		return
+	}
+	if err != nil {
+		fmt.Println("Database error removing member:", err)
+		writeServerError(w, r, err, "Database error")
+		return
+	}
+	h.audit(r, user, AuditWorkspaceMemberRemove, "workspace", strconv.Itoa(workspace.ID), WorkspaceMember{UserID: member.UserID}, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CreateWorkspaceTables creates the workspace tables if they don't exist
+func (db *Database) CreateWorkspaceTables(ctx context.Context) error {
+	fmt.Println("CreateWorkspaceTables called")
+	query := `
+		CREATE TABLE IF NOT EXISTS workspaces (
+			id SERIAL PRIMARY KEY,
+			name VARCHAR(100) NOT NULL,
+			created_by INTEGER,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+		ALTER TABLE workspaces ADD COLUMN IF NOT EXISTS plan VARCHAR(32) NOT NULL DEFAULT 'free';
+
+		CREATE TABLE IF NOT EXISTS workspace_members (
+			workspace_id INTEGER NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			role VARCHAR(20) NOT NULL,
+			joined_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			PRIMARY KEY (workspace_id, user_id)
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_workspace_members_user ON workspace_members(user_id);
+
+		CREATE TABLE IF NOT EXISTS workspace_invites (
+			id SERIAL PRIMARY KEY,
+			workspace_id INTEGER NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			role VARCHAR(20) NOT NULL,
+			invited_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			UNIQUE (workspace_id, user_id)
+		);
+	`
+
+	_, err := db.conn.ExecContext(ctx, query)
+	return err
+}
+
+// CreateWorkspace creates a workspace owned by ownerID
+func (db *Database) CreateWorkspace(ctx context.Context, name string, ownerID int) (*Workspace, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	workspace := &Workspace{Name: name, Role: WorkspaceOwner}
+	err = tx.QueryRowContext(ctx, `INSERT INTO workspaces (name, created_by) VALUES ($1, $2) RETURNING id, created_at, plan`, name, ownerID).
+		Scan(&workspace.ID, &workspace.CreatedAt, &workspace.Plan)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO workspace_members (workspace_id, user_id, role) VALUES ($1, $2, $3)`,
+		workspace.ID, ownerID, WorkspaceOwner); err != nil {
+		return nil, err
+	}
+	return workspace, tx.Commit()
+}
+
+// workspaceColumns selects a workspace joined with one membership as m
+const workspaceColumns = `w.id, w.name, w.created_at, w.plan, m.role`
+
+// GetMembership returns a workspace with userID's role in it, or sql.ErrNoRows if they aren't a member
+func (db *Database) GetMembership(ctx context.Context, workspaceID, userID int) (*Workspace, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	query := `
+		SELECT ` + workspaceColumns + `
+		FROM workspaces w JOIN workspace_members m ON m.workspace_id = w.id
+		WHERE w.id = $1 AND m.user_id = $2`
+	workspace := &Workspace{}
+	err := db.conn.QueryRowContext(ctx, query, workspaceID, userID).Scan(&workspace.ID, &workspace.Name, &workspace.CreatedAt, &workspace.Plan, &workspace.Role)
+	if err != nil {
+		return nil, err
+	}
+	return workspace, nil
+}
+
+// ListWorkspaces returns the workspaces userID belongs to, oldest first
+func (db *Database) ListWorkspaces(ctx context.Context, userID int) ([]*Workspace, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	query := `
+		SELECT ` + workspaceColumns + `
+		FROM workspaces w JOIN workspace_members m ON m.workspace_id = w.id
+		WHERE m.user_id = $1
+		ORDER BY w.id`
+	rows, err := db.conn.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	workspaces := []*Workspace{}
+	for rows.Next() {
+		workspace := &Workspace{}
+		if err := rows.Scan(&workspace.ID, &workspace.Name, &workspace.CreatedAt, &workspace.Plan, &workspace.Role); err != nil {
+			return nil, err
+		}
+		workspaces = append(workspaces, workspace)
+	}
+	return workspaces, rows.Err()
+}
+
+// SetCurrentWorkspace switches the workspace a user is working in
+func (db *Database) SetCurrentWorkspace(ctx context.Context, userID int, workspaceID *int) error {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	_, err := db.conn.ExecContext(ctx, `UPDATE users SET current_workspace_id = $2, updated_at = NOW() WHERE id = $1`, userID, workspaceID)
+	return err
+}
+
+// ListMembers returns a workspace's members in the order they joined
+func (db *Database) ListMembers(ctx context.Context, workspaceID int) ([]*WorkspaceMember, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	query := `
+		SELECT u.id, u.user_id, m.role, m.joined_at
+		FROM workspace_members m JOIN users u ON u.id = m.user_id
+		WHERE m.workspace_id = $1
+		ORDER BY m.joined_at, u.id`
+	rows, err := db.conn.QueryContext(ctx, query, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []*WorkspaceMember{}
+	for rows.Next() {
+		member := &WorkspaceMember{}
+		if err := rows.Scan(&member.ID, &member.UserID, &member.Role, &member.JoinedAt); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+// inviteColumns lists the columns scanned by scanInvite
+const inviteColumns = `
+	SELECT i.id, i.workspace_id, w.name, i.user_id, u.user_id, i.role, COALESCE(b.user_id, ''), i.created_at
+	FROM workspace_invites i
+	JOIN workspaces w ON w.id = i.workspace_id
+	JOIN users u ON u.id = i.user_id
+	LEFT JOIN users b ON b.id = i.invited_by`
+
+// scanInvite reads a row selected with inviteColumns
+func scanInvite(row rowScanner) (*WorkspaceInvite, error) {
+	invite := &WorkspaceInvite{}
+	err := row.Scan(&invite.ID, &invite.WorkspaceID, &invite.WorkspaceName, &invite.InviteeID, &invite.UserID,
+		&invite.Role, &invite.InvitedBy, &invite.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return invite, nil
+}
+
+// CreateInvite invites a user to a workspace, replacing any pending invite for them
+func (db *Database) CreateInvite(ctx context.Context, workspaceID, inviteeID int, role string, invitedBy int) (*WorkspaceInvite, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	var id int
+	err := db.conn.QueryRowContext(ctx, `
+		INSERT INTO workspace_invites (workspace_id, user_id, role, invited_by)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (workspace_id, user_id) DO UPDATE
+		SET role = EXCLUDED.role, invited_by = EXCLUDED.invited_by, created_at = NOW()
+		RETURNING id`, workspaceID, inviteeID, role, invitedBy).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+	return db.GetInvite(ctx, id)
+}
+
+// GetInvite returns an invite by ID
+func (db *Database) GetInvite(ctx context.Context, id int) (*WorkspaceInvite, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	return scanInvite(db.conn.QueryRowContext(ctx, inviteColumns+` WHERE i.id = $1`, id))
+}
+
+// ListInvites returns the pending invites for a user, newest first
+func (db *Database) ListInvites(ctx context.Context, userID int) ([]*WorkspaceInvite, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	rows, err := db.conn.QueryContext(ctx, inviteColumns+` WHERE i.user_id = $1 ORDER BY i.created_at DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := []*WorkspaceInvite{}
+	for rows.Next() {
+		invite, err := scanInvite(rows)
+		if err != nil {
+			return nil, err
+		}
+		invites = append(invites, invite)
+	}
+	return invites, rows.Err()
+}
+
+// AcceptInvite adds the invitee to the workspace and removes the invite
+func (db *Database) AcceptInvite(ctx context.Context, invite *WorkspaceInvite) (*Workspace, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO workspace_members (workspace_id, user_id, role) VALUES ($1, $2, $3)
+		ON CONFLICT (workspace_id, user_id) DO NOTHING`,
+		invite.WorkspaceID, invite.InviteeID, invite.Role); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM workspace_invites WHERE id = $1`, invite.ID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return db.GetMembership(ctx, invite.WorkspaceID, invite.InviteeID)
+}
+
+// DeleteInvite removes an invite
+func (db *Database) DeleteInvite(ctx context.Context, id int) error {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	_, err := db.conn.ExecContext(ctx, `DELETE FROM workspace_invites WHERE id = $1`, id)
+	return err
+}
+
+// SetMemberRole changes a member's role, refusing to demote the last owner
+func (db *Database) SetMemberRole(ctx context.Context, workspaceID, userID int, role string) error {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if role != WorkspaceOwner {
+		if err := checkOtherOwners(ctx, tx, workspaceID, userID); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE workspace_members SET role = $3 WHERE workspace_id = $1 AND user_id = $2`,
+		workspaceID, userID, role); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RemoveMember removes a user from a workspace, refusing to remove the last
+// owner. The user is switched back to personal links if they were working in it.
+func (db *Database) RemoveMember(ctx context.Context, workspaceID, userID int) error {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := checkOtherOwners(ctx, tx, workspaceID, userID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM workspace_members WHERE workspace_id = $1 AND user_id = $2`, workspaceID, userID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE users SET current_workspace_id = NULL WHERE id = $2 AND current_workspace_id = $1`,
+		workspaceID, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// checkOtherOwners returns ErrLastOwner if userID is the workspace's only owner.
+// The owner rows stay locked until tx ends so concurrent demotions can't race.
+func checkOtherOwners(ctx context.Context, tx *sql.Tx, workspaceID, userID int) error {
+	rows, err := tx.QueryContext(ctx, `SELECT user_id FROM workspace_members WHERE workspace_id = $1 AND role = $2 FOR UPDATE`,
+		workspaceID, WorkspaceOwner)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	isOwner, others := false, 0
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		if id == userID {
+			isOwner = true
+		} else {
+			others++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if isOwner && others == 0 {
+		return ErrLastOwner
+	}
+	return nil
+}
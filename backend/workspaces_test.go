@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestHasWorkspaceRole(t *testing.T) {
+	tests := []struct {
+		role string
+		need string
+		want bool
+	}{
+		{WorkspaceViewer, WorkspaceViewer, true},
+		{WorkspaceViewer, WorkspaceEditor, false},
+		{WorkspaceViewer, WorkspaceOwner, false},
+		{WorkspaceEditor, WorkspaceViewer, true},
+		{WorkspaceEditor, WorkspaceEditor, true},
+		{WorkspaceEditor, WorkspaceOwner, false},
+		{WorkspaceOwner, WorkspaceViewer, true},
+		{WorkspaceOwner, WorkspaceEditor, true},
+		{WorkspaceOwner, WorkspaceOwner, true},
+		{"", WorkspaceViewer, false},
+		{RoleAdmin, WorkspaceViewer, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.role+"/"+tt.need, func(t *testing.T) {
+			if got := hasWorkspaceRole(tt.role, tt.need); got != tt.want {
+				t.Errorf("hasWorkspaceRole(%q, %q) = %v, want %v", tt.role, tt.need, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateWorkspaceRole(t *testing.T) {
+	tests := []struct {
+		role    string
+		wantErr bool
+	}{
+		{WorkspaceViewer, false},
+		{WorkspaceEditor, false},
+		{WorkspaceOwner, false},
+		{"", true},
+		{"Owner", true},
+		{RoleAdmin, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.role, func(t *testing.T) {
+			if err := ValidateWorkspaceRole(tt.role); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateWorkspaceRole(%q) = %v, want error %v", tt.role, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -20,12 +20,45 @@ function App() {
     }
   }, []);
 
+  // Finish linking an SSO account; the backend puts the result in the URL fragment
+  useEffect(() => {
+    const result = new URLSearchParams(window.location.hash.slice(1));
+    const token = localStorage.getItem('authToken');
+    if (!result.has('link_result') || !token) {
+      return;
+    }
+    window.history.replaceState(null, '', window.location.pathname + window.location.search);
+
+    fetch('http://localhost:8080/api/oidc/link/complete', {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json', Authorization: `Bearer ${token}` },
+      body: JSON.stringify({ link_result: result.get('link_result') }),
+    })
+      .then(async (response) => {
+        if (response.ok) {
+          window.alert('Your SSO account is now linked');
+          return;
+        }
+        const data = await response.json().catch(() => ({}));
+        window.alert(data.detail || 'Could not link your SSO account');
+      })
+      .catch((err) => console.error('Linking SSO account failed:', err));
+  }, []);
+
   const handleLogin = (userId) => {
     setUser(userId);
     setCurrentPage('dashboard');
   };
 
   const handleLogout = () => {
+    const token = localStorage.getItem('authToken');
+    if (token) {
+      // End the server-side session; the local logout happens regardless
+      fetch('http://localhost:8080/api/logout', {
+        method: 'POST',
+        headers: { Authorization: `Bearer ${token}` },
+      }).catch((err) => console.error('Logout request failed:', err));
+    }
     localStorage.removeItem('authToken');
     localStorage.removeItem('userId');
     setUser(null);
@@ -1,4 +1,4 @@
-import React, { useState } from 'react';
+import React, { useState, useEffect } from 'react';
 import './Auth.css';
 
 const Auth = ({ onLogin }) => {
@@ -10,6 +10,28 @@ const Auth = ({ onLogin }) => {
   });
   const [loading, setLoading] = useState(false);
   const [error, setError] = useState('');
+  // Set when the password was accepted but a two-factor code is still needed
+  const [challengeToken, setChallengeToken] = useState('');
+  const [mfaCode, setMfaCode] = useState('');
+
+  // Pick up the result of an SSO sign-in, which the backend puts in the URL fragment
+  useEffect(() => {
+    const result = new URLSearchParams(window.location.hash.slice(1));
+    if (!result.has('token') && !result.has('mfa_required') && !result.has('error')) {
+      return;
+    }
+    window.history.replaceState(null, '', window.location.pathname + window.location.search);
+
+    if (result.get('token')) {
+      localStorage.setItem('authToken', result.get('token'));
+      localStorage.setItem('userId', result.get('user_id'));
+      onLogin(result.get('user_id'));
+    } else if (result.get('mfa_required')) {
+      setChallengeToken(result.get('challenge_token'));
+    } else {
+      setError(result.get('error'));
+    }
+  }, [onLogin]);
 
   const handleInputChange = (e) => {
     setFormData({
@@ -24,6 +46,11 @@ const Auth = ({ onLogin }) => {
     setLoading(true);
     setError('');
 
+    if (challengeToken) {
+      await submitMfaCode();
+      return;
+    }
+
     // Validation
     if (!formData.userId || !formData.password) {
       setError('Please fill in all fields');
@@ -56,9 +83,40 @@ const Auth = ({ onLogin }) => {
         localStorage.setItem('authToken', data.token || 'dummy-token');
         localStorage.setItem('userId', formData.userId);
         onLogin(formData.userId);
+      } else if (data.code === 'mfa_required') {
+        setChallengeToken(data.challenge_token);
       } else {
         // Backend sends error message in 'message' field, not 'error'
-        setError(data.message || data.error || (isLogin ? 'Login failed' : 'Sign up failed'));
+        setError(data.detail || data.message || (isLogin ? 'Login failed' : 'Sign up failed'));
+      }
+    } catch (err) {
+      setError('Cannot connect to server. Please try again.');
+    } finally {
+      setLoading(false);
+    }
+  };
+
+  const submitMfaCode = async () => {
+    try {
+      const response = await fetch('http://localhost:8080/api/login/mfa', {
+        method: 'POST',
+        headers: {
+          'Content-Type': 'application/json',
+        },
+        body: JSON.stringify({
+          challenge_token: challengeToken,
+          code: mfaCode
+        })
+      });
+
+      const data = await response.json();
+
+      if (response.ok) {
+        localStorage.setItem('authToken', data.token);
+        localStorage.setItem('userId', data.user_id);
+        onLogin(data.user_id);
+      } else {
+        setError(data.detail || 'Invalid code');
       }
     } catch (err) {
       setError('Cannot connect to server. Please try again.');
@@ -76,6 +134,22 @@ const Auth = ({ onLogin }) => {
         </div>
         
         <form onSubmit={handleSubmit} className="auth-form">
+          {challengeToken ? (
+            <div className="form-group">
+              <label htmlFor="mfaCode">Authentication Code</label>
+              <input
+                type="text"
+                id="mfaCode"
+                name="mfaCode"
+                value={mfaCode}
+                onChange={(e) => { setMfaCode(e.target.value); setError(''); }}
+                placeholder="6-digit code or recovery code"
+                autoComplete="one-time-code"
+                required
+              />
+            </div>
+          ) : (
+          <>
           <div className="form-group">
             <label htmlFor="userId">User ID</label>
             <input
@@ -116,14 +190,26 @@ const Auth = ({ onLogin }) => {
               />
             </div>
           )}
+          </>
+          )}
 
           {error && <div className="error-message">{error}</div>}
 
           <button type="submit" className="auth-button" disabled={loading}>
-            {loading ? 'Processing...' : (isLogin ? 'Sign In' : 'Sign Up')}
+            {loading ? 'Processing...' : (challengeToken ? 'Verify' : (isLogin ? 'Sign In' : 'Sign Up'))}
           </button>
         </form>
 
+        {isLogin && !challengeToken && (
+          <button
+            type="button"
+            className="auth-button"
+            onClick={() => { window.location.href = 'http://localhost:8080/api/oidc/login'; }}
+          >
+            Sign in with SSO
+          </button>
+        )}
+
         <div className="auth-toggle">
           <p>
             {isLogin ? "Don't have an account? " : "Already have an account? "}
@@ -133,6 +219,8 @@ const Auth = ({ onLogin }) => {
               onClick={() => {
                 setIsLogin(!isLogin);
                 setError('');
+                setChallengeToken('');
+                setMfaCode('');
                 setFormData({ userId: '', password: '', confirmPassword: '' });
               }}
             >
@@ -30,13 +30,15 @@ const CreateShortUrl = ({ onBack }) => {
         requestData.expires_in_days = parseInt(expiresInDays);
       }
 
-      const response = await axios.post('http://localhost:8080/api/shorten', requestData);
+      const token = localStorage.getItem('authToken');
+      const headers = token ? { Authorization: `Bearer ${token}` } : {};
+      const response = await axios.post('http://localhost:8080/api/shorten', requestData, { headers });
       setShortUrl(response.data.short_url);
     } catch (err) {
       console.error('Error occurred:', err);
       
       if (err.response) {
-        setError(err.response.data?.error || `Server error: ${err.response.status}`);
+        setError(err.response.data?.detail || err.response.data?.error || `Server error: ${err.response.status}`);
       } else if (err.request) {
         setError('Cannot connect to server. Make sure the backend is running on port 8080.');
       } else {
@@ -30,7 +30,7 @@ const UrlShortener = () => {
       
       if (err.response) {
         // Server responded with error status
-        setError(err.response.data?.error || `Server error: ${err.response.status}`);
+        setError(err.response.data?.detail || err.response.data?.error || `Server error: ${err.response.status}`);
       } else if (err.request) {
         // Request was made but no response received
         setError('Cannot connect to server. Make sure the backend is running on port 8080.');